@@ -142,7 +142,11 @@ func writeProps() error {
 		ImageVersion      string `json:"version"`
 	}
 	type QEMU struct {
-		Image string `json:"image"`
+		Image    string `json:"image"`
+		Firmware string `json:"firmware"`
+		BootMode string `json:"boot"`
+		ISO      string `json:"iso"`
+		IPMode   string `json:"ipMode"`
 	}
 	return enc.Encode(&struct {
 		Cmdline  []string `json:"cmdline"`
@@ -173,7 +177,11 @@ func writeProps() error {
 			ImageVersion:      kola.PacketOptions.ImageVersion,
 		},
 		QEMU: QEMU{
-			Image: kola.QEMUOptions.DiskImage,
+			Image:    kola.QEMUOptions.DiskImage,
+			Firmware: kola.QEMUOptions.Firmware,
+			BootMode: kola.QEMUOptions.BootMode,
+			ISO:      kola.QEMUOptions.ISOImage,
+			IPMode:   kola.QEMUOptions.IPMode,
 		},
 	})
 }
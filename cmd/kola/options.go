@@ -17,10 +17,14 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/coreos/mantle/auth"
 	"github.com/coreos/mantle/kola"
+	"github.com/coreos/mantle/network"
+	"github.com/coreos/mantle/platform/local"
+	"github.com/coreos/mantle/platform/machine/qemu"
 	"github.com/coreos/mantle/sdk"
 )
 
@@ -28,16 +32,7 @@ var (
 	outputDir          string
 	kolaPlatform       string
 	defaultTargetBoard = sdk.DefaultBoard()
-	kolaPlatforms      = []string{"aws", "gce", "packet", "qemu"}
-	kolaDefaultImages  = map[string]string{
-		"amd64-usr": sdk.BuildRoot() + "/images/amd64-usr/latest/coreos_production_image.bin",
-		"arm64-usr": sdk.BuildRoot() + "/images/arm64-usr/latest/coreos_production_image.bin",
-	}
-
-	kolaDefaultBIOS = map[string]string{
-		"amd64-usr": "bios-256k.bin",
-		"arm64-usr": sdk.BuildRoot() + "/images/arm64-usr/latest/coreos_production_qemu_uefi_efi_code.fd",
-	}
+	kolaPlatforms      = []string{"aws", "external", "gce", "nspawn", "packet", "qemu", "qemu-unpriv"}
 )
 
 func init() {
@@ -50,11 +45,28 @@ func init() {
 	root.PersistentFlags().IntVar(&kola.TestParallelism, "parallel", 1, "number of tests to run in parallel")
 	sv(&kola.TAPFile, "tapfile", "", "file to write TAP results to")
 	sv(&kola.Options.BaseName, "basename", "kola", "Cluster name prefix")
+	bv(&kola.ConsoleHostKeys, "ssh-console-host-keys", false, "verify machine SSH host keys against the fingerprints on their console")
+	bv(&kola.Diagnostics, "diagnostics", true, "collect a diagnostics bundle from each machine of a failed test")
+	sv(&kola.Options.Proxy, "proxy", "", "socks5://, socks5h://, http:// or https:// proxy for cloud APIs and SSH (default $ALL_PROXY for SSH, $HTTPS_PROXY or $HTTP_PROXY for APIs)")
 
 	// QEMU-specific options
 	sv(&kola.QEMUOptions.Board, "board", defaultTargetBoard, "target board")
 	sv(&kola.QEMUOptions.DiskImage, "qemu-image", "", "path to CoreOS disk image")
 	sv(&kola.QEMUOptions.BIOSImage, "qemu-bios", "", "BIOS to use for QEMU vm")
+	sv(&kola.QEMUOptions.Firmware, "qemu-firmware", qemu.FirmwareBIOS, "QEMU firmware: "+strings.Join(qemu.Firmwares, ", "))
+	sv(&kola.QEMUOptions.UEFICode, "qemu-uefi-code", "", "UEFI code image for QEMU vm (default board-dependent)")
+	sv(&kola.QEMUOptions.UEFIVars, "qemu-uefi-vars", "", "UEFI variable store template for QEMU vm (default board-dependent)")
+	sv(&kola.QEMUOptions.BootMode, "qemu-boot", qemu.BootDisk, "QEMU boot mode: "+strings.Join(qemu.BootModes, ", "))
+	sv(&kola.QEMUOptions.PXEKernel, "qemu-pxe-kernel", "", "PXE kernel for QEMU vm (default board-dependent)")
+	sv(&kola.QEMUOptions.PXEInitrd, "qemu-pxe-initrd", "", "PXE initramfs for QEMU vm (default board-dependent)")
+	sv(&kola.QEMUOptions.ISOImage, "qemu-iso", "", "ISO image for QEMU vm (default board-dependent)")
+	sv(&kola.QEMUOptions.TFTPRoot, "qemu-tftp-root", "", "directory of iPXE binaries to serve over TFTP")
+	bv(&kola.QEMUOptions.TPM, "qemu-tpm", false, "attach an emulated TPM 2.0 to QEMU vms")
+	sv(&kola.QEMUOptions.BlankDiskSize, "qemu-blank-disk-size", "", "size of an empty disk to attach to network or ISO booted QEMU vms")
+	sv(&kola.QEMUOptions.IPMode, "qemu-ip-mode", local.IPModeDual, "QEMU cluster network address families: "+strings.Join(local.IPModes, ", "))
+	root.PersistentFlags().StringSliceVar(&kola.QEMUOptions.RegistryArchives, "qemu-registry-archive", nil, "docker save tarball of images to serve to QEMU vms from a local registry")
+	root.PersistentFlags().IntVar(&kola.QEMUOptions.EtcdMembers, "qemu-etcd-members", 1, "number of members of the local etcd cluster serving QEMU vms")
+	sv(&kola.QEMUOptions.SnapshotCacheDir, "qemu-snapshot-cache", "", "directory caching booted QEMU vm snapshots for tests that allow them")
 
 	// gce-specific options
 	sv(&kola.GCEOptions.Image, "gce-image", "projects/coreos-cloud/global/images/family/coreos-alpha", "GCE image, full api endpoints names are accepted if resource is in a different project")
@@ -65,6 +77,9 @@ func init() {
 	sv(&kola.GCEOptions.Network, "gce-network", "default", "GCE network")
 	bv(&kola.GCEOptions.ServiceAuth, "gce-service-auth", false, "for non-interactive auth when running within GCE")
 	sv(&kola.GCEOptions.JSONKeyFile, "gce-json-key", "", "use a service account's JSON key for authentication")
+	sv(&kola.GCEOptions.Bastion, "gce-bastion", "", "SSH jump host ([user@]host[:port]) to reach GCE vms without external IPs through")
+	sv(&kola.GCEOptions.BastionKey, "gce-bastion-key", "", "private key file for the GCE jump host (default $SSH_AUTH_SOCK)")
+	sv(&kola.GCEOptions.BastionKnownHosts, "gce-bastion-known-hosts", "", "known_hosts file with the GCE jump host's key (default trust on first use)")
 
 	// aws-specific options
 	defaultRegion := os.Getenv("AWS_REGION")
@@ -76,6 +91,12 @@ func init() {
 	sv(&kola.AWSOptions.AMI, "aws-ami", "alpha", `AWS AMI ID, or (alpha|beta|stable) to use the latest image`)
 	sv(&kola.AWSOptions.InstanceType, "aws-type", "t2.small", "AWS instance type")
 	sv(&kola.AWSOptions.SecurityGroup, "aws-sg", "kola", "AWS security group name")
+	sv(&kola.AWSOptions.Bastion, "aws-bastion", "", "SSH jump host ([user@]host[:port]) to reach AWS instances through by private IP")
+	sv(&kola.AWSOptions.BastionKey, "aws-bastion-key", "", "private key file for the AWS jump host (default $SSH_AUTH_SOCK)")
+	sv(&kola.AWSOptions.BastionKnownHosts, "aws-bastion-known-hosts", "", "known_hosts file with the AWS jump host's key (default trust on first use)")
+
+	// external-specific options
+	sv(&kola.ExternalOptions.Inventory, "external-inventory", "", "JSON inventory file of pre-provisioned machines")
 
 	// packet-specific options
 	sv(&kola.PacketOptions.ConfigPath, "packet-config-file", "", "Packet config file (default \"~/"+auth.PacketConfigPath+"\")")
@@ -106,17 +127,42 @@ func syncOptions() error {
 		return fmt.Errorf("unsupport platform %q", kolaPlatform)
 	}
 
-	image, ok := kolaDefaultImages[kola.QEMUOptions.Board]
-	if !ok {
+	// without --proxy, the API clients already honor $HTTPS_PROXY
+	// and $HTTP_PROXY
+	if kola.Options.Proxy == "" {
+		kola.Options.Proxy = network.ProxyFromEnvironment()
+	} else if err := network.SetHTTPProxy(kola.Options.Proxy); err != nil {
+		return err
+	}
+
+	if _, ok := qemu.Boards[kola.QEMUOptions.Board]; !ok {
 		return fmt.Errorf("unsupport board %q", kola.QEMUOptions.Board)
 	}
+	imageDir := sdk.BuildImageDir(kola.QEMUOptions.Board, "latest")
 
 	if kola.QEMUOptions.DiskImage == "" {
-		kola.QEMUOptions.DiskImage = image
+		kola.QEMUOptions.DiskImage = filepath.Join(sdk.BuildRoot(), "images", kola.QEMUOptions.Board, "latest", "coreos_production_image.bin")
+	}
+
+	if err := kola.QEMUOptions.SetDefaultFirmware(imageDir); err != nil {
+		return err
 	}
 
-	if kola.QEMUOptions.BIOSImage == "" {
-		kola.QEMUOptions.BIOSImage = kolaDefaultBIOS[kola.QEMUOptions.Board]
+	switch kola.QEMUOptions.BootMode {
+	case qemu.BootDisk:
+	case qemu.BootPXE:
+		if kola.QEMUOptions.PXEKernel == "" {
+			kola.QEMUOptions.PXEKernel = filepath.Join(imageDir, "coreos_production_pxe.vmlinuz")
+		}
+		if kola.QEMUOptions.PXEInitrd == "" {
+			kola.QEMUOptions.PXEInitrd = filepath.Join(imageDir, "coreos_production_pxe_image.cpio.gz")
+		}
+	case qemu.BootISO:
+		if kola.QEMUOptions.ISOImage == "" {
+			kola.QEMUOptions.ISOImage = filepath.Join(imageDir, "coreos_production_iso_image.iso")
+		}
+	default:
+		return fmt.Errorf("unsupported qemu boot mode %q", kola.QEMUOptions.BootMode)
 	}
 
 	return nil
@@ -17,11 +17,17 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/spf13/cobra"
 
 	"github.com/coreos/mantle/kola"
+	"github.com/coreos/mantle/network"
 	"github.com/coreos/mantle/platform"
 	"github.com/coreos/mantle/platform/conf"
 )
@@ -39,14 +45,28 @@ var (
 	spawnShell     bool
 	spawnRemove    bool
 	spawnVerbose   bool
+	spawnForwards  []string
 )
 
+// portForwarder is implemented by clusters whose machines are only
+// reachable inside a private network namespace.
+type portForwarder interface {
+	ForwardPort(localAddr, remoteAddr string) (*network.PortForwarder, error)
+}
+
+// forwardSpec is a parsed --forward argument.
+type forwardSpec struct {
+	local  int // 0 picks a free port
+	remote int
+}
+
 func init() {
 	cmdSpawn.Flags().IntVarP(&spawnNodeCount, "nodecount", "c", 1, "number of nodes to spawn")
 	cmdSpawn.Flags().StringVarP(&spawnUserData, "userdata", "u", "", "userdata to pass to the instances")
 	cmdSpawn.Flags().BoolVarP(&spawnShell, "shell", "s", false, "spawn a shell in an instance before exiting")
 	cmdSpawn.Flags().BoolVarP(&spawnRemove, "remove", "r", true, "remove instances after shell exits")
 	cmdSpawn.Flags().BoolVarP(&spawnVerbose, "verbose", "v", false, "output information about spawned instances")
+	cmdSpawn.Flags().StringSliceVarP(&spawnForwards, "forward", "p", nil, "forward PORT or LOCALPORT:PORT of each instance to localhost; LOCALPORT is incremented for each instance")
 	root.AddCommand(cmdSpawn)
 }
 
@@ -73,6 +93,11 @@ func doSpawn(cmd *cobra.Command, args []string) error {
 		userdata = conf.Unknown(string(userbytes))
 	}
 
+	forwards, err := parseForwards(spawnForwards)
+	if err != nil {
+		return err
+	}
+
 	outputDir, err = kola.SetupOutputDir(outputDir, kolaPlatform)
 	if err != nil {
 		return fmt.Errorf("Setup failed: %v", err)
@@ -85,6 +110,11 @@ func doSpawn(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Cluster failed: %v", err)
 	}
 
+	forwarder, ok := cluster.(portForwarder)
+	if len(forwards) > 0 && !ok {
+		return fmt.Errorf("Forwarding ports is not supported on %s", kolaPlatform)
+	}
+
 	var someMach platform.Machine
 	for i := 0; i < spawnNodeCount; i++ {
 		mach, err := cluster.NewMachine(userdata)
@@ -100,6 +130,20 @@ func doSpawn(cmd *cobra.Command, args []string) error {
 			defer mach.Destroy()
 		}
 
+		for _, spec := range forwards {
+			local := 0
+			if spec.local != 0 {
+				local = spec.local + i
+			}
+			f, err := forwarder.ForwardPort(
+				net.JoinHostPort("127.0.0.1", strconv.Itoa(local)),
+				net.JoinHostPort(mach.IP(), strconv.Itoa(spec.remote)))
+			if err != nil {
+				return fmt.Errorf("Forwarding port failed: %v", err)
+			}
+			fmt.Printf("Forwarding %v to %s\n", f.LocalAddr(), f.RemoteAddr)
+		}
+
 		someMach = mach
 	}
 
@@ -107,6 +151,43 @@ func doSpawn(cmd *cobra.Command, args []string) error {
 		if err := platform.Manhole(someMach); err != nil {
 			return fmt.Errorf("Manhole failed: %v", err)
 		}
+	} else if len(forwards) > 0 {
+		// forwarding stops when kola exits
+		fmt.Println("Press Ctrl-C to stop forwarding")
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		signal.Stop(sig)
 	}
 	return nil
 }
+
+// parseForwards parses --forward arguments of the form PORT or
+// LOCALPORT:PORT.
+func parseForwards(args []string) ([]forwardSpec, error) {
+	var specs []forwardSpec
+	for _, arg := range args {
+		var spec forwardSpec
+		local, remote := "", arg
+		if i := strings.Index(arg, ":"); i >= 0 {
+			local, remote = arg[:i], arg[i+1:]
+		}
+
+		port, err := strconv.ParseUint(remote, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("Invalid port in forward %q", arg)
+		}
+		spec.remote = int(port)
+
+		if local != "" {
+			port, err := strconv.ParseUint(local, 10, 16)
+			if err != nil || port == 0 {
+				return nil, fmt.Errorf("Invalid local port in forward %q", arg)
+			}
+			spec.local = int(port)
+		}
+
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
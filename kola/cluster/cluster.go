@@ -43,17 +43,11 @@ func (t *TestCluster) Run(name string, f func(c TestCluster)) bool {
 func (t *TestCluster) RunNative(funcName string, m platform.Machine) bool {
 	command := fmt.Sprintf("./kolet run %q %q", t.Name(), funcName)
 	return t.Run(funcName, func(c TestCluster) {
-		client, err := m.SSHClient()
-		if err != nil {
-			c.Fatalf("kolet SSH client: %v", err)
-		}
-		defer client.Close()
-
-		session, err := client.NewSession()
+		session, release, err := platform.NewSSHSession(m)
 		if err != nil {
 			c.Fatalf("kolet SSH session: %v", err)
 		}
-		defer session.Close()
+		defer release()
 
 		b, err := session.CombinedOutput(command)
 		b = bytes.TrimSpace(b)
@@ -90,3 +84,15 @@ func (t *TestCluster) DropFile(localPath string) error {
 	}
 	return nil
 }
+
+// Upload copies the file or directory tree at localPath to remotePath
+// on m over SFTP, with the mode, owner and verification in opts.
+func (t *TestCluster) Upload(m platform.Machine, localPath, remotePath string, opts *platform.TransferOptions) error {
+	return platform.Upload(m, localPath, remotePath, opts)
+}
+
+// Download copies the file or directory tree at remotePath on m to
+// localPath over SFTP.
+func (t *TestCluster) Download(m platform.Machine, remotePath, localPath string, opts *platform.TransferOptions) error {
+	return platform.Download(m, remotePath, localPath, opts)
+}
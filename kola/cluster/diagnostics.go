@@ -0,0 +1,82 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/mantle/platform"
+)
+
+// Collector gathers one piece of a machine's diagnostics bundle by
+// running Cmd, recording its output in a file called Name.
+type Collector struct {
+	Name string
+	Cmd  string
+}
+
+// DefaultCollectors make up the diagnostics bundle of every machine in
+// a failed test. Tests can add their own in register.Test.
+var DefaultCollectors = []Collector{
+	{"failed-units.txt", "systemctl --failed --no-pager; systemctl list-units --failed --no-legend --plain | cut -d' ' -f1 | xargs -r sudo systemctl status --no-pager -l"},
+	{"ip-addr.txt", "ip addr"},
+	{"ip-route.txt", "ip route; ip -6 route"},
+	{"df.txt", "df -h"},
+	{"mounts.txt", "findmnt"},
+	{"dmesg.txt", "sudo dmesg"},
+	{"ignition.json", "sudo cat /run/ignition.json"},
+	{"selinux-denials.txt", "sudo journalctl -b -o short-precise --no-pager _TRANSPORT=audit | grep 'avc: *denied' || true"},
+	{"update-engine.txt", "update_engine_client -status"},
+}
+
+// CollectDiagnostics runs collectors on m, writing their output to dir.
+// Collectors that fail have their error recorded in place of their
+// output. An error is returned if none could run or ctx is done.
+func CollectDiagnostics(ctx context.Context, m platform.Machine, dir string, collectors []Collector) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+
+	var ran bool
+	for _, c := range collectors {
+		var buf bytes.Buffer
+		res, err := m.Exec(ctx, c.Cmd, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("collecting diagnostics from %s: %v", m.ID(), ctx.Err())
+			}
+			fmt.Fprintf(&buf, "# %s: %v\n", c.Cmd, err)
+		} else {
+			ran = true
+			buf.Write(res.Stdout)
+			if res.ExitStatus != 0 {
+				fmt.Fprintf(&buf, "\n# %s: exit status %d\n%s", c.Cmd, res.ExitStatus, res.Stderr)
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, c.Name), buf.Bytes(), 0666); err != nil {
+			return err
+		}
+	}
+
+	if !ran {
+		return fmt.Errorf("collecting diagnostics from %s: no collector could run", m.ID())
+	}
+	return nil
+}
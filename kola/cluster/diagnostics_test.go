@@ -0,0 +1,139 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/coreos/mantle/platform"
+)
+
+// diagMachine answers Exec with a result per command.
+type diagMachine struct {
+	fakeMachine
+	results map[string]*platform.ExecResult
+}
+
+func (m *diagMachine) Exec(ctx context.Context, cmd string, opts *platform.ExecOptions) (*platform.ExecResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if res, ok := m.results[cmd]; ok {
+		return res, nil
+	}
+	return nil, errors.New("connection refused")
+}
+
+func TestDefaultCollectors(t *testing.T) {
+	names := make(map[string]bool)
+	for _, c := range DefaultCollectors {
+		if c.Name == "" || c.Cmd == "" || strings.Contains(c.Name, "/") {
+			t.Errorf("bad collector %+v", c)
+		}
+		if names[c.Name] {
+			t.Errorf("collector name %q used twice", c.Name)
+		}
+		names[c.Name] = true
+	}
+	for _, name := range []string{"failed-units.txt", "dmesg.txt", "ignition.json"} {
+		if !names[name] {
+			t.Errorf("no %s in the default bundle", name)
+		}
+	}
+}
+
+func TestCollectDiagnostics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kola-diagnostics-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	collectors := []Collector{
+		{"ok.txt", "echo ok"},
+		{"failed.txt", "false"},
+		{"error.txt", "unreachable"},
+	}
+	m := &diagMachine{
+		fakeMachine: fakeMachine{id: "m1"},
+		results: map[string]*platform.ExecResult{
+			"echo ok": {Stdout: []byte("ok\n")},
+			"false":   {Stdout: []byte("partial\n"), Stderr: []byte("oops\n"), ExitStatus: 1},
+		},
+	}
+
+	bundle := filepath.Join(dir, "m1", "diagnostics")
+	if err := CollectDiagnostics(context.Background(), m, bundle, collectors); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	if strings.Join(names, " ") != "error.txt failed.txt ok.txt" {
+		t.Errorf("bundle has %q", names)
+	}
+
+	for name, expect := range map[string]string{
+		"ok.txt":     "ok\n",
+		"failed.txt": "partial\n\n# false: exit status 1\noops\n",
+		"error.txt":  "# unreachable: connection refused\n",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(bundle, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expect {
+			t.Errorf("%s: got %q, wanted %q", name, data, expect)
+		}
+	}
+}
+
+func TestCollectDiagnosticsFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kola-diagnostics-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &diagMachine{fakeMachine: fakeMachine{id: "m1"}}
+	collectors := []Collector{{"ip-addr.txt", "ip addr"}}
+
+	// an unreachable machine
+	if err := CollectDiagnostics(context.Background(), m, dir, collectors); err == nil {
+		t.Errorf("expected an error when no collector ran")
+	}
+
+	// running out of time
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.results = map[string]*platform.ExecResult{"ip addr": {}}
+	if err := CollectDiagnostics(ctx, m, dir, collectors); err == nil {
+		t.Errorf("expected an error for a cancelled context")
+	}
+}
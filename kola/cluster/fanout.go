@@ -0,0 +1,108 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/coreos/mantle/platform"
+)
+
+// MachineResult is the outcome of running a command on one machine.
+type MachineResult struct {
+	Machine platform.Machine
+
+	// ExecResult is nil if Err kept the command from completing.
+	*platform.ExecResult
+	Err error
+}
+
+// ok reports whether the command ran and exited successfully.
+func (r *MachineResult) ok() bool {
+	return r.Err == nil && r.ExitStatus == 0
+}
+
+// ExecAll runs cmd concurrently on machines, or on every machine in the
+// cluster if none are given. Results are in the order of the machines.
+func (t *TestCluster) ExecAll(cmd string, machines ...platform.Machine) []MachineResult {
+	if len(machines) == 0 {
+		machines = t.Machines()
+	}
+	return execAll(t.Context(), cmd, machines)
+}
+
+func execAll(ctx context.Context, cmd string, machines []platform.Machine) []MachineResult {
+	results := make([]MachineResult, len(machines))
+	var wg sync.WaitGroup
+	for i, m := range machines {
+		wg.Add(1)
+		go func(r *MachineResult, m platform.Machine) {
+			defer wg.Done()
+			r.Machine = m
+			r.ExecResult, r.Err = m.Exec(ctx, cmd, nil)
+		}(&results[i], m)
+	}
+	wg.Wait()
+	return results
+}
+
+// MustExecAll runs cmd like ExecAll, failing the test with a table of
+// the results if it failed on any machine.
+func (t *TestCluster) MustExecAll(cmd string, machines ...platform.Machine) []MachineResult {
+	results := t.ExecAll(cmd, machines...)
+	for i := range results {
+		if !results[i].ok() {
+			t.Fatalf("%q failed:\n%s", cmd, resultTable(results))
+		}
+	}
+	return results
+}
+
+// MustExecAllSame runs cmd like MustExecAll, also failing the test
+// unless every machine printed the same output, which is returned.
+func (t *TestCluster) MustExecAllSame(cmd string, machines ...platform.Machine) []byte {
+	results := t.MustExecAll(cmd, machines...)
+	if len(results) == 0 {
+		t.Fatalf("%q: no machines to compare output of", cmd)
+	}
+	for _, r := range results[1:] {
+		if !bytes.Equal(r.Stdout, results[0].Stdout) {
+			t.Fatalf("%q output differs between machines:\n%s", cmd, resultTable(results))
+		}
+	}
+	return bytes.TrimSpace(results[0].Stdout)
+}
+
+// resultTable formats results for test failure messages.
+func resultTable(results []MachineResult) string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "MACHINE\tSTATUS\tSTDOUT\tSTDERR\n")
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			fmt.Fprintf(w, "%s\terror: %v\t\t\n", r.Machine.ID(), r.Err)
+		default:
+			fmt.Fprintf(w, "%s\t%d\t%q\t%q\n", r.Machine.ID(), r.ExitStatus,
+				bytes.TrimSpace(r.Stdout), bytes.TrimSpace(r.Stderr))
+		}
+	}
+	w.Flush()
+	return buf.String()
+}
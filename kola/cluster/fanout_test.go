@@ -0,0 +1,115 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/coreos/mantle/platform"
+)
+
+// fakeMachine answers Exec with a canned result.
+type fakeMachine struct {
+	id  string
+	res *platform.ExecResult
+	err error
+
+	cmd string
+}
+
+func (m *fakeMachine) ID() string                      { return m.id }
+func (m *fakeMachine) IP() string                      { return "" }
+func (m *fakeMachine) PrivateIP() string               { return "" }
+func (m *fakeMachine) SSHClient() (*ssh.Client, error) { return nil, errors.New("no SSH") }
+func (m *fakeMachine) PasswordSSHClient(user string, password string) (*ssh.Client, error) {
+	return nil, errors.New("no SSH")
+}
+func (m *fakeMachine) SSH(cmd string) ([]byte, error) { return nil, errors.New("no SSH") }
+func (m *fakeMachine) Reboot() error                  { return nil }
+func (m *fakeMachine) Destroy() error                 { return nil }
+func (m *fakeMachine) ConsoleOutput() string          { return "" }
+
+func (m *fakeMachine) Exec(ctx context.Context, cmd string, opts *platform.ExecOptions) (*platform.ExecResult, error) {
+	m.cmd = cmd
+	return m.res, m.err
+}
+
+func TestExecAll(t *testing.T) {
+	machines := []platform.Machine{
+		&fakeMachine{id: "a", res: &platform.ExecResult{Stdout: []byte("one\n")}},
+		&fakeMachine{id: "b", res: &platform.ExecResult{Stdout: []byte("two\n"), ExitStatus: 1}},
+		&fakeMachine{id: "c", err: errors.New("connection refused")},
+	}
+
+	results := execAll(context.Background(), "true", machines)
+	if len(results) != len(machines) {
+		t.Fatalf("got %d results, wanted %d", len(results), len(machines))
+	}
+	for i, r := range results {
+		if r.Machine != machines[i] {
+			t.Errorf("result %d is for machine %s, wanted %s", i, r.Machine.ID(), machines[i].ID())
+		}
+		if cmd := machines[i].(*fakeMachine).cmd; cmd != "true" {
+			t.Errorf("machine %s ran %q", r.Machine.ID(), cmd)
+		}
+	}
+	if !results[0].ok() || results[1].ok() || results[2].ok() {
+		t.Errorf("got ok %v %v %v, wanted true false false",
+			results[0].ok(), results[1].ok(), results[2].ok())
+	}
+}
+
+func TestResultTable(t *testing.T) {
+	results := []MachineResult{
+		{
+			Machine:    &fakeMachine{id: "machine-a"},
+			ExecResult: &platform.ExecResult{Stdout: []byte("one\n"), Stderr: []byte("warning\n")},
+		},
+		{
+			Machine:    &fakeMachine{id: "b"},
+			ExecResult: &platform.ExecResult{ExitStatus: 2},
+		},
+		{
+			Machine: &fakeMachine{id: "c"},
+			Err:     errors.New("connection refused"),
+		},
+	}
+
+	lines := strings.Split(strings.TrimSpace(resultTable(results)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, wanted 4:\n%s", len(lines), strings.Join(lines, "\n"))
+	}
+	for i, expect := range [][]string{
+		{"MACHINE", "STATUS", "STDOUT", "STDERR"},
+		{"machine-a", "0", `"one"`, `"warning"`},
+		{"b", "2", `""`, `""`},
+		{"c", "error:", "connection", "refused"},
+	} {
+		if fields := strings.Fields(lines[i]); strings.Join(fields, " ") != strings.Join(expect, " ") {
+			t.Errorf("line %d: got %q, wanted %q", i, fields, expect)
+		}
+	}
+
+	// columns line up
+	col := strings.Index(lines[0], "STATUS")
+	if strings.Index(lines[1], "0") != col || strings.Index(lines[3], "error:") != col {
+		t.Errorf("columns not aligned:\n%s", strings.Join(lines, "\n"))
+	}
+}
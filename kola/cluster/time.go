@@ -0,0 +1,139 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/mantle/network/ntp"
+	"github.com/coreos/mantle/platform"
+	"github.com/coreos/mantle/util"
+)
+
+// ntpCluster is implemented by clusters whose machines sync their clocks
+// with an NTP server the cluster controls.
+type ntpCluster interface {
+	GetNTPServer() *ntp.Server
+}
+
+// NTPServer returns the cluster's NTP server, skipping the test if the
+// platform doesn't provide one.
+func (t *TestCluster) NTPServer() *ntp.Server {
+	nc, ok := t.Cluster.(ntpCluster)
+	if !ok {
+		t.Skip("platform has no controllable NTP server")
+	}
+	return nc.GetNTPServer()
+}
+
+// SetTime has the NTP server serve the given time. Machines only follow
+// once they sync, see SyncTime.
+func (t *TestCluster) SetTime(now time.Time) {
+	t.NTPServer().SetTime(now)
+}
+
+// StepTime moves the time served by the NTP server by delta.
+func (t *TestCluster) StepTime(delta time.Duration) {
+	t.NTPServer().StepTime(delta)
+}
+
+// SlewTime gradually moves the time served by the NTP server by delta
+// over the given duration.
+func (t *TestCluster) SlewTime(delta, over time.Duration) {
+	t.NTPServer().SlewTime(delta, over)
+}
+
+// InsertLeapSecond announces a leap second inserted before at, which
+// must be midnight UTC on the first day of a month.
+func (t *TestCluster) InsertLeapSecond(at time.Time) {
+	t.NTPServer().SetLeapSecond(at, ntp.LEAP_ADD)
+}
+
+// DeleteLeapSecond announces a leap second deleted before at, which
+// must be midnight UTC on the first day of a month.
+func (t *TestCluster) DeleteLeapSecond(at time.Time) {
+	t.NTPServer().SetLeapSecond(at, ntp.LEAP_SUB)
+}
+
+// SetLeapSmear has the NTP server smear leap seconds over the given
+// window instead of announcing them.
+func (t *TestCluster) SetLeapSmear(window time.Duration) {
+	t.NTPServer().SetLeapSmear(window)
+}
+
+// SyncTime has timesyncd on m resync with the NTP server immediately,
+// stepping its clock if needed, and waits until it has.
+func SyncTime(m platform.Machine) error {
+	if out, err := m.SSH("sudo systemctl restart systemd-timesyncd.service"); err != nil {
+		return fmt.Errorf("restarting timesyncd: %s: %v", out, err)
+	}
+
+	return util.Retry(60, time.Second, func() error {
+		out, err := m.SSH("systemctl status systemd-timesyncd.service")
+		if err != nil {
+			return fmt.Errorf("systemctl: %v", err)
+		}
+		if !bytes.Contains(out, []byte(`Status: "Synchronized to time server`)) {
+			return fmt.Errorf("timesyncd not synchronized:\n%s", out)
+		}
+		return nil
+	})
+}
+
+// MachineTime returns the current time on m's clock.
+func MachineTime(m platform.Machine) (time.Time, error) {
+	out, err := m.SSH("date +%s.%N")
+	if err != nil {
+		return time.Time{}, fmt.Errorf("date: %s: %v", out, err)
+	}
+
+	parts := strings.SplitN(strings.TrimSpace(string(out)), ".", 2)
+	if len(parts) != 2 {
+		return time.Time{}, fmt.Errorf("unexpected date output %q", out)
+	}
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	nsec, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, nsec), nil
+}
+
+// CheckTime returns an error unless m's clock is within tolerance of the
+// time served by the cluster's NTP server while m was asked for it, so
+// the SSH round trip doesn't count against the tolerance.
+func (t *TestCluster) CheckTime(m platform.Machine, tolerance time.Duration) error {
+	before := t.NTPServer().Now()
+	mtime, err := MachineTime(m)
+	if err != nil {
+		return err
+	}
+	after := t.NTPServer().Now()
+
+	if mtime.Before(before.Add(-tolerance)) {
+		return fmt.Errorf("machine time %s is %s behind NTP time %s", mtime.UTC(), before.Sub(mtime), before.UTC())
+	}
+	if mtime.After(after.Add(tolerance)) {
+		return fmt.Errorf("machine time %s is %s ahead of NTP time %s", mtime.UTC(), mtime.Sub(after), after.UTC())
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/coreos/mantle/platform"
+	"github.com/coreos/mantle/util"
+)
+
+// waitInterval is how often WaitFor checks a condition.
+const waitInterval = time.Second
+
+// Condition is a state of a machine to wait for. Cmd observes the state
+// and Check reports whether its result shows the condition holds.
+// Failing to run Cmd, e.g. while the machine reboots, just means the
+// condition doesn't hold yet.
+type Condition struct {
+	// Desc describes the condition, e.g. "etcd2.service active".
+	Desc  string
+	Cmd   string
+	Check func(res *platform.ExecResult) bool
+}
+
+// UnitActive holds once systemd unit is active.
+func UnitActive(unit string) Condition {
+	return unitState(unit, "active")
+}
+
+// UnitFailed holds once systemd unit has failed.
+func UnitFailed(unit string) Condition {
+	return unitState(unit, "failed")
+}
+
+func unitState(unit, state string) Condition {
+	return Condition{
+		Desc: fmt.Sprintf("%s %s", unit, state),
+		Cmd:  "systemctl show -p ActiveState -p SubState -p Result " + util.ShellQuote(unit),
+		Check: func(res *platform.ExecResult) bool {
+			return res.ExitStatus == 0 && bytes.Contains(res.Stdout, []byte("ActiveState="+state+"\n"))
+		},
+	}
+}
+
+// PortListening holds once something listens on TCP port.
+func PortListening(port int) Condition {
+	return Condition{
+		Desc: fmt.Sprintf("TCP port %d listening", port),
+		// older ss lacks -H to leave out the header line
+		Cmd: fmt.Sprintf("ss -ltn 'sport = :%d'", port),
+		Check: func(res *platform.ExecResult) bool {
+			lines := strings.Split(string(bytes.TrimSpace(res.Stdout)), "\n")
+			return res.ExitStatus == 0 && len(lines) > 1
+		},
+	}
+}
+
+// FileExists holds once path exists.
+func FileExists(path string) Condition {
+	return Condition{
+		Desc: fmt.Sprintf("%s exists", path),
+		Cmd:  "sudo stat -c '%F, %s bytes' " + util.ShellQuote(path),
+		Check: func(res *platform.ExecResult) bool {
+			return res.ExitStatus == 0
+		},
+	}
+}
+
+// JournalMessage holds once a message logged this boot by unit, or by
+// anything if unit is empty, matches the regular expression pattern.
+func JournalMessage(unit, pattern string) Condition {
+	re := regexp.MustCompile(pattern)
+	cmd := "sudo journalctl -b -o cat --no-pager"
+	desc := fmt.Sprintf("journal message matching %q", pattern)
+	if unit != "" {
+		cmd += " -u " + util.ShellQuote(unit)
+		desc = fmt.Sprintf("%s message matching %q", unit, pattern)
+	}
+	return Condition{
+		Desc: desc,
+		Cmd:  cmd,
+		Check: func(res *platform.ExecResult) bool {
+			return res.ExitStatus == 0 && re.Match(res.Stdout)
+		},
+	}
+}
+
+// BootIDChanged holds once the machine has rebooted since it had boot
+// ID oldID, as returned by BootID.
+func BootIDChanged(oldID string) Condition {
+	return Condition{
+		Desc: fmt.Sprintf("boot ID other than %s", oldID),
+		Cmd:  "cat /proc/sys/kernel/random/boot_id",
+		Check: func(res *platform.ExecResult) bool {
+			id := string(bytes.TrimSpace(res.Stdout))
+			return res.ExitStatus == 0 && id != "" && id != oldID
+		},
+	}
+}
+
+// BootID returns the current boot ID of m.
+func BootID(ctx context.Context, m platform.Machine) (string, error) {
+	res, err := m.Exec(ctx, "cat /proc/sys/kernel/random/boot_id", nil)
+	if err != nil {
+		return "", err
+	}
+	if res.ExitStatus != 0 {
+		return "", fmt.Errorf("reading boot ID: %s", bytes.TrimSpace(res.Stderr))
+	}
+	return string(bytes.TrimSpace(res.Stdout)), nil
+}
+
+// WaitFor checks cond on m until it holds or ctx is done, returning an
+// error describing the last observed state in the latter case.
+func WaitFor(ctx context.Context, m platform.Machine, cond Condition) error {
+	var state string
+	for {
+		res, err := m.Exec(ctx, cond.Cmd, nil)
+		if err == nil && cond.Check(res) {
+			return nil
+		}
+		if ctx.Err() == nil {
+			state = observedState(res, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			if state == "" {
+				state = ctx.Err().Error()
+			}
+			return fmt.Errorf("machine %s: gave up waiting for %s; last observed:\n%s", m.ID(), cond.Desc, state)
+		case <-time.After(waitInterval):
+		}
+	}
+}
+
+// observedState formats the result of a condition's command.
+func observedState(res *platform.ExecResult, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+
+	var state []string
+	if res.ExitStatus != 0 {
+		state = append(state, fmt.Sprintf("exit status %d", res.ExitStatus))
+	}
+	if out := bytes.TrimSpace(res.Stdout); len(out) > 0 {
+		state = append(state, lastLines(out, 10))
+	}
+	if out := bytes.TrimSpace(res.Stderr); len(out) > 0 {
+		state = append(state, lastLines(out, 10))
+	}
+	return strings.Join(state, "\n")
+}
+
+// lastLines returns the last n lines of out.
+func lastLines(out []byte, n int) string {
+	lines := strings.Split(string(out), "\n")
+	if len(lines) > n {
+		lines = append([]string{"..."}, lines[len(lines)-n:]...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// WaitFor waits up to timeout for cond to hold on m, failing the test
+// if it doesn't.
+func (t *TestCluster) WaitFor(m platform.Machine, cond Condition, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(t.Context(), timeout)
+	defer cancel()
+
+	if err := WaitFor(ctx, m, cond); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BootID returns the current boot ID of m, failing the test if it
+// can't be read.
+func (t *TestCluster) BootID(m platform.Machine) string {
+	id, err := BootID(t.Context(), m)
+	if err != nil {
+		t.Fatalf("machine %s: %v", m.ID(), err)
+	}
+	return id
+}
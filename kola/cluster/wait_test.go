@@ -0,0 +1,187 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/mantle/platform"
+)
+
+func TestConditions(t *testing.T) {
+	for _, tt := range []struct {
+		cond   Condition
+		cmd    string
+		result platform.ExecResult
+		holds  bool
+	}{
+		{
+			UnitActive("etcd-member.service"),
+			"systemctl show -p ActiveState -p SubState -p Result 'etcd-member.service'",
+			platform.ExecResult{Stdout: []byte("ActiveState=active\nSubState=running\nResult=success\n")},
+			true,
+		},
+		{
+			UnitActive("etcd-member.service"),
+			"systemctl show -p ActiveState -p SubState -p Result 'etcd-member.service'",
+			platform.ExecResult{Stdout: []byte("ActiveState=activating\nSubState=start\nResult=success\n")},
+			false,
+		},
+		{
+			UnitFailed("a.service"),
+			"systemctl show -p ActiveState -p SubState -p Result 'a.service'",
+			platform.ExecResult{Stdout: []byte("ActiveState=failed\nSubState=failed\nResult=exit-code\n")},
+			true,
+		},
+		{
+			PortListening(2379),
+			"ss -ltn 'sport = :2379'",
+			platform.ExecResult{Stdout: []byte("State Recv-Q Send-Q Local Address:Port Peer Address:Port\nLISTEN 0 128 *:2379 *:*\n")},
+			true,
+		},
+		{
+			PortListening(2379),
+			"ss -ltn 'sport = :2379'",
+			platform.ExecResult{Stdout: []byte("State Recv-Q Send-Q Local Address:Port Peer Address:Port\n")},
+			false,
+		},
+		{
+			FileExists("/etc/it's here"),
+			`sudo stat -c '%F, %s bytes' '/etc/it'\''s here'`,
+			platform.ExecResult{Stdout: []byte("regular file, 3 bytes\n")},
+			true,
+		},
+		{
+			FileExists("/etc/missing"),
+			"sudo stat -c '%F, %s bytes' '/etc/missing'",
+			platform.ExecResult{ExitStatus: 1},
+			false,
+		},
+		{
+			JournalMessage("", `Reached target .*\.`),
+			"sudo journalctl -b -o cat --no-pager",
+			platform.ExecResult{Stdout: []byte("Starting...\nReached target Multi-User System.\n")},
+			true,
+		},
+		{
+			JournalMessage("a b.service", "ready"),
+			"sudo journalctl -b -o cat --no-pager -u 'a b.service'",
+			platform.ExecResult{Stdout: []byte("starting\n")},
+			false,
+		},
+		{
+			BootIDChanged("1234"),
+			"cat /proc/sys/kernel/random/boot_id",
+			platform.ExecResult{Stdout: []byte("1234\n")},
+			false,
+		},
+		{
+			BootIDChanged("1234"),
+			"cat /proc/sys/kernel/random/boot_id",
+			platform.ExecResult{Stdout: []byte("5678\n")},
+			true,
+		},
+	} {
+		if tt.cond.Cmd != tt.cmd {
+			t.Errorf("%s: got command %q, wanted %q", tt.cond.Desc, tt.cond.Cmd, tt.cmd)
+		}
+		if holds := tt.cond.Check(&tt.result); holds != tt.holds {
+			t.Errorf("%s: holds %v for %+v, wanted %v", tt.cond.Desc, holds, tt.result, tt.holds)
+		}
+	}
+}
+
+func TestObservedState(t *testing.T) {
+	var long []string
+	for i := 1; i <= 12; i++ {
+		long = append(long, fmt.Sprintf("line %d", i))
+	}
+
+	for _, tt := range []struct {
+		desc   string
+		res    *platform.ExecResult
+		err    error
+		expect string
+	}{
+		{"error", nil, errors.New("connection refused"), "connection refused"},
+		{"success", &platform.ExecResult{Stdout: []byte("ok\n")}, nil, "ok"},
+		{
+			"failure",
+			&platform.ExecResult{ExitStatus: 3, Stdout: []byte("\nout\n"), Stderr: []byte("err\n")},
+			nil,
+			"exit status 3\nout\nerr",
+		},
+		{
+			"long output",
+			&platform.ExecResult{Stdout: []byte(strings.Join(long, "\n"))},
+			nil,
+			"...\n" + strings.Join(long[2:], "\n"),
+		},
+	} {
+		if state := observedState(tt.res, tt.err); state != tt.expect {
+			t.Errorf("%s: got %q, wanted %q", tt.desc, state, tt.expect)
+		}
+	}
+}
+
+func TestLastLines(t *testing.T) {
+	for _, tt := range []struct {
+		out    string
+		n      int
+		expect string
+	}{
+		{"a", 2, "a"},
+		{"a\nb", 2, "a\nb"},
+		{"a\nb\nc", 2, "...\nb\nc"},
+	} {
+		if got := lastLines([]byte(tt.out), tt.n); got != tt.expect {
+			t.Errorf("lastLines(%q, %d) = %q, wanted %q", tt.out, tt.n, got, tt.expect)
+		}
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	cond := Condition{
+		Desc: "ready",
+		Cmd:  "check",
+		Check: func(res *platform.ExecResult) bool {
+			return res.ExitStatus == 0
+		},
+	}
+
+	m := &fakeMachine{id: "a", res: &platform.ExecResult{}}
+	if err := WaitFor(context.Background(), m, cond); err != nil {
+		t.Errorf("condition holding right away: %v", err)
+	}
+	if m.cmd != "check" {
+		t.Errorf("ran %q, wanted the condition's command", m.cmd)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	m = &fakeMachine{id: "a", res: &platform.ExecResult{ExitStatus: 1, Stderr: []byte("not yet\n")}}
+	err := WaitFor(ctx, m, cond)
+	if err == nil {
+		t.Fatal("expected an error for a condition that never holds")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "machine a: gave up waiting for ready") || !strings.Contains(msg, "exit status 1\nnot yet") {
+		t.Errorf("error lacks the last observed state: %v", err)
+	}
+}
@@ -15,12 +15,14 @@
 package kola
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/coreos/go-semver/semver"
@@ -34,23 +36,41 @@ import (
 	gcloudapi "github.com/coreos/mantle/platform/api/gcloud"
 	packetapi "github.com/coreos/mantle/platform/api/packet"
 	"github.com/coreos/mantle/platform/machine/aws"
+	"github.com/coreos/mantle/platform/machine/external"
 	"github.com/coreos/mantle/platform/machine/gcloud"
+	"github.com/coreos/mantle/platform/machine/nspawn"
 	"github.com/coreos/mantle/platform/machine/packet"
 	"github.com/coreos/mantle/platform/machine/qemu"
+	"github.com/coreos/mantle/platform/machine/unprivqemu"
 	"github.com/coreos/mantle/system"
 )
 
 var (
 	plog = capnslog.NewPackageLogger("github.com/coreos/mantle", "kola")
 
-	Options       = platform.Options{}
-	QEMUOptions   = qemu.Options{Options: &Options}      // glue to set platform options from main
-	GCEOptions    = gcloudapi.Options{Options: &Options} // glue to set platform options from main
-	AWSOptions    = awsapi.Options{Options: &Options}    // glue to set platform options from main
-	PacketOptions = packetapi.Options{Options: &Options} // glue to set platform options from main
+	Options         = platform.Options{}
+	QEMUOptions     = qemu.Options{Options: &Options}      // glue to set platform options from main
+	GCEOptions      = gcloudapi.Options{Options: &Options} // glue to set platform options from main
+	AWSOptions      = awsapi.Options{Options: &Options}    // glue to set platform options from main
+	PacketOptions   = packetapi.Options{Options: &Options} // glue to set platform options from main
+	ExternalOptions = external.Options{Options: &Options}  // glue to set platform options from main
 
 	TestParallelism int    //glue var to set test parallelism from main
 	TAPFile         string // if not "", write TAP results here
+	ConsoleHostKeys bool   // verify host keys against console output
+	Diagnostics     bool   // collect diagnostics bundles from failed tests
+
+	// platforms whose machines can't reach each other, so tests with
+	// the RequiresBridgedNetwork flag are skipped
+	unbridgedPlatforms = map[string]bool{
+		"qemu-unpriv": true,
+	}
+
+	// platforms running machines as containers, so only tests with
+	// the ContainerSafe flag are run
+	containerPlatforms = map[string]bool{
+		"nspawn": true,
+	}
 
 	consoleChecks = []struct {
 		desc     string
@@ -94,12 +114,18 @@ func NewCluster(pltfrm string, rconf *platform.RuntimeConfig) (cluster platform.
 	switch pltfrm {
 	case "qemu":
 		cluster, err = qemu.NewCluster(&QEMUOptions, rconf)
+	case "qemu-unpriv":
+		cluster, err = unprivqemu.NewCluster(&QEMUOptions, rconf)
+	case "nspawn":
+		cluster, err = nspawn.NewCluster(&QEMUOptions, rconf)
 	case "gce":
 		cluster, err = gcloud.NewCluster(&GCEOptions, rconf)
 	case "aws":
 		cluster, err = aws.NewCluster(&AWSOptions, rconf)
 	case "packet":
 		cluster, err = packet.NewCluster(&PacketOptions, rconf)
+	case "external":
+		cluster, err = external.NewCluster(&ExternalOptions, rconf)
 	default:
 		err = fmt.Errorf("invalid platform %q", pltfrm)
 	}
@@ -137,6 +163,12 @@ func filterTests(tests map[string]*register.Test, pattern, platform string, vers
 				allowed = false
 			}
 		}
+		if t.HasFlag(register.RequiresBridgedNetwork) && unbridgedPlatforms[platform] {
+			allowed = false
+		}
+		if !t.HasFlag(register.ContainerSafe) && containerPlatforms[platform] {
+			allowed = false
+		}
 		if !allowed {
 			continue
 		}
@@ -307,6 +339,8 @@ func runTest(h *harness.H, t *register.Test, pltfrm string) {
 		OutputDir:          h.OutputDir(),
 		NoSSHKeyInUserData: t.HasFlag(register.NoSSHKeyInUserData),
 		NoSSHKeyInMetadata: t.HasFlag(register.NoSSHKeyInMetadata),
+		AllowSnapshotBoot:  t.HasFlag(register.AllowSnapshotBoot),
+		ConsoleHostKeys:    ConsoleHostKeys,
 	}
 	c, err := NewCluster(pltfrm, rconf)
 	if err != nil {
@@ -319,6 +353,13 @@ func runTest(h *harness.H, t *register.Test, pltfrm string) {
 		checkConsole(h, t, c)
 	}()
 
+	// also when machines fail to come up, from those that did
+	defer func() {
+		if Diagnostics && h.Failed() {
+			collectDiagnostics(h, t, c)
+		}
+	}()
+
 	if t.ClusterSize > 0 {
 		url, err := c.GetDiscoveryURL(t.ClusterSize)
 		if err != nil {
@@ -362,10 +403,32 @@ func runTest(h *harness.H, t *register.Test, pltfrm string) {
 	t.Run(tcluster)
 }
 
+// collectDiagnostics gathers the diagnostics bundle of each machine in
+// c into its directory in the test's output.
+func collectDiagnostics(h *harness.H, t *register.Test, c platform.Cluster) {
+	collectors := append(append([]cluster.Collector{}, cluster.DefaultCollectors...), t.Diagnostics...)
+
+	var wg sync.WaitGroup
+	for _, m := range c.Machines() {
+		wg.Add(1)
+		go func(m platform.Machine) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+			defer cancel()
+
+			dir := filepath.Join(h.OutputDir(), m.ID(), "diagnostics")
+			if err := cluster.CollectDiagnostics(ctx, m, dir, collectors); err != nil {
+				plog.Errorf("%v", err)
+			}
+		}(m)
+	}
+	wg.Wait()
+}
+
 // architecture returns the machine architecture of the given platform.
 func architecture(pltfrm string) string {
 	nativeArch := "amd64"
-	if pltfrm == "qemu" && QEMUOptions.Board != "" {
+	if (pltfrm == "qemu" || pltfrm == "qemu-unpriv" || pltfrm == "nspawn") && QEMUOptions.Board != "" {
 		nativeArch = strings.SplitN(QEMUOptions.Board, "-", 2)[0]
 	}
 	return nativeArch
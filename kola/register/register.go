@@ -26,9 +26,12 @@ import (
 type Flag int
 
 const (
-	NoSSHKeyInUserData    Flag = iota // don't inject SSH key into Ignition/cloud-config
-	NoSSHKeyInMetadata                // don't add SSH key to platform metadata
-	NoEmergencyShellCheck             // don't check console output for emergency shell invocation
+	NoSSHKeyInUserData     Flag = iota // don't inject SSH key into Ignition/cloud-config
+	NoSSHKeyInMetadata                 // don't add SSH key to platform metadata
+	NoEmergencyShellCheck              // don't check console output for emergency shell invocation
+	RequiresBridgedNetwork             // machines must reach each other and cluster services over a shared network
+	AllowSnapshotBoot                  // machines may skip first boot by restoring a cached snapshot
+	ContainerSafe                      // test only exercises userspace, without Ignition or reboots, so may run in containers
 )
 
 // Test provides the main test abstraction for kola. The run function is
@@ -46,6 +49,10 @@ type Test struct {
 	Architectures    []string // whitelist of machine architectures supported -- defaults to all
 	Flags            []Flag   // special-case options for this test
 
+	// Diagnostics are collected from each machine, in addition to
+	// cluster.DefaultCollectors, if the test fails.
+	Diagnostics []cluster.Collector
+
 	// MinVersion prevents the test from executing on CoreOS machines
 	// less than MinVersion. This will be ignored if the name fully
 	// matches without globbing.
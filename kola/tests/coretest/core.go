@@ -46,6 +46,7 @@ func init() {
 		Name:        "coreos.cluster",
 		Run:         ClusterTests,
 		ClusterSize: 3,
+		Flags:       []register.Flag{register.RequiresBridgedNetwork},
 		NativeFuncs: map[string]func() error{
 			"EtcdUpdateValue":    TestEtcdUpdateValue,
 			"FleetctlRunService": TestFleetctlRunService,
@@ -87,7 +88,7 @@ func init() {
 		Name:             "coreos.internet",
 		Run:              InternetTests,
 		ClusterSize:      1,
-		ExcludePlatforms: []string{"qemu"},
+		ExcludePlatforms: []string{"qemu", "qemu-unpriv"},
 		NativeFuncs: map[string]func() error{
 			"UpdateEngine": TestUpdateEngine,
 			"DockerPing":   TestDockerPing,
@@ -40,6 +40,7 @@ func init() {
 		Run:         dockerNetwork,
 		ClusterSize: 2,
 		Name:        "docker.network",
+		Flags:       []register.Flag{register.RequiresBridgedNetwork},
 	})
 	register.Register(&register.Test{
 		Run:           dockerOldClient,
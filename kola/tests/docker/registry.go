@@ -0,0 +1,59 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker
+
+import (
+	"strings"
+
+	"github.com/coreos/mantle/kola/cluster"
+	"github.com/coreos/mantle/kola/register"
+	"github.com/coreos/mantle/platform/machine/qemu"
+)
+
+func init() {
+	register.Register(&register.Test{
+		Run:         dockerLocalRegistry,
+		ClusterSize: 1,
+		Name:        "docker.registry.local",
+		Platforms:   []string{"qemu"},
+	})
+}
+
+// dockerLocalRegistry pulls each image served by the cluster's registry,
+// both through the Docker Hub mirror and by its full reference.
+func dockerLocalRegistry(c cluster.TestCluster) {
+	qc, ok := c.Cluster.(*qemu.Cluster)
+	if !ok {
+		c.Fatal("test only works in qemu")
+	}
+	if qc.Registry == nil {
+		c.Skip("no images given for the local registry")
+	}
+
+	m := c.Machines()[0]
+
+	for _, image := range qc.Registry.Images() {
+		refs := []string{qc.RegistryHost() + "/" + image}
+		if strings.HasPrefix(image, "library/") {
+			refs = append(refs, strings.TrimPrefix(image, "library/"))
+		}
+
+		for _, ref := range refs {
+			if out, err := m.SSH("docker pull " + ref); err != nil {
+				c.Fatalf("pulling %s: %s: %v", ref, out, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coreos/mantle/kola/cluster"
+	"github.com/coreos/mantle/kola/register"
+	"github.com/coreos/mantle/platform/machine/qemu"
+)
+
+func init() {
+	register.Register(&register.Test{
+		Run:         LocalV3,
+		ClusterSize: 1,
+		Name:        "coreos.etcd3.local",
+		Platforms:   []string{"qemu"},
+	})
+}
+
+// LocalV3 checks that the v3 API of the cluster's local etcd works from
+// a machine, with writes through one member visible through the others.
+func LocalV3(c cluster.TestCluster) {
+	qc, ok := c.Cluster.(*qemu.Cluster)
+	if !ok {
+		c.Fatal("test only works in qemu")
+	}
+
+	m := c.Machines()[0]
+	endpoints := qc.EtcdV3Endpoints()
+
+	etcdctl := func(endpoint, args string) string {
+		out, err := m.SSH(fmt.Sprintf("ETCDCTL_API=3 etcdctl --endpoints=%s %s", endpoint, args))
+		if err != nil {
+			c.Fatalf("etcdctl %s: %s: %v", args, out, err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	out := etcdctl(endpoints[0], "member list")
+	if n := len(strings.Split(out, "\n")); n != len(endpoints) {
+		c.Fatalf("expected %d members, got %d:\n%s", len(endpoints), n, out)
+	}
+
+	etcdctl(endpoints[0], "put kola-test hello")
+	for _, endpoint := range endpoints {
+		if out := etcdctl(endpoint, "get --print-value-only kola-test"); out != "hello" {
+			c.Fatalf("expected value %q from %s, got %q", "hello", endpoint, out)
+		}
+	}
+}
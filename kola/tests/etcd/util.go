@@ -23,6 +23,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/coreos/mantle/kola/cluster"
 	"github.com/coreos/mantle/platform"
 	"github.com/coreos/mantle/util"
 )
@@ -94,45 +95,37 @@ func setKeys(cluster platform.Cluster, n int) (map[string]string, error) {
 
 // checkKeys tests that each node in the cluster has the full provided
 // key set in keyMap. Quorum get must be used.
-func checkKeys(cluster platform.Cluster, keyMap map[string]string) error {
-	for i, m := range cluster.Machines() {
-		for k, v := range keyMap {
-			cmd := fmt.Sprintf("curl -s http://127.0.0.1:2379/v2/keys/%v?quorum=true", k)
-
-			b, err := m.SSH(cmd)
-			if err != nil {
-				return fmt.Errorf("error curling key: %v", err)
-			}
-
-			var jsonMap map[string]interface{}
-			err = json.Unmarshal(b, &jsonMap)
-			if err != nil {
-				return err
-			}
+func checkKeys(c cluster.TestCluster, keyMap map[string]string) {
+	for k, v := range keyMap {
+		// every machine must return the same node for the key
+		b := c.MustExecAllSame(fmt.Sprintf("curl -s http://127.0.0.1:2379/v2/keys/%v?quorum=true", k))
+
+		var jsonMap map[string]interface{}
+		if err := json.Unmarshal(b, &jsonMap); err != nil {
+			c.Fatalf("parsing key %v: %v: %s", k, err, b)
+		}
 
-			// error code?
-			errorCode, ok := jsonMap["errorCode"]
-			if ok {
-				msg := jsonMap["message"]
-				return fmt.Errorf("machine %v errorCode %v: %v: %s", i, errorCode, msg, b)
-			}
+		// error code?
+		errorCode, ok := jsonMap["errorCode"]
+		if ok {
+			msg := jsonMap["message"]
+			c.Fatalf("errorCode %v: %v: %s", errorCode, msg, b)
+		}
 
-			node, ok := jsonMap["node"]
-			if !ok {
-				return fmt.Errorf("retrieving key in CheckKeys, no node in resp")
-			}
+		node, ok := jsonMap["node"]
+		if !ok {
+			c.Fatalf("retrieving key in CheckKeys, no node in resp")
+		}
 
-			n := node.(map[string]interface{})
-			value, ok := n["value"]
-			if !ok {
-				return fmt.Errorf("retrieving key in CheckKeys, no value in resp")
-			}
+		n := node.(map[string]interface{})
+		value, ok := n["value"]
+		if !ok {
+			c.Fatalf("retrieving key in CheckKeys, no value in resp")
+		}
 
-			if value != v {
-				return fmt.Errorf("checkKeys got incorrect value! expected:%v got: %v", v, value)
-			}
+		if value != v {
+			c.Fatalf("checkKeys got incorrect value! expected:%v got: %v", v, value)
 		}
 	}
 	plog.Infof("checked %v keys", len(keyMap))
-	return nil
 }
@@ -78,7 +78,8 @@ func init() {
 		Run:              udp,
 		ClusterSize:      3,
 		Name:             "coreos.flannel.udp",
-		ExcludePlatforms: []string{"qemu"},
+		ExcludePlatforms: []string{"qemu", "qemu-unpriv"},
+		Flags:            []register.Flag{register.RequiresBridgedNetwork},
 		UserData:         flannelConf.Subst("$type", "udp"),
 	})
 
@@ -86,7 +87,8 @@ func init() {
 		Run:              vxlan,
 		ClusterSize:      3,
 		Name:             "coreos.flannel.vxlan",
-		ExcludePlatforms: []string{"qemu"},
+		ExcludePlatforms: []string{"qemu", "qemu-unpriv"},
+		Flags:            []register.Flag{register.RequiresBridgedNetwork},
 		UserData:         flannelConf.Subst("$type", "vxlan"),
 	})
 }
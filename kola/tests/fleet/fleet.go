@@ -115,6 +115,7 @@ func init() {
 		Run:         Proxy,
 		ClusterSize: 0,
 		Name:        "coreos.fleet.etcdproxy",
+		Flags:       []register.Flag{register.RequiresBridgedNetwork},
 	})
 }
 
@@ -170,4 +171,9 @@ func Proxy(c cluster.TestCluster) {
 	if err := util.Retry(5, 1*time.Second, fleetList); err != nil {
 		c.Fatalf("fleetctl list-units failed: %v", err)
 	}
+
+	// the master must see the same state through etcd directly
+	if status := c.MustExecAllSame("fleetctl list-units -l -fields active -no-legend", master, proxy); string(status) != "active" {
+		c.Fatalf("unit not active: %s", status)
+	}
 }
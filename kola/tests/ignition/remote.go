@@ -0,0 +1,126 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ignition
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/coreos/mantle/kola/cluster"
+	"github.com/coreos/mantle/kola/register"
+	"github.com/coreos/mantle/platform/conf"
+	"github.com/coreos/mantle/platform/local"
+	"github.com/coreos/mantle/platform/machine/qemu"
+)
+
+func init() {
+	register.Register(&register.Test{
+		Name:        "coreos.ignition.v2.remote",
+		Run:         remoteResources,
+		ClusterSize: 0,
+		Platforms:   []string{"qemu"},
+	})
+}
+
+const (
+	remoteConfigPath = "/ignition/remote.ign"
+	remoteFilePath   = "/ignition/remote.txt"
+
+	remoteConfig = `{
+                      "ignition": { "version": "2.0.0" },
+                      "storage": {
+                        "files": [
+                          {
+                            "filesystem": "root",
+                            "path": "/etc/ignition-appended",
+                            "contents": {
+                              "source": "data:,appended"
+                            }
+                          }
+                        ]
+                      }
+                    }`
+	remoteFile = "fetched"
+
+	remoteUserData = `{
+                        "ignition": {
+                          "version": "2.0.0",
+                          "config": {
+                            "append": [
+                              {
+                                "source": "%s",
+                                "verification": { "hash": "%s" }
+                              }
+                            ]
+                          }
+                        },
+                        "storage": {
+                          "files": [
+                            {
+                              "filesystem": "root",
+                              "path": "/etc/ignition-fetched",
+                              "contents": {
+                                "source": "%s",
+                                "verification": { "hash": "%s" }
+                              }
+                            }
+                          ]
+                        }
+                      }`
+)
+
+// remoteResources verifies that Ignition fetches appended configs and
+// file contents over HTTP, retries failed requests, and accepts
+// resources matching their verification hash.
+func remoteResources(c cluster.TestCluster) {
+	qc, ok := c.Cluster.(*qemu.Cluster)
+	if !ok {
+		c.Fatal("test only works in qemu")
+	}
+
+	qc.HTTPServer.AddFile(remoteConfigPath, []byte(remoteConfig))
+	qc.HTTPServer.AddFile(remoteFilePath, []byte(remoteFile))
+	qc.HTTPServer.FailRequests(remoteConfigPath, 2, http.StatusServiceUnavailable)
+
+	userdata := conf.Ignition(fmt.Sprintf(remoteUserData,
+		qc.HTTPURL(remoteConfigPath), local.VerificationHash([]byte(remoteConfig)),
+		qc.HTTPURL(remoteFilePath), local.VerificationHash([]byte(remoteFile))))
+
+	m, err := c.NewMachine(userdata)
+	if err != nil {
+		c.Fatalf("Cluster.NewMachine: %s", err)
+	}
+
+	for path, expected := range map[string]string{
+		"/etc/ignition-appended": "appended",
+		"/etc/ignition-fetched":  remoteFile,
+	} {
+		out, err := m.SSH("cat " + path)
+		if err != nil {
+			c.Fatalf("reading %s: %v", path, err)
+		}
+		if string(out) != expected {
+			c.Errorf("%s contains %q, expected %q", path, out, expected)
+		}
+	}
+
+	reqs := qc.HTTPServer.RequestsFor(remoteConfigPath)
+	if len(reqs) < 3 {
+		c.Errorf("expected Ignition to retry fetching %s, got %d requests", remoteConfigPath, len(reqs))
+	}
+	for _, r := range reqs {
+		c.Logf("%s %s %s: %d", r.Time.Format("15:04:05.000"), r.Method, r.Path, r.Status)
+	}
+}
@@ -26,7 +26,7 @@ func init() {
 		Name:             "coreos.ignition.v1.ssh.key",
 		Run:              empty,
 		ClusterSize:      1,
-		ExcludePlatforms: []string{"qemu"}, // redundant on qemu
+		ExcludePlatforms: []string{"qemu", "qemu-unpriv"}, // redundant on qemu
 		Flags:            []register.Flag{register.NoSSHKeyInMetadata},
 		UserData:         conf.Ignition(`{"ignitionVersion": 1}`),
 	})
@@ -34,7 +34,7 @@ func init() {
 		Name:             "coreos.ignition.v2.ssh.key",
 		Run:              empty,
 		ClusterSize:      1,
-		ExcludePlatforms: []string{"qemu"}, // redundant on qemu
+		ExcludePlatforms: []string{"qemu", "qemu-unpriv"}, // redundant on qemu
 		Flags:            []register.Flag{register.NoSSHKeyInMetadata},
 		UserData:         conf.Ignition(`{"ignition":{"version":"2.0.0"}}`),
 	})
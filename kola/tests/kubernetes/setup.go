@@ -83,6 +83,9 @@ func setupCluster(c cluster.TestCluster, nodes int, version, runtime string) *kC
 		c.Fatalf("error creating worker tls: %v", err)
 	}
 
+	kubeNodes := append([]platform.Machine{master}, workers...)
+	c.MustExecAll("sudo stat /usr/lib/coreos/kubelet-wrapper", kubeNodes...)
+
 	// configure nodes via generic install scripts
 	runInstallScript(c, master, controllerInstallScript, options)
 
@@ -103,6 +106,10 @@ func setupCluster(c cluster.TestCluster, nodes int, version, runtime string) *kC
 		c.Fatalf("error waiting for nodes: %v", err)
 	}
 
+	if state := c.MustExecAllSame("systemctl is-active kubelet.service", kubeNodes...); string(state) != "active" {
+		c.Fatalf("kubelet not active: %s", state)
+	}
+
 	cluster := &kCluster{
 		etcd:    etcdNode,
 		master:  master,
@@ -255,10 +262,6 @@ func stripSemverSuffix(v string) (string, error) {
 
 // Run and configure the coreos-kubernetes generic install scripts.
 func runInstallScript(c cluster.TestCluster, m platform.Machine, script string, options map[string]string) {
-	if _, err := m.SSH("sudo stat /usr/lib/coreos/kubelet-wrapper"); err != nil {
-		c.Fatal("kubelet wrapper not found on disk")
-	}
-
 	var buffer = new(bytes.Buffer)
 
 	tmpl, err := template.New("installScript").Parse(script)
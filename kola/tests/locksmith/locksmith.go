@@ -37,6 +37,7 @@ func init() {
 		Name:        "coreos.locksmith.cluster",
 		Run:         locksmithCluster,
 		ClusterSize: 3,
+		Flags:       []register.Flag{register.RequiresBridgedNetwork},
 		UserData: conf.Ignition(`{
   "ignition": { "version": "2.0.0" },
   "systemd": {
@@ -24,6 +24,7 @@ func init() {
 		Run:         AuthVerify,
 		ClusterSize: 1,
 		Name:        "coreos.auth.verify",
+		Flags:       []register.Flag{register.AllowSnapshotBoot, register.ContainerSafe},
 	})
 }
 
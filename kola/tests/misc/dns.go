@@ -0,0 +1,80 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package misc
+
+import (
+	"net"
+	"strings"
+
+	"github.com/coreos/mantle/kola/cluster"
+	"github.com/coreos/mantle/kola/register"
+	"github.com/coreos/mantle/platform/local"
+	"github.com/coreos/mantle/platform/machine/qemu"
+)
+
+func init() {
+	register.Register(&register.Test{
+		Run:         LocalDNS,
+		ClusterSize: 2,
+		Name:        "coreos.network.dns.local",
+		Platforms:   []string{"qemu"},
+		Flags:       []register.Flag{register.RequiresBridgedNetwork},
+	})
+}
+
+// LocalDNS checks that machines can resolve each other's names and the
+// address and SRV records added by tests through the cluster's dnsmasq.
+func LocalDNS(c cluster.TestCluster) {
+	qc, ok := c.Cluster.(*qemu.Cluster)
+	if !ok {
+		c.Fatal("test only works in qemu")
+	}
+
+	m0 := c.Machines()[0]
+	m1 := c.Machines()[1]
+
+	if err := qc.Dnsmasq.AddHost("peer.br0.local", net.ParseIP(m1.IP())); err != nil {
+		c.Fatalf("adding DNS record: %v", err)
+	}
+
+	for _, name := range []string{m1.ID() + ".br0.local", "peer.br0.local"} {
+		out, err := m0.SSH("getent ahostsv4 " + name)
+		if err != nil {
+			c.Fatalf("resolving %s: %s: %v", name, out, err)
+		}
+		if !strings.HasPrefix(string(out), m1.IP()+" ") {
+			c.Fatalf("%s resolved to %q, expected %s", name, out, m1.IP())
+		}
+	}
+
+	srv := local.SRVRecord{
+		Name:     "_kola._tcp.br0.local",
+		Target:   "peer.br0.local",
+		Port:     2379,
+		Priority: 10,
+		Weight:   20,
+	}
+	if err := qc.Dnsmasq.AddSRVRecord(srv); err != nil {
+		c.Fatalf("adding SRV record: %v", err)
+	}
+
+	out, err := m0.SSH("dig +short SRV " + srv.Name)
+	if err != nil {
+		c.Fatalf("resolving SRV %s: %s: %v", srv.Name, out, err)
+	}
+	if expected := "10 20 2379 peer.br0.local."; string(out) != expected {
+		c.Fatalf("SRV %s resolved to %q, expected %q", srv.Name, out, expected)
+	}
+}
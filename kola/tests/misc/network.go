@@ -15,13 +15,17 @@
 package misc
 
 import (
+	"net"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/coreos/go-semver/semver"
 
 	"github.com/coreos/mantle/kola/cluster"
 	"github.com/coreos/mantle/kola/register"
+	"github.com/coreos/mantle/platform"
+	"github.com/coreos/mantle/platform/machine/qemu"
 )
 
 func init() {
@@ -37,6 +41,12 @@ func init() {
 		ExcludePlatforms: []string{"digitalocean"},
 		MinVersion:       semver.Version{Major: 1445},
 	})
+	register.Register(&register.Test{
+		Run:         NetworkIPv6,
+		ClusterSize: 2,
+		Name:        "coreos.network.ipv6",
+		Platforms:   []string{"qemu"},
+	})
 }
 
 type listener struct {
@@ -146,3 +156,51 @@ func NetworkInitramfsSecondBoot(c cluster.TestCluster) {
 		c.Fatal("networkd started in initramfs")
 	}
 }
+
+// ipv6Addr returns the global IPv6 address of a machine's eth0.
+func ipv6Addr(c cluster.TestCluster, m platform.Machine) string {
+	out, err := m.SSH("ip -6 -o addr show dev eth0 scope global")
+	if err != nil {
+		c.Fatalf("listing IPv6 addresses of %s: %v", m.ID(), err)
+	}
+	for _, field := range strings.Fields(string(out)) {
+		if ip, _, err := net.ParseCIDR(field); err == nil && ip.To4() == nil {
+			return ip.String()
+		}
+	}
+	c.Fatalf("%s has no global IPv6 address:\n%s", m.ID(), out)
+	return ""
+}
+
+// Verify that machines reach each other and the host's services over
+// IPv6, in cluster networks that have it.
+func NetworkIPv6(c cluster.TestCluster) {
+	qc, ok := c.Cluster.(*qemu.Cluster)
+	if !ok {
+		c.Fatal("test only works in qemu")
+	}
+	bridge := qc.Dnsmasq.Segments[0].BridgeIf
+	if len(bridge.DHCPv6) == 0 {
+		c.Skip("cluster network has no IPv6")
+	}
+	host := bridge.DHCPv6[0].IP.String()
+
+	m0, m1 := c.Machines()[0], c.Machines()[1]
+	addr1 := ipv6Addr(c, m1)
+
+	for _, dst := range []string{host, addr1} {
+		if out, err := m0.SSH("ping6 -c 3 " + dst); err != nil {
+			c.Fatalf("ping6 %s from %s failed: %v\n%s", dst, m0.ID(), err, out)
+		}
+	}
+
+	qc.HTTPServer.AddFile("/ipv6.txt", []byte("ipv6"))
+	url := "http://" + net.JoinHostPort(host, strconv.Itoa(qc.HTTPServer.Port)) + "/ipv6.txt"
+	out, err := m1.SSH("curl -g -sSf " + url)
+	if err != nil {
+		c.Fatalf("fetching %s: %v\n%s", url, err, out)
+	}
+	if string(out) != "ipv6" {
+		c.Errorf("%s contains %q, expected %q", url, out, "ipv6")
+	}
+}
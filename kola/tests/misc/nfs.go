@@ -74,11 +74,13 @@ func init() {
 		Run:         NFSv3,
 		ClusterSize: 0,
 		Name:        "linux.nfs.v3",
+		Flags:       []register.Flag{register.RequiresBridgedNetwork},
 	})
 	register.Register(&register.Test{
 		Run:         NFSv4,
 		ClusterSize: 0,
 		Name:        "linux.nfs.v4",
+		Flags:       []register.Flag{register.RequiresBridgedNetwork},
 	})
 }
 
@@ -16,11 +16,24 @@ package misc
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"math/big"
+	"net"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/coreos/mantle/kola/cluster"
 	"github.com/coreos/mantle/kola/register"
+	"github.com/coreos/mantle/kola/tests/etcd"
+	"github.com/coreos/mantle/platform"
+	"github.com/coreos/mantle/platform/conf"
+	"github.com/coreos/mantle/platform/machine/qemu"
 	"github.com/coreos/mantle/util"
 )
 
@@ -31,10 +44,46 @@ func init() {
 		Name:        "linux.ntp",
 		Platforms:   []string{"qemu"},
 	})
+	register.Register(&register.Test{
+		Run:         NTPStep,
+		ClusterSize: 1,
+		Name:        "linux.ntp.step",
+		Platforms:   []string{"qemu"},
+	})
+	register.Register(&register.Test{
+		Run:         NTPLeapSecond,
+		ClusterSize: 1,
+		Name:        "linux.ntp.leap",
+		Platforms:   []string{"qemu"},
+	})
+	register.Register(&register.Test{
+		Run:         NTPEtcd,
+		ClusterSize: 1,
+		Name:        "linux.ntp.etcd",
+		Platforms:   []string{"qemu"},
+		UserData: conf.Ignition(`{
+  "ignition": { "version": "2.0.0" },
+  "systemd": {
+    "units": [{ "name": "etcd2.service", "enable": true }]
+  }
+}`),
+	})
+	register.Register(&register.Test{
+		Run:         NTPCertExpiry,
+		ClusterSize: 1,
+		Name:        "linux.ntp.cert-expiry",
+		Platforms:   []string{"qemu"},
+	})
 }
 
 // Test that timesyncd starts using the local NTP server
 func NTP(c cluster.TestCluster) {
+	qc, ok := c.Cluster.(*qemu.Cluster)
+	if !ok {
+		c.Fatal("test only works in qemu")
+	}
+	server := qc.BridgeIP("br0")
+
 	m, err := c.NewMachine(nil)
 	if err != nil {
 		c.Fatalf("Cluster.NewMachine: %s", err)
@@ -45,24 +94,171 @@ func NTP(c cluster.TestCluster) {
 	if err != nil {
 		c.Fatalf("networkctl: %v", err)
 	}
-	if !bytes.Contains(out, []byte("NTP: 10.0.0.1")) {
+	if !bytes.Contains(out, []byte("NTP: "+server.String())) {
 		c.Fatalf("Bad network config:\n%s", out)
 	}
 
-	checker := func() error {
-		out, err = m.SSH("systemctl status systemd-timesyncd.service")
+	synced := "Synchronized to time server " + regexp.QuoteMeta(net.JoinHostPort(server.String(), "123"))
+	c.WaitFor(m, cluster.JournalMessage("systemd-timesyncd.service", synced), time.Minute)
+}
+
+// Test that timesyncd follows the NTP server when its time jumps far ahead.
+func NTPStep(c cluster.TestCluster) {
+	m := c.Machines()[0]
+
+	c.StepTime(400 * 24 * time.Hour)
+	if err := cluster.SyncTime(m); err != nil {
+		c.Fatal(err)
+	}
+	if err := c.CheckTime(m, time.Second); err != nil {
+		c.Fatal(err)
+	}
+}
+
+// Test that the kernel applies leap seconds announced by the NTP server.
+func NTPLeapSecond(c cluster.TestCluster) {
+	m := c.Machines()[0]
+
+	c.Run("insert", func(c cluster.TestCluster) {
+		checkLeapSecond(c, m, c.InsertLeapSecond)
+	})
+	c.Run("delete", func(c cluster.TestCluster) {
+		checkLeapSecond(c, m, c.DeleteLeapSecond)
+	})
+}
+
+func checkLeapSecond(c cluster.TestCluster, m platform.Machine, announce func(time.Time)) {
+	// the next month boundary after the time currently served
+	now := c.NTPServer().Now().UTC()
+	leap := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+
+	c.SetTime(leap.Add(-30 * time.Second))
+	announce(leap)
+	if err := cluster.SyncTime(m); err != nil {
+		c.Fatal(err)
+	}
+
+	// timesyncd must not resync before checking, so that any
+	// agreement is due to the kernel applying the leap
+	time.Sleep(leap.Sub(c.NTPServer().Now()) + 5*time.Second)
+	if err := c.CheckTime(m, 500*time.Millisecond); err != nil {
+		c.Fatal(err)
+	}
+}
+
+// Test that etcd expires keys by the cluster's time and keeps working
+// when the time jumps in either direction.
+func NTPEtcd(c cluster.TestCluster) {
+	m := c.Machines()[0]
+
+	if err := cluster.SyncTime(m); err != nil {
+		c.Fatal(err)
+	}
+	if err := etcd.GetClusterHealth(m, 1); err != nil {
+		c.Fatal(err)
+	}
+
+	etcdctl := func(args string) string {
+		out, err := m.SSH("etcdctl " + args)
 		if err != nil {
-			return fmt.Errorf("systemctl: %v", err)
+			c.Fatalf("etcdctl %s failed: %s: %v", args, out, err)
 		}
+		return string(out)
+	}
 
-		if !bytes.Contains(out, []byte(`Status: "Synchronized to time server 10.0.0.1:123 (10.0.0.1)."`)) {
-			return fmt.Errorf("unexpected systemd-timesyncd status: %v", out)
-		}
+	etcdctl("set /kola/kept yes")
+	etcdctl("set --ttl 3600 /kola/expiring yes")
 
+	c.StepTime(2 * time.Hour)
+	if err := cluster.SyncTime(m); err != nil {
+		c.Fatal(err)
+	}
+	err := util.Retry(30, time.Second, func() error {
+		if out, err := m.SSH("etcdctl get /kola/expiring"); err == nil {
+			return fmt.Errorf("key with a TTL of an hour still set two hours later: %s", out)
+		}
 		return nil
+	})
+	if err != nil {
+		c.Fatal(err)
+	}
+	if out := etcdctl("get /kola/kept"); out != "yes" {
+		c.Fatalf("key without a TTL got %q after stepping forward", out)
+	}
+
+	c.StepTime(-4 * time.Hour)
+	if err := cluster.SyncTime(m); err != nil {
+		c.Fatal(err)
+	}
+	if err := etcd.GetClusterHealth(m, 1); err != nil {
+		c.Fatalf("after stepping back: %v", err)
+	}
+	etcdctl("set /kola/after yes")
+	for _, key := range []string{"/kola/kept", "/kola/after"} {
+		if out := etcdctl("get " + key); out != "yes" {
+			c.Fatalf("%s got %q after stepping back", key, out)
+		}
+	}
+}
+
+// Test that certificates stop validating once the cluster's time passes
+// their expiry.
+func NTPCertExpiry(c cluster.TestCluster) {
+	m := c.Machines()[0]
+
+	if err := cluster.SyncTime(m); err != nil {
+		c.Fatal(err)
+	}
+
+	now := c.NTPServer().Now()
+	cert, err := selfSignedCert(now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		c.Fatal(err)
+	}
+	if err := platform.InstallFile(bytes.NewReader(cert), m, "cert.pem"); err != nil {
+		c.Fatalf("installing certificate: %v", err)
+	}
+
+	verify := "openssl verify -CAfile cert.pem cert.pem"
+	if out, err := m.SSH(verify); err != nil {
+		c.Fatalf("certificate not valid before expiry: %s: %v", out, err)
 	}
 
-	if err = util.Retry(60, 1*time.Second, checker); err != nil {
+	c.StepTime(2 * time.Hour)
+	if err := cluster.SyncTime(m); err != nil {
 		c.Fatal(err)
 	}
+
+	out, err := m.SSH(verify)
+	if err == nil {
+		c.Fatalf("certificate still valid after expiry: %s", out)
+	}
+	if !strings.Contains(string(out), "certificate has expired") {
+		c.Fatalf("unexpected verification failure: %s", out)
+	}
+}
+
+// selfSignedCert returns a PEM encoded CA certificate valid between
+// notBefore and notAfter.
+func selfSignedCert(notBefore, notAfter time.Time) ([]byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kola"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
 }
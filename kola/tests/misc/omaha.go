@@ -15,6 +15,7 @@
 package misc
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/coreos/go-omaha/omaha"
@@ -28,17 +29,18 @@ import (
 func init() {
 	register.Register(&register.Test{
 		Run:         OmahaPing,
-		ClusterSize: 1,
+		ClusterSize: 0,
 		Name:        "coreos.omaha.ping",
 		Platforms:   []string{"qemu"},
-		UserData: conf.CloudConfig(`#cloud-config
+	})
+}
+
+const omahaUserData = `#cloud-config
 
 coreos:
   update:
-    server: "http://10.0.0.1:34567/v1/update/"
-`),
-	})
-}
+    server: "%s"
+`
 
 type pingServer struct {
 	omaha.UpdaterStub
@@ -64,7 +66,10 @@ func OmahaPing(c cluster.TestCluster) {
 
 	omahaserver.Updater = svc
 
-	m := c.Machines()[0]
+	m, err := c.NewMachine(conf.CloudConfig(fmt.Sprintf(omahaUserData, qc.OmahaURL())))
+	if err != nil {
+		c.Fatalf("Cluster.NewMachine: %s", err)
+	}
 
 	out, err := m.SSH("update_engine_client -check_for_update")
 	if err != nil {
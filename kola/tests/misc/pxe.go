@@ -0,0 +1,91 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package misc
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/coreos/mantle/kola/cluster"
+	"github.com/coreos/mantle/kola/register"
+	"github.com/coreos/mantle/platform/conf"
+	"github.com/coreos/mantle/platform/machine/qemu"
+)
+
+func init() {
+	register.Register(&register.Test{
+		Run:         PXEBoot,
+		ClusterSize: 0,
+		Name:        "coreos.boot.pxe",
+		Platforms:   []string{"qemu"},
+	})
+}
+
+// Verify that machines network boot with their config fetched over
+// HTTP, and that the config stops being served when they're destroyed.
+// Only runs with --qemu-boot=pxe.
+func PXEBoot(c cluster.TestCluster) {
+	qc, ok := c.Cluster.(*qemu.Cluster)
+	if !ok {
+		c.Fatal("test only works in qemu")
+	}
+	if qc.BootMode() != qemu.BootPXE {
+		c.Skip("machines aren't PXE booted")
+	}
+
+	m1, err := c.NewMachine(conf.Ignition(`{"ignition": {"version": "2.0.0"}}`))
+	if err != nil {
+		c.Fatalf("Cluster.NewMachine: %s", err)
+	}
+	m2, err := c.NewMachine(nil)
+	if err != nil {
+		c.Fatalf("Cluster.NewMachine: %s", err)
+	}
+
+	configURL := qc.PXEConfigURL(m1.ID())
+	cmdline, err := m1.SSH("cat /proc/cmdline")
+	if err != nil {
+		c.Fatalf("reading kernel command line: %v", err)
+	}
+	if !strings.Contains(string(cmdline), "coreos.config.url="+configURL) {
+		c.Errorf("kernel command line lacks config URL %s: %s", configURL, cmdline)
+	}
+
+	// PXE booted machines run from the initramfs
+	if out, err := m1.SSH("findmnt -n -o FSTYPE /"); err != nil {
+		c.Fatalf("findmnt: %v", err)
+	} else if string(out) != "tmpfs" {
+		c.Errorf("root filesystem is %q, expected tmpfs", out)
+	}
+
+	u, err := url.Parse(configURL)
+	if err != nil {
+		c.Fatal(err)
+	}
+	if reqs := qc.HTTPServer.RequestsFor(u.Path); len(reqs) == 0 {
+		c.Errorf("config %s was never fetched", u.Path)
+	}
+
+	if err := m1.Destroy(); err != nil {
+		c.Fatalf("destroying %s: %v", m1.ID(), err)
+	}
+	out, err := m2.SSH("curl -g -s -o /dev/null -w '%{http_code}' " + configURL)
+	if err != nil {
+		c.Fatalf("fetching %s: %v", configURL, err)
+	}
+	if string(out) != "404" {
+		c.Errorf("config of destroyed machine still served: got status %s", out)
+	}
+}
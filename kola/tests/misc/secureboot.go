@@ -0,0 +1,49 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package misc
+
+import (
+	"github.com/coreos/mantle/kola"
+	"github.com/coreos/mantle/kola/cluster"
+	"github.com/coreos/mantle/kola/register"
+)
+
+func init() {
+	register.Register(&register.Test{
+		Run:         SecureBoot,
+		ClusterSize: 1,
+		Name:        "coreos.boot.secureboot",
+		Platforms:   []string{"qemu", "qemu-unpriv"},
+	})
+}
+
+// SecureBoot checks that the firmware reports Secure Boot as enabled,
+// which means shim, GRUB and the kernel all passed signature checks.
+func SecureBoot(c cluster.TestCluster) {
+	if !kola.QEMUOptions.IsSecureBoot() {
+		c.Skip("machines not booted with Secure Boot firmware")
+	}
+
+	m := c.Machines()[0]
+
+	// the first four bytes of an efivar are its attributes
+	out, err := m.SSH("od -An -t u1 -j 4 /sys/firmware/efi/efivars/SecureBoot-8be4df61-93ca-11d2-aa0d-00e098032b8c")
+	if err != nil {
+		c.Fatalf("failed reading SecureBoot efivar: %v: %v", out, err)
+	}
+	if string(out) != "1" {
+		c.Fatalf("Secure Boot is not enabled: SecureBoot=%q", out)
+	}
+}
@@ -25,7 +25,7 @@ func init() {
 	register.Register(&register.Test{
 		Run:              dnfInstall,
 		ClusterSize:      1,
-		ExcludePlatforms: []string{"qemu"}, // Network access for toolbox
+		ExcludePlatforms: []string{"qemu", "qemu-unpriv"}, // Network access for toolbox
 		Name:             "coreos.toolbox.dnf-install",
 	})
 }
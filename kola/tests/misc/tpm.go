@@ -0,0 +1,47 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package misc
+
+import (
+	"github.com/coreos/mantle/kola"
+	"github.com/coreos/mantle/kola/cluster"
+	"github.com/coreos/mantle/kola/register"
+)
+
+func init() {
+	register.Register(&register.Test{
+		Run:         TPM,
+		ClusterSize: 1,
+		Name:        "coreos.tpm.present",
+		Platforms:   []string{"qemu"},
+	})
+}
+
+// TPM checks that the kernel found a TPM 2.0 device.
+func TPM(c cluster.TestCluster) {
+	if !kola.QEMUOptions.TPM {
+		c.Skip("machines not started with a TPM")
+	}
+
+	m := c.Machines()[0]
+
+	out, err := m.SSH("cat /sys/class/tpm/tpm0/tpm_version_major")
+	if err != nil {
+		c.Fatalf("no TPM found: %v: %v", out, err)
+	}
+	if string(out) != "2" {
+		c.Fatalf("expected a TPM 2.0, got version %q", out)
+	}
+}
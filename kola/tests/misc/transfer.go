@@ -0,0 +1,94 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package misc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/mantle/kola/cluster"
+	"github.com/coreos/mantle/kola/register"
+	"github.com/coreos/mantle/platform"
+)
+
+func init() {
+	register.Register(&register.Test{
+		Run:         FileTransfer,
+		ClusterSize: 1,
+		Name:        "coreos.sftp",
+		Flags:       []register.Flag{register.AllowSnapshotBoot, register.ContainerSafe},
+	})
+}
+
+// FileTransfer uploads a directory tree over SFTP with an owner and
+// mode, checks them on the machine, and downloads it again.
+func FileTransfer(c cluster.TestCluster) {
+	m := c.Machines()[0]
+
+	dir, err := ioutil.TempDir("", "kola-sftp-")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 4<<20)
+	rand.Read(data)
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		c.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "sub", "payload"), data, 0644); err != nil {
+		c.Fatal(err)
+	}
+
+	var reported int64
+	err = c.Upload(m, src, "/var/lib/kola-sftp", &platform.TransferOptions{
+		Mode:   0600,
+		Owner:  "core:core",
+		Verify: true,
+		Progress: func(path string, done, total int64) {
+			reported = done
+		},
+	})
+	if err != nil {
+		c.Fatalf("upload: %v", err)
+	}
+	if reported != int64(len(data)) {
+		c.Errorf("progress reported %d bytes, expected %d", reported, len(data))
+	}
+
+	out, err := m.SSH("stat -c '%a %U:%G' /var/lib/kola-sftp/sub /var/lib/kola-sftp/sub/payload")
+	if err != nil {
+		c.Fatalf("stat: %s: %v", out, err)
+	}
+	if expect := "755 core:core\n600 core:core"; string(out) != expect {
+		c.Errorf("uploaded files are %q, expected %q", out, expect)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if err := c.Download(m, "/var/lib/kola-sftp", dst, &platform.TransferOptions{Verify: true}); err != nil {
+		c.Fatalf("download: %v", err)
+	}
+	downloaded, err := ioutil.ReadFile(filepath.Join(dst, "sub", "payload"))
+	if err != nil {
+		c.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, data) {
+		c.Errorf("downloaded payload differs")
+	}
+}
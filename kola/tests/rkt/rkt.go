@@ -40,7 +40,7 @@ func init() {
 	register.Register(&register.Test{
 		Run:              rktEtcd,
 		ClusterSize:      1,
-		ExcludePlatforms: []string{"qemu"},
+		ExcludePlatforms: []string{"qemu", "qemu-unpriv"},
 		Name:             "coreos.rkt.etcd3",
 		UserData:         config,
 	})
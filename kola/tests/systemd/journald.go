@@ -58,6 +58,7 @@ func init() {
 		Run:         journalRemote,
 		ClusterSize: 0,
 		Name:        "systemd.journal.remote",
+		Flags:       []register.Flag{register.RequiresBridgedNetwork},
 	})
 }
 
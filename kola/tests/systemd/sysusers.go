@@ -24,6 +24,7 @@ func init() {
 		Run:         gshadowParser,
 		ClusterSize: 1,
 		Name:        "systemd.sysusers.gshadow",
+		Flags:       []register.Flag{register.ContainerSafe},
 	})
 }
 
@@ -0,0 +1,138 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/coreos/pkg/capnslog"
+)
+
+var plog = capnslog.NewPackageLogger("github.com/coreos/mantle", "network")
+
+// PortForwarder accepts TCP connections on a local address and proxies
+// each of them to a remote address reached through a Dialer, such as an
+// NsDialer for addresses inside another network namespace.
+type PortForwarder struct {
+	RemoteAddr string
+
+	listener net.Listener
+	dialer   Dialer
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// NewPortForwarder starts forwarding connections to localAddr, which may
+// use port 0 to pick a free port, to remoteAddr.
+func NewPortForwarder(localAddr, remoteAddr string, dialer Dialer) (*PortForwarder, error) {
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &PortForwarder{
+		RemoteAddr: remoteAddr,
+		listener:   listener,
+		dialer:     dialer,
+		conns:      make(map[net.Conn]struct{}),
+	}
+	go f.serve()
+
+	return f, nil
+}
+
+// LocalAddr returns the address connections are accepted on.
+func (f *PortForwarder) LocalAddr() net.Addr {
+	return f.listener.Addr()
+}
+
+func (f *PortForwarder) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.forward(conn)
+	}
+}
+
+func (f *PortForwarder) forward(local net.Conn) {
+	defer local.Close()
+
+	remote, err := f.dialer.Dial("tcp", f.RemoteAddr)
+	if err != nil {
+		plog.Warningf("Forwarding %s to %s: %v", f.LocalAddr(), f.RemoteAddr, err)
+		return
+	}
+	defer remote.Close()
+
+	if !f.track(local, remote) {
+		return
+	}
+	defer f.untrack(local, remote)
+
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		// let the other side see EOF while the reply is still copied
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go cp(remote, local)
+	go cp(local, remote)
+	<-done
+	<-done
+}
+
+// track records open connections so they can be closed by Destroy. It
+// returns false if the forwarder has already been destroyed.
+func (f *PortForwarder) track(conns ...net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conns == nil {
+		return false
+	}
+	for _, c := range conns {
+		f.conns[c] = struct{}{}
+	}
+	return true
+}
+
+func (f *PortForwarder) untrack(conns ...net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range conns {
+		delete(f.conns, c)
+	}
+}
+
+// Destroy stops accepting connections and closes any open ones.
+func (f *PortForwarder) Destroy() error {
+	err := f.listener.Close()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for c := range f.conns {
+		c.Close()
+	}
+	f.conns = nil
+
+	return err
+}
@@ -0,0 +1,238 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// consoleFingerprint matches the host key fingerprints Container Linux
+// prints above the console login prompt.
+var consoleFingerprint = regexp.MustCompile(`SSH host key: (SHA256:[A-Za-z0-9+/]+)`)
+
+// HostKeyChangedError is returned when connecting to a host that
+// presents a different key than the one pinned for it.
+type HostKeyChangedError struct {
+	Host      string
+	Pinned    ssh.PublicKey
+	Presented ssh.PublicKey
+}
+
+func (e *HostKeyChangedError) Error() string {
+	return fmt.Sprintf("host key for %s changed from %s to %s", e.Host, Fingerprint(e.Pinned), Fingerprint(e.Presented))
+}
+
+// HostKeyStore pins the first host key each host presents (trust on
+// first use) and rejects connections presenting a different key.
+type HostKeyStore struct {
+	// File, if set, records pinned keys in known_hosts format.
+	File string
+
+	mu       sync.Mutex
+	keys     map[string]ssh.PublicKey
+	expected map[string][]string
+}
+
+// NewHostKeyStore creates a HostKeyStore recording keys in file, which
+// may be empty to only keep them in memory. Keys already in file are
+// pinned.
+func NewHostKeyStore(file string) (*HostKeyStore, error) {
+	s := &HostKeyStore{
+		File:     file,
+		keys:     make(map[string]ssh.PublicKey),
+		expected: make(map[string][]string),
+	}
+	if file == "" {
+		return s, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for len(data) > 0 {
+		_, hosts, key, _, rest, err := ssh.ParseKnownHosts(data)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", file, err)
+		}
+		for _, host := range hosts {
+			s.keys[hostKeyAddr(host)] = key
+		}
+		data = rest
+	}
+	return s, nil
+}
+
+// Fingerprint returns the SHA256 fingerprint of key as printed by
+// ssh-keygen -l.
+func Fingerprint(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// ParseConsoleFingerprints returns the host key fingerprints printed
+// on a machine's console.
+func ParseConsoleFingerprints(console string) []string {
+	var fingerprints []string
+	for _, match := range consoleFingerprint.FindAllStringSubmatch(console, -1) {
+		fingerprints = append(fingerprints, match[1])
+	}
+	return fingerprints
+}
+
+// Pin trusts only key for host. host may omit the SSH port.
+func (s *HostKeyStore) Pin(host string, key ssh.PublicKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[hostKeyAddr(host)] = key
+	return s.save()
+}
+
+// Expect has the first key host presents only be trusted if it matches
+// one of the given fingerprints, e.g. from ParseConsoleFingerprints.
+func (s *HostKeyStore) Expect(host string, fingerprints []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expected[hostKeyAddr(host)] = fingerprints
+}
+
+// Forget stops pinning a key for host, e.g. once the machine using its
+// address is gone.
+func (s *HostKeyStore) Forget(host string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addr := hostKeyAddr(host)
+	delete(s.keys, addr)
+	delete(s.expected, addr)
+	return s.save()
+}
+
+// Key returns the key pinned for host, or nil.
+func (s *HostKeyStore) Key(host string) ssh.PublicKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys[hostKeyAddr(host)]
+}
+
+// Check is an ssh.ClientConfig HostKeyCallback verifying key against
+// the one pinned for hostname, or pinning it if there is none.
+func (s *HostKeyStore) Check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addr := hostKeyAddr(hostname)
+	if pinned, ok := s.keys[addr]; ok {
+		if !bytes.Equal(pinned.Marshal(), key.Marshal()) {
+			return &HostKeyChangedError{
+				Host:      addr,
+				Pinned:    pinned,
+				Presented: key,
+			}
+		}
+		return nil
+	}
+
+	if fingerprints, ok := s.expected[addr]; ok {
+		fingerprint := Fingerprint(key)
+		var found bool
+		for _, fp := range fingerprints {
+			if fp == fingerprint {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("host key %s for %s is not one of %s", fingerprint, addr, strings.Join(fingerprints, ", "))
+		}
+		delete(s.expected, addr)
+	}
+
+	s.keys[addr] = key
+	if err := s.save(); err != nil {
+		plog.Warningf("recording host key for %s: %v", addr, err)
+	}
+	return nil
+}
+
+// CheckKnown is an ssh.ClientConfig HostKeyCallback like Check, but
+// rejecting hosts with no pinned key instead of pinning theirs.
+func (s *HostKeyStore) CheckKnown(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	s.mu.Lock()
+	_, ok := s.keys[hostKeyAddr(hostname)]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no known host key for %s", hostKeyAddr(hostname))
+	}
+	return s.Check(hostname, remote, key)
+}
+
+// save writes the pinned keys to File.
+func (s *HostKeyStore) save() error {
+	if s.File == "" {
+		return nil
+	}
+
+	var addrs []string
+	for addr := range s.keys {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var buf bytes.Buffer
+	for _, addr := range addrs {
+		fmt.Fprintf(&buf, "%s %s", knownHostsHost(addr), ssh.MarshalAuthorizedKey(s.keys[addr]))
+	}
+	return ioutil.WriteFile(s.File, buf.Bytes(), 0644)
+}
+
+// hostKeyAddr normalizes host, which may be a known_hosts host
+// pattern, to the host:port form keys are stored under.
+func hostKeyAddr(host string) string {
+	addr := ensurePortSuffix(host, defaultPort)
+	h, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return net.JoinHostPort(h, port)
+}
+
+// knownHostsHost formats addr as a known_hosts host pattern.
+func knownHostsHost(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if port == fmt.Sprint(defaultPort) {
+		return host
+	}
+	return fmt.Sprintf("[%s]:%s", host, port)
+}
@@ -0,0 +1,110 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+func TestHostKeyTOFU(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mantle-hostkeys-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "known_hosts")
+
+	s, err := NewHostKeyStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key1 := newHostKey(t)
+	key2 := newHostKey(t)
+
+	if err := s.Check("10.0.0.2:22", nil, key1); err != nil {
+		t.Fatalf("first use rejected: %v", err)
+	}
+	if err := s.Check("10.0.0.2:22", nil, key1); err != nil {
+		t.Fatalf("pinned key rejected: %v", err)
+	}
+	if err := s.Check("10.0.0.2:2222", nil, key2); err != nil {
+		t.Fatalf("first use on another port rejected: %v", err)
+	}
+
+	err = s.Check("10.0.0.2:22", nil, key2)
+	if _, ok := err.(*HostKeyChangedError); !ok {
+		t.Fatalf("changed key returned %v", err)
+	}
+
+	// keys are reloaded from the file
+	s, err = NewHostKeyStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := s.Key("10.0.0.2"); key == nil || !reflect.DeepEqual(key.Marshal(), key1.Marshal()) {
+		t.Errorf("reloaded key for port 22 doesn't match")
+	}
+	if key := s.Key("10.0.0.2:2222"); key == nil || !reflect.DeepEqual(key.Marshal(), key2.Marshal()) {
+		t.Errorf("reloaded key for port 2222 doesn't match")
+	}
+
+	if err := s.Forget("10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Check("10.0.0.2:22", nil, key2); err != nil {
+		t.Fatalf("new key after Forget rejected: %v", err)
+	}
+}
+
+func TestHostKeyExpect(t *testing.T) {
+	s, err := NewHostKeyStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key1 := newHostKey(t)
+	key2 := newHostKey(t)
+
+	console := "This is localhost\nSSH host key: " + Fingerprint(key1) + " (RSA)\n"
+	s.Expect("[fd00::2]", ParseConsoleFingerprints(console))
+
+	if err := s.Check("[fd00::2]:22", nil, key2); err == nil {
+		t.Fatal("unexpected key accepted")
+	}
+	if err := s.Check("[fd00::2]:22", nil, key1); err != nil {
+		t.Fatalf("expected key rejected: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// JumpDialer dials connections through an SSH jump host (bastion), for
+// reaching machines that aren't directly reachable, e.g. on private
+// subnets. The connection to the jump host is shared and reopened if it
+// drops.
+type JumpDialer struct {
+	addr   string
+	config *ssh.ClientConfig
+	dialer Dialer
+	agent  net.Conn
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+// NewJumpDialer creates a JumpDialer for the jump host given as
+// [user@]host[:port], reached with dialer. It authenticates with the
+// private key in keyFile if set, and otherwise with the agent at
+// $SSH_AUTH_SOCK. The jump host's key must be listed in the
+// known_hosts file knownHosts if set, and is otherwise pinned on first
+// use.
+func NewJumpDialer(jumpHost, keyFile, knownHosts string, dialer Dialer) (*JumpDialer, error) {
+	user := defaultUser
+	host := jumpHost
+	if i := strings.LastIndex(jumpHost, "@"); i >= 0 {
+		user, host = jumpHost[:i], jumpHost[i+1:]
+	}
+	if host == "" {
+		return nil, fmt.Errorf("no host in jump host %q", jumpHost)
+	}
+
+	hostKeys, err := NewHostKeyStore(knownHosts)
+	if err != nil {
+		return nil, err
+	}
+	check := hostKeys.Check
+	if knownHosts != "" {
+		// verify against the file, but don't add to it
+		hostKeys.File = ""
+		check = hostKeys.CheckKnown
+	}
+
+	var auth ssh.AuthMethod
+	var agentConn net.Conn
+	if keyFile != "" {
+		pem, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", keyFile, err)
+		}
+		auth = ssh.PublicKeys(signer)
+	} else {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, fmt.Errorf("jump host %s needs a key file or $SSH_AUTH_SOCK", jumpHost)
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to SSH agent: %v", err)
+		}
+		agentConn = conn
+		auth = ssh.PublicKeysCallback(agent.NewClient(conn).Signers)
+	}
+
+	return &JumpDialer{
+		addr: ensurePortSuffix(host, defaultPort),
+		config: &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{auth},
+			HostKeyCallback: check,
+		},
+		dialer: dialer,
+		agent:  agentConn,
+	}, nil
+}
+
+// Dial connects to address through the jump host.
+func (j *JumpDialer) Dial(network, address string) (net.Conn, error) {
+	client, err := j.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.Dial(network, address)
+	if _, ok := err.(*ssh.OpenChannelError); err == nil || ok {
+		// the jump host is fine, address may not be
+		return conn, err
+	}
+
+	// the connection to the jump host died; try again on a new one
+	j.drop(client)
+	if client, err = j.connect(); err != nil {
+		return nil, err
+	}
+	return client.Dial(network, address)
+}
+
+func (j *JumpDialer) connect() (*ssh.Client, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.client != nil {
+		return j.client, nil
+	}
+
+	conn, err := j.dialer.Dial("tcp", j.addr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing jump host %s: %v", j.addr, err)
+	}
+	sshconn, chans, reqs, err := ssh.NewClientConn(conn, j.addr, j.config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("connecting to jump host %s: %v", j.addr, err)
+	}
+
+	j.client = ssh.NewClient(sshconn, chans, reqs)
+	return j.client, nil
+}
+
+// drop closes client if it is still the shared connection.
+func (j *JumpDialer) drop(client *ssh.Client) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.client == client {
+		j.client.Close()
+		j.client = nil
+	}
+}
+
+// Close closes the connection to the jump host and the SSH agent.
+func (j *JumpDialer) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var err error
+	if j.client != nil {
+		err = j.client.Close()
+		j.client = nil
+	}
+	if j.agent != nil {
+		if aerr := j.agent.Close(); err == nil {
+			err = aerr
+		}
+		j.agent = nil
+	}
+	return err
+}
@@ -0,0 +1,316 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// jumpServer is an SSH server forwarding direct-tcpip channels.
+type jumpServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	conns    int32
+}
+
+func newJumpServer(t *testing.T) *jumpServer {
+	hostKey, err := ssh.ParsePrivateKey(testHostKeyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &jumpServer{
+		config: &ssh.ServerConfig{
+			PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				if conn.User() != "bastion" {
+					return nil, fmt.Errorf("unexpected user %q", conn.User())
+				}
+				return nil, nil
+			},
+		},
+	}
+	s.config.AddHostKey(hostKey)
+
+	if s.listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go s.serve()
+	return s
+}
+
+func (s *jumpServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.conns, 1)
+		go s.handle(conn)
+	}
+}
+
+func (s *jumpServer) handle(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			newChannel.Reject(ssh.UnknownChannelType, "no")
+			continue
+		}
+		var target struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		dst, err := net.Dial("tcp", net.JoinHostPort(target.Host, fmt.Sprint(target.Port)))
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, reqs, err := newChannel.Accept()
+		if err != nil {
+			dst.Close()
+			continue
+		}
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			io.Copy(channel, dst)
+			channel.Close()
+		}()
+		go func() {
+			io.Copy(dst, channel)
+			dst.Close()
+		}()
+	}
+}
+
+// echo serves one line echoed back on each connection.
+func echo(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				io.WriteString(conn, line)
+			}()
+		}
+	}()
+	return l
+}
+
+func dialEcho(t *testing.T, j *JumpDialer, addr string) {
+	conn, err := j.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, "hello\n"); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello\n" {
+		t.Errorf("got %q, expected %q", line, "hello\n")
+	}
+}
+
+func TestJumpDialer(t *testing.T) {
+	keyFile, err := ioutil.TempFile("", "mantle-jump-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name())
+	keyFile.Write(testHostKeyBytes)
+	keyFile.Close()
+
+	server := newJumpServer(t)
+	defer server.listener.Close()
+	target := echo(t)
+	defer target.Close()
+
+	j, err := NewJumpDialer("bastion@"+server.listener.Addr().String(), keyFile.Name(), "", &net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	// the connection to the jump host is shared
+	dialEcho(t, j, target.Addr().String())
+	dialEcho(t, j, target.Addr().String())
+	if n := atomic.LoadInt32(&server.conns); n != 1 {
+		t.Errorf("jump host connected %d times, expected 1", n)
+	}
+
+	// unreachable targets don't drop it
+	if _, err := j.Dial("tcp", "127.0.0.1:1"); err == nil {
+		t.Errorf("dialing a closed port succeeded")
+	}
+	dialEcho(t, j, target.Addr().String())
+	if n := atomic.LoadInt32(&server.conns); n != 1 {
+		t.Errorf("jump host connected %d times, expected 1", n)
+	}
+
+	// a dead connection is replaced
+	j.client.Close()
+	dialEcho(t, j, target.Addr().String())
+	if n := atomic.LoadInt32(&server.conns); n != 2 {
+		t.Errorf("jump host connected %d times, expected 2", n)
+	}
+}
+
+func TestJumpDialerKnownHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mantle-jump-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, testHostKeyBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey(testHostKeyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey := newHostKey(t)
+
+	server := newJumpServer(t)
+	defer server.listener.Close()
+	target := echo(t)
+	defer target.Close()
+	addr := server.listener.Addr().String()
+
+	for _, tt := range []struct {
+		name  string
+		hosts string
+		ok    bool
+	}{
+		{"listed", knownHostsHost(addr) + " " + string(ssh.MarshalAuthorizedKey(signer.PublicKey())), true},
+		{"changed", knownHostsHost(addr) + " " + string(ssh.MarshalAuthorizedKey(otherKey)), false},
+		{"unlisted", "", false},
+	} {
+		knownHosts := filepath.Join(dir, "known_hosts")
+		if err := ioutil.WriteFile(knownHosts, []byte(tt.hosts), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		j, err := NewJumpDialer("bastion@"+addr, keyFile, knownHosts, &net.Dialer{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.ok {
+			dialEcho(t, j, target.Addr().String())
+		} else if _, err := j.Dial("tcp", target.Addr().String()); err == nil {
+			t.Errorf("%s: connected to jump host not in known_hosts", tt.name)
+		}
+		j.Close()
+
+		// the file is only read
+		if data, _ := ioutil.ReadFile(knownHosts); string(data) != tt.hosts {
+			t.Errorf("%s: known_hosts changed to %q", tt.name, data)
+		}
+	}
+}
+
+func TestJumpDialerAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mantle-jump-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := ssh.ParseRawPrivateKey(testHostKeyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		agent.ServeAgent(keyring, conn)
+		conn.Close()
+	}()
+
+	old := os.Getenv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", sock)
+	defer os.Setenv("SSH_AUTH_SOCK", old)
+
+	server := newJumpServer(t)
+	defer server.listener.Close()
+	target := echo(t)
+	defer target.Close()
+
+	j, err := NewJumpDialer("bastion@"+server.listener.Addr().String(), "", "", &net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialEcho(t, j, target.Addr().String())
+
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Errorf("agent connection still open after Close")
+	}
+}
@@ -31,13 +31,18 @@ var plog = capnslog.NewPackageLogger("github.com/coreos/mantle", "network/ntp")
 // lead to incorrect results. Timekeeping sucks.
 
 // A simple NTP server intended for testing. It can serve time at some offset
-// from the real time and adjust for a single leap second.
+// from the real time, step or slew that offset, and adjust for a single leap
+// second either all at once or smeared over a window.
 type Server struct {
 	net.PacketConn
-	mu       sync.Mutex    // protects offset, leapTime, and leapType.
-	offset   time.Duration // see SetTime
-	leapTime time.Time     // see SetLeapSecond
-	leapType LeapIndicator
+	mu        sync.Mutex    // protects all of the following fields.
+	offset    time.Duration // see SetTime
+	leapTime  time.Time     // see SetLeapSecond
+	leapType  LeapIndicator
+	leapSmear time.Duration // see SetLeapSmear
+	slewStart time.Time     // see SlewTime
+	slewDelta time.Duration
+	slewOver  time.Duration
 }
 
 type ServerReq struct {
@@ -65,6 +70,42 @@ func (s *Server) SetTime(now time.Time) {
 	} else {
 		s.offset = -time.Since(now)
 	}
+	s.slewOver = 0
+}
+
+// Step the served time by delta immediately.
+func (s *Server) StepTime(delta time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset += delta
+}
+
+// Gradually adjust the served time by delta over the given real duration,
+// like adjtime(3) does, instead of stepping it. Replaces any slew still in
+// progress, keeping the part of it already applied.
+func (s *Server) SlewTime(delta, over time.Duration) {
+	if over <= 0 {
+		panic("Invalid slew duration.")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.offset += s.slew(now)
+	s.slewStart = now
+	s.slewDelta = delta
+	s.slewOver = over
+}
+
+// Smear leap seconds set with SetLeapSecond linearly over a window of
+// the given length centered on the leap, the way some public NTP services
+// do, rather than announcing them and stepping. Zero disables smearing.
+func (s *Server) SetLeapSmear(window time.Duration) {
+	if window < 0 {
+		panic("Invalid leap smear window.")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leapSmear = window
 }
 
 // Must be exactly midnight on the first day of the month. This is the first
@@ -84,19 +125,32 @@ func (s *Server) SetLeapSecond(second time.Time, direction LeapIndicator) {
 	s.leapType = direction
 }
 
+// Now returns the time currently being served.
+func (s *Server) Now() time.Time {
+	now := time.Now()
+	offset, _ := s.UpdateOffset(now)
+	return now.Add(offset)
+}
+
 // Get the current offset between real time and the server's time, adjusting
 // for a leap second as needed. now is real time, not server time.
 func (s *Server) UpdateOffset(now time.Time) (time.Duration, LeapIndicator) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	slew := s.slew(now)
 	if s.leapTime.IsZero() || s.leapType == LEAP_NONE {
-		return s.offset, LEAP_NONE
+		return s.offset + slew, LEAP_NONE
+	}
+
+	now = now.Add(s.offset + slew)
+	if s.leapSmear != 0 {
+		smear := s.smear(now)
+		return s.offset + slew + smear, LEAP_NONE
 	}
 
-	now = now.Add(s.offset)
 	if now.Add(24 * time.Hour).Before(s.leapTime) {
-		return s.offset, LEAP_NONE
+		return s.offset + slew, LEAP_NONE
 	}
 
 	if s.leapType == LEAP_ADD && !now.Before(s.leapTime) {
@@ -114,7 +168,51 @@ func (s *Server) UpdateOffset(now time.Time) (time.Duration, LeapIndicator) {
 		s.leapType = LEAP_NONE
 	}
 
-	return s.offset, s.leapType
+	return s.offset + slew, s.leapType
+}
+
+// The part of the slew in progress applied by now, which is real time.
+// Completed slews are folded into the offset. Must be called with mu held.
+func (s *Server) slew(now time.Time) time.Duration {
+	if s.slewOver == 0 {
+		return 0
+	}
+	elapsed := now.Sub(s.slewStart)
+	if elapsed < 0 {
+		return 0
+	}
+	if elapsed >= s.slewOver {
+		s.offset += s.slewDelta
+		s.slewOver = 0
+		return 0
+	}
+	return time.Duration(float64(s.slewDelta) * float64(elapsed) / float64(s.slewOver))
+}
+
+// The part of the leap second smeared in by now, which is server time.
+// Once the window has passed the leap is folded into the offset. Must be
+// called with mu held.
+func (s *Server) smear(now time.Time) time.Duration {
+	leap := time.Second
+	if s.leapType == LEAP_ADD {
+		// the inserted second sets clocks back
+		leap = -time.Second
+	}
+
+	start := s.leapTime.Add(-s.leapSmear / 2)
+	elapsed := now.Sub(start)
+	switch {
+	case elapsed <= 0:
+		return 0
+	case elapsed >= s.leapSmear:
+		plog.Infof("Finished smearing leap second at %s", s.leapTime)
+		s.offset += leap
+		s.leapTime = time.Time{}
+		s.leapType = LEAP_NONE
+		return 0
+	default:
+		return time.Duration(float64(leap) * float64(elapsed) / float64(s.leapSmear))
+	}
 }
 
 // Serve NTP requests forever.
@@ -118,3 +118,46 @@ func TestServerUpdate(t *testing.T) {
 		}
 	}
 }
+
+func TestServerSlew(t *testing.T) {
+	s := &Server{}
+	s.SlewTime(10*time.Second, 100*time.Second)
+	start := s.slewStart
+
+	for _, u := range []update{
+		{0, 0, LEAP_NONE},
+		{10 * time.Second, time.Second, LEAP_NONE},
+		{50 * time.Second, 5 * time.Second, LEAP_NONE},
+		{100 * time.Second, 10 * time.Second, LEAP_NONE},
+		{200 * time.Second, 10 * time.Second, LEAP_NONE},
+	} {
+		off, li := s.UpdateOffset(start.Add(u.now))
+		if off != u.off || li != u.li {
+			t.Errorf("Wrong update at %s: %s!=%s %s!=%s",
+				u.now, u.off, off, u.li, li)
+		}
+	}
+}
+
+func TestServerSmear(t *testing.T) {
+	leap := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+	s := &Server{}
+	s.SetLeapSecond(leap, LEAP_ADD)
+	s.SetLeapSmear(24 * time.Hour)
+
+	for _, u := range []update{
+		{-24 * time.Hour, 0, LEAP_NONE},
+		{-12 * time.Hour, 0, LEAP_NONE},
+		{-6 * time.Hour, -250 * time.Millisecond, LEAP_NONE},
+		{0, -500 * time.Millisecond, LEAP_NONE},
+		{6 * time.Hour, -750 * time.Millisecond, LEAP_NONE},
+		{12 * time.Hour, -time.Second, LEAP_NONE},
+		{24 * time.Hour, -time.Second, LEAP_NONE},
+	} {
+		off, li := s.UpdateOffset(leap.Add(u.now))
+		if off != u.off || li != u.li {
+			t.Errorf("Wrong update at %s: %s!=%s %s!=%s",
+				u.now, u.off, off, u.li, li)
+		}
+	}
+}
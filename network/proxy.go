@@ -0,0 +1,358 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lookupIP resolves hostnames for socks5:// proxies.
+var lookupIP = net.LookupIP
+
+// ProxyFromEnvironment returns the proxy set by $ALL_PROXY (or
+// all_proxy), or "" if none is. $HTTPS_PROXY and $HTTP_PROXY are only
+// meant for HTTP, so they aren't used for other protocols like SSH.
+func ProxyFromEnvironment() string {
+	if proxy := os.Getenv("ALL_PROXY"); proxy != "" {
+		return proxy
+	}
+	return os.Getenv("all_proxy")
+}
+
+// ProxyDialer dials connections through a SOCKS5 or HTTP CONNECT proxy.
+// Loopback addresses and hosts matching $NO_PROXY are dialed directly.
+type ProxyDialer struct {
+	proxy  *url.URL
+	dialer Dialer
+}
+
+// NewProxyDialer creates a ProxyDialer for proxy, given as a
+// socks5://, socks5h://, http:// or https:// URL, reached with dialer.
+// A socks5:// proxy is sent addresses resolved locally, and a socks5h://
+// proxy hostnames. A proxy without a scheme is taken to be an HTTP
+// proxy.
+func NewProxyDialer(proxy string, dialer Dialer) (*ProxyDialer, error) {
+	u, err := parseProxy(proxy)
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyDialer{
+		proxy:  u,
+		dialer: dialer,
+	}, nil
+}
+
+// Dial connects to address through the proxy.
+func (d *ProxyDialer) Dial(network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(network, "tcp") || bypassProxy(host) {
+		return d.dialer.Dial(network, address)
+	}
+
+	conn, err := d.dialer.Dial("tcp", d.proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("dialing proxy %s: %v", d.proxy.Host, err)
+	}
+
+	switch d.proxy.Scheme {
+	case "socks5", "socks5h":
+		err = d.socks5Connect(conn, address)
+	case "https":
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: d.proxy.Hostname()})
+		if err = tlsConn.Handshake(); err == nil {
+			conn, err = d.httpConnect(tlsConn, address)
+		}
+	default:
+		conn, err = d.httpConnect(conn, address)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("connecting to %s through proxy %s: %v", address, d.proxy.Host, err)
+	}
+	return conn, nil
+}
+
+// socks5Connect asks a SOCKS5 proxy to connect conn to address, per
+// RFC 1928 and RFC 1929.
+func (d *ProxyDialer) socks5Connect(conn net.Conn, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("bad port %q", portStr)
+	}
+	if d.proxy.Scheme == "socks5" && net.ParseIP(host) == nil {
+		ips, err := lookupIP(host)
+		if err != nil {
+			return err
+		}
+		if len(ips) == 0 {
+			return fmt.Errorf("no addresses for %s", host)
+		}
+		host = ips[0].String()
+	}
+
+	const (
+		authNone     = 0
+		authPassword = 2
+	)
+	methods := []byte{authNone}
+	if d.proxy.User != nil {
+		methods = append(methods, authPassword)
+	}
+	if _, err := conn.Write(append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	switch reply[1] {
+	case authNone:
+	case authPassword:
+		user := d.proxy.User.Username()
+		password, _ := d.proxy.User.Password()
+		req := []byte{1, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("SOCKS authentication failed")
+		}
+	default:
+		return fmt.Errorf("no acceptable SOCKS authentication method")
+	}
+
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 1)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 4)
+		req = append(req, ip...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// the reply's bound address is of no interest but must be consumed
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		return fmt.Errorf("SOCKS connect failed with code %d", header[1])
+	}
+	var addrLen int
+	switch header[3] {
+	case 1:
+		addrLen = net.IPv4len
+	case 4:
+		addrLen = net.IPv6len
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		addrLen = int(n[0])
+	default:
+		return fmt.Errorf("unexpected SOCKS address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2)) // and port
+	return err
+}
+
+// httpConnect asks an HTTP proxy to connect conn to address.
+func (d *ProxyDialer) httpConnect(conn net.Conn, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.proxy.User != nil {
+		password, _ := d.proxy.User.Password()
+		auth := d.proxy.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("proxy responded %s", resp.Status)
+	}
+
+	// the server may already have sent data, e.g. the SSH banner
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
+
+// bufferedConn is a net.Conn read through a bufio.Reader.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// SetHTTPProxy has HTTP clients using http.DefaultTransport, as the
+// platform API clients do, connect through proxy. Requests to loopback
+// addresses and hosts matching $NO_PROXY still go directly. An empty
+// proxy leaves the transport's proxy settings alone.
+func SetHTTPProxy(proxy string) error {
+	if proxy == "" {
+		return nil
+	}
+
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("default HTTP transport is a %T", http.DefaultTransport)
+	}
+	return setTransportProxy(transport, proxy)
+}
+
+// setTransportProxy has transport connect through proxy. The Go releases
+// we build with only support http:// proxies in http.Transport, so other
+// proxies are dialed with a ProxyDialer.
+func setTransportProxy(transport *http.Transport, proxy string) error {
+	u, err := parseProxy(proxy)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme == "http" {
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if bypassProxy(req.URL.Hostname()) {
+				return nil, nil
+			}
+			return u, nil
+		}
+		return nil
+	}
+
+	d, err := NewProxyDialer(proxy, &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	})
+	if err != nil {
+		return err
+	}
+	transport.Proxy = nil
+	transport.DialContext = nil
+	transport.Dial = d.Dial
+	return nil
+}
+
+func parseProxy(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("parsing proxy %q: %v", proxy, err)
+	}
+
+	var port string
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		port = "1080"
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// bypassProxy reports whether host should be connected to directly:
+// if it is a loopback address or matches $NO_PROXY.
+func bypassProxy(host string) bool {
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	ip := net.ParseIP(host)
+	if host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return true
+	}
+
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && ipnet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		entry = strings.Trim(entry, "[]")
+		if host == entry || strings.HasSuffix(host, "."+strings.TrimPrefix(entry, ".")) {
+			return true
+		}
+	}
+	return false
+}
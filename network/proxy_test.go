@@ -0,0 +1,288 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// serveProxy accepts connections on a new listener, handing each to
+// handshake which returns the address to connect it to. Every host is
+// taken to be the loopback address, which the dialer wouldn't proxy.
+func serveProxy(t *testing.T, handshake func(conn net.Conn, r *bufio.Reader) string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				_, port, err := net.SplitHostPort(handshake(conn, r))
+				if err != nil {
+					return
+				}
+				dst, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+				if err != nil {
+					return
+				}
+				defer dst.Close()
+				go io.Copy(dst, r)
+				io.Copy(conn, dst)
+			}()
+		}
+	}()
+	return l
+}
+
+func socks5Handshake(conn net.Conn, r *bufio.Reader) string {
+	var hdr [2]byte
+	io.ReadFull(r, hdr[:])
+	io.ReadFull(r, make([]byte, hdr[1]))
+	conn.Write([]byte{5, 0})
+
+	var req [4]byte
+	io.ReadFull(r, req[:])
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case 3:
+		n, _ := r.ReadByte()
+		name := make([]byte, n)
+		io.ReadFull(r, name)
+		host = string(name)
+	}
+	var port [2]byte
+	io.ReadFull(r, port[:])
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+}
+
+func connectHandshake(conn net.Conn, r *bufio.Reader) string {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return ""
+	}
+	// greet right away to check early data isn't lost
+	fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\n\r\nhi\n")
+	return req.Host
+}
+
+func TestProxyDialer(t *testing.T) {
+	target := echo(t)
+	defer target.Close()
+
+	for _, tt := range []struct {
+		scheme    string
+		handshake func(net.Conn, *bufio.Reader) string
+		greeting  string
+	}{
+		{"socks5h", socks5Handshake, ""},
+		{"http", connectHandshake, "hi\n"},
+	} {
+		proxy := serveProxy(t, tt.handshake)
+		defer proxy.Close()
+
+		d, err := NewProxyDialer(tt.scheme+"://"+proxy.Addr().String(), &net.Dialer{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, port, _ := net.SplitHostPort(target.Addr().String())
+		conn, err := d.Dial("tcp", net.JoinHostPort("echo.test", port))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.scheme, err)
+		}
+
+		r := bufio.NewReader(conn)
+		if tt.greeting != "" {
+			if line, _ := r.ReadString('\n'); line != tt.greeting {
+				t.Errorf("%s: got greeting %q, expected %q", tt.scheme, line, tt.greeting)
+			}
+		}
+		io.WriteString(conn, "hello\n")
+		if line, _ := r.ReadString('\n'); line != "hello\n" {
+			t.Errorf("%s: got %q, expected %q", tt.scheme, line, "hello\n")
+		}
+		conn.Close()
+	}
+}
+
+func TestSetTransportProxy(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	}))
+	defer web.Close()
+	_, port, _ := net.SplitHostPort(web.Listener.Addr().String())
+	host := net.JoinHostPort("web.test", port)
+
+	proxy := serveProxy(t, socks5Handshake)
+	defer proxy.Close()
+
+	// http.Transport doesn't know SOCKS in the Go releases we build with
+	transport := &http.Transport{}
+	if err := setTransportProxy(transport, "socks5h://"+proxy.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if transport.Proxy != nil || transport.Dial == nil {
+		t.Fatalf("socks5h proxy not dialed by the transport")
+	}
+	resp, err := (&http.Client{Transport: transport}).Get("http://" + host + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != host {
+		t.Errorf("got %q, expected %q", body, host)
+	}
+
+	transport = &http.Transport{}
+	if err := setTransportProxy(transport, "http://proxy.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if transport.Proxy == nil || transport.Dial != nil {
+		t.Fatalf("http proxy not set as the transport's proxy")
+	}
+	req, _ := http.NewRequest("GET", "http://"+host+"/", nil)
+	if u, err := transport.Proxy(req); err != nil || u.String() != "http://proxy.example.com:80" {
+		t.Errorf("got proxy %v, %v", u, err)
+	}
+}
+
+func TestSocks5Resolve(t *testing.T) {
+	target := echo(t)
+	defer target.Close()
+
+	defer func(f func(string) ([]net.IP, error)) { lookupIP = f }(lookupIP)
+	lookupIP = func(host string) ([]net.IP, error) {
+		if host != "echo.test" {
+			return nil, fmt.Errorf("unknown host %s", host)
+		}
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil
+	}
+
+	for scheme, expect := range map[string]string{
+		"socks5":  "192.0.2.1",
+		"socks5h": "echo.test",
+	} {
+		hosts := make(chan string, 1)
+		proxy := serveProxy(t, func(conn net.Conn, r *bufio.Reader) string {
+			address := socks5Handshake(conn, r)
+			host, _, _ := net.SplitHostPort(address)
+			hosts <- host
+			return address
+		})
+		defer proxy.Close()
+
+		d, err := NewProxyDialer(scheme+"://"+proxy.Addr().String(), &net.Dialer{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, port, _ := net.SplitHostPort(target.Addr().String())
+		conn, err := d.Dial("tcp", net.JoinHostPort("echo.test", port))
+		if err != nil {
+			t.Fatalf("%s: %v", scheme, err)
+		}
+		conn.Close()
+		if host := <-hosts; host != expect {
+			t.Errorf("%s: proxy was sent %q, expected %q", scheme, host, expect)
+		}
+	}
+}
+
+func TestParseProxy(t *testing.T) {
+	for proxy, expect := range map[string]string{
+		"proxy.example.com":          "http://proxy.example.com:80",
+		"http://proxy.example.com":   "http://proxy.example.com:80",
+		"https://proxy.example.com":  "https://proxy.example.com:443",
+		"socks5://127.0.0.1":         "socks5://127.0.0.1:1080",
+		"socks5h://user:pw@[::1]:99": "socks5h://user:pw@[::1]:99",
+	} {
+		u, err := parseProxy(proxy)
+		if err != nil {
+			t.Errorf("%s: %v", proxy, err)
+		} else if u.String() != expect {
+			t.Errorf("parseProxy(%q) = %s, expected %s", proxy, u, expect)
+		}
+	}
+
+	if _, err := parseProxy("ftp://proxy.example.com"); err == nil {
+		t.Errorf("expected an error for an ftp:// proxy")
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	for _, name := range []string{"ALL_PROXY", "all_proxy", "HTTPS_PROXY", "HTTP_PROXY"} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Unsetenv(name)
+	}
+
+	os.Setenv("HTTPS_PROXY", "http://https.example.com")
+	os.Setenv("HTTP_PROXY", "http://http.example.com")
+	if proxy := ProxyFromEnvironment(); proxy != "" {
+		t.Errorf("got %q from HTTP-only proxy settings", proxy)
+	}
+
+	os.Setenv("all_proxy", "socks5://lower.example.com")
+	if proxy := ProxyFromEnvironment(); proxy != "socks5://lower.example.com" {
+		t.Errorf("got %q, expected all_proxy", proxy)
+	}
+	os.Setenv("ALL_PROXY", "socks5://upper.example.com")
+	if proxy := ProxyFromEnvironment(); proxy != "socks5://upper.example.com" {
+		t.Errorf("got %q, expected ALL_PROXY", proxy)
+	}
+}
+
+func TestBypassProxy(t *testing.T) {
+	defer os.Setenv("NO_PROXY", os.Getenv("NO_PROXY"))
+	os.Setenv("NO_PROXY", "example.com, .internal,10.0.0.0/8,[fd00::1]")
+
+	tests := map[string]bool{
+		"localhost":         true,
+		"127.0.0.1":         true,
+		"::1":               true,
+		"example.com":       true,
+		"api.example.com":   true,
+		"notexample.com":    false,
+		"host.internal":     true,
+		"10.1.2.3":          true,
+		"11.1.2.3":          false,
+		"fd00::1":           true,
+		"[fd00::1]":         true,
+		"storage.cloud.net": false,
+	}
+	for host, expect := range tests {
+		if bypassProxy(host) != expect {
+			t.Errorf("bypassProxy(%q) = %v, expected %v", host, !expect, expect)
+		}
+	}
+}
@@ -0,0 +1,483 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sftp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+// writeWindow is how many WRITE requests ReadFrom keeps in flight.
+const writeWindow = 16
+
+// response is a reply to a request, without its id.
+type response struct {
+	typ  byte
+	data []byte
+}
+
+// Client speaks SFTP to a server over a pair of streams, e.g. the
+// stdin and stdout of an SSH session running the sftp subsystem.
+// Requests may be made concurrently.
+type Client struct {
+	w   io.WriteCloser
+	wmu sync.Mutex
+
+	mu       sync.Mutex
+	nextID   uint32
+	inflight map[uint32]chan response
+	err      error
+}
+
+// NewClient starts an SFTP session, reading responses from r and
+// writing requests to w.
+func NewClient(r io.Reader, w io.WriteCloser) (*Client, error) {
+	c := &Client{
+		w:        w,
+		inflight: make(map[uint32]chan response),
+	}
+
+	p := newPacket(fxpInit)
+	p.uint32(protocolVersion)
+	if _, err := w.Write(p.bytes()); err != nil {
+		return nil, err
+	}
+	typ, data, err := readPacket(r)
+	if err != nil {
+		return nil, fmt.Errorf("sftp: reading server version: %v", err)
+	}
+	d := decoder{b: data}
+	if version := d.uint32(); typ != fxpVersion || version != protocolVersion {
+		return nil, fmt.Errorf("sftp: unsupported server version %d", version)
+	}
+
+	go c.recv(r)
+	return c, nil
+}
+
+// Close ends the session.
+func (c *Client) Close() error {
+	return c.w.Close()
+}
+
+func readPacket(r io.Reader) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	length := be.Uint32(hdr[:4])
+	if length < 1 || length > 1<<24 {
+		return 0, nil, fmt.Errorf("bad packet length %d", length)
+	}
+	data := make([]byte, length-1)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return hdr[4], data, nil
+}
+
+// recv hands responses to the requests waiting for them.
+func (c *Client) recv(r io.Reader) {
+	var err error
+	for {
+		var typ byte
+		var data []byte
+		if typ, data, err = readPacket(r); err != nil {
+			break
+		}
+		d := decoder{b: data}
+		id := d.uint32()
+		if d.err != nil {
+			err = fmt.Errorf("short packet")
+			break
+		}
+
+		c.mu.Lock()
+		ch, ok := c.inflight[id]
+		delete(c.inflight, id)
+		c.mu.Unlock()
+		if !ok {
+			err = fmt.Errorf("response to unknown request %d", id)
+			break
+		}
+		ch <- response{typ, d.b}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	c.err = fmt.Errorf("sftp: connection lost: %v", err)
+	for id, ch := range c.inflight {
+		close(ch)
+		delete(c.inflight, id)
+	}
+}
+
+// send sends a request built by build, returning where its response
+// will be delivered.
+func (c *Client) send(typ byte, build func(p *buffer)) (<-chan response, error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	id := c.nextID
+	c.nextID++
+	ch := make(chan response, 1)
+	c.inflight[id] = ch
+	c.mu.Unlock()
+
+	p := newPacket(typ)
+	p.uint32(id)
+	build(p)
+
+	c.wmu.Lock()
+	_, err := c.w.Write(p.bytes())
+	c.wmu.Unlock()
+	if err != nil {
+		c.mu.Lock()
+		delete(c.inflight, id)
+		c.mu.Unlock()
+		return nil, err
+	}
+	return ch, nil
+}
+
+// wait waits for the response on ch, turning error statuses into
+// errors and checking it is of type expect.
+func (c *Client) wait(ch <-chan response, expect byte) (*decoder, error) {
+	resp, ok := <-ch
+	if !ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return nil, c.err
+	}
+
+	d := &decoder{b: resp.data}
+	if resp.typ == fxpStatus {
+		code := d.uint32()
+		msg := d.string()
+		if d.err != nil {
+			return nil, d.err
+		}
+		if code == statusOK && expect == fxpStatus {
+			return d, nil
+		}
+		if code == statusEOF {
+			return nil, io.EOF
+		}
+		return nil, &StatusError{Code: code, Msg: msg}
+	}
+	if resp.typ != expect {
+		return nil, fmt.Errorf("sftp: unexpected response type %d", resp.typ)
+	}
+	return d, nil
+}
+
+// call sends a request and waits for its response.
+func (c *Client) call(typ, expect byte, build func(p *buffer)) (*decoder, error) {
+	ch, err := c.send(typ, build)
+	if err != nil {
+		return nil, err
+	}
+	return c.wait(ch, expect)
+}
+
+// PathError records an error and the operation and path it concerns.
+type PathError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *PathError) Error() string {
+	return e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+func pathError(op, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PathError{Op: op, Path: path, Err: err}
+}
+
+func (c *Client) open(name string, flags uint32, a *attrs) (*File, error) {
+	d, err := c.call(fxpOpen, fxpHandle, func(p *buffer) {
+		p.string(name)
+		p.uint32(flags)
+		p.attrs(a)
+	})
+	if err != nil {
+		return nil, err
+	}
+	handle := d.string()
+	return &File{c: c, name: name, handle: handle}, d.err
+}
+
+// Open opens name for reading.
+func (c *Client) Open(name string) (*File, error) {
+	f, err := c.open(name, fxfRead, nil)
+	return f, pathError("open", name, err)
+}
+
+// Create creates or truncates name for writing. New files get mode.
+func (c *Client) Create(name string, mode os.FileMode) (*File, error) {
+	f, err := c.open(name, fxfWrite|fxfCreat|fxfTrunc, &attrs{
+		flags: attrPermissions,
+		perm:  permissions(mode),
+	})
+	return f, pathError("create", name, err)
+}
+
+func (c *Client) stat(typ byte, name string) (*FileInfo, error) {
+	d, err := c.call(typ, fxpAttrs, func(p *buffer) {
+		p.string(name)
+	})
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	a := d.attrs()
+	return &FileInfo{name: path.Base(name), attrs: a}, d.err
+}
+
+// Stat describes name, following symlinks.
+func (c *Client) Stat(name string) (*FileInfo, error) {
+	return c.stat(fxpStat, name)
+}
+
+// Lstat describes name without following symlinks.
+func (c *Client) Lstat(name string) (*FileInfo, error) {
+	return c.stat(fxpLstat, name)
+}
+
+// ReadDir lists the directory name.
+func (c *Client) ReadDir(name string) ([]*FileInfo, error) {
+	d, err := c.call(fxpOpendir, fxpHandle, func(p *buffer) {
+		p.string(name)
+	})
+	if err != nil {
+		return nil, pathError("open directory", name, err)
+	}
+	handle := d.string()
+	defer c.closeHandle(handle)
+
+	var entries []*FileInfo
+	for {
+		d, err := c.call(fxpReaddir, fxpName, func(p *buffer) {
+			p.string(handle)
+		})
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, pathError("read directory", name, err)
+		}
+
+		for n := d.uint32(); n > 0 && d.err == nil; n-- {
+			fi := &FileInfo{name: d.string()}
+			d.string() // long name
+			fi.attrs = d.attrs()
+			if fi.name != "." && fi.name != ".." {
+				entries = append(entries, fi)
+			}
+		}
+		if d.err != nil {
+			return nil, pathError("read directory", name, d.err)
+		}
+	}
+}
+
+func (c *Client) setstat(name string, a *attrs) error {
+	_, err := c.call(fxpSetstat, fxpStatus, func(p *buffer) {
+		p.string(name)
+		p.attrs(a)
+	})
+	return err
+}
+
+// Chmod changes the mode of name.
+func (c *Client) Chmod(name string, mode os.FileMode) error {
+	return pathError("chmod", name, c.setstat(name, &attrs{
+		flags: attrPermissions,
+		perm:  permissions(mode),
+	}))
+}
+
+// Chown changes the owner of name.
+func (c *Client) Chown(name string, uid, gid int) error {
+	return pathError("chown", name, c.setstat(name, &attrs{
+		flags: attrUIDGID,
+		uid:   uint32(uid),
+		gid:   uint32(gid),
+	}))
+}
+
+// Mkdir creates the directory name.
+func (c *Client) Mkdir(name string, mode os.FileMode) error {
+	_, err := c.call(fxpMkdir, fxpStatus, func(p *buffer) {
+		p.string(name)
+		p.attrs(&attrs{
+			flags: attrPermissions,
+			perm:  permissions(mode),
+		})
+	})
+	return pathError("mkdir", name, err)
+}
+
+// MkdirAll creates the directory name and any missing parents.
+func (c *Client) MkdirAll(name string, mode os.FileMode) error {
+	fi, err := c.Stat(name)
+	if err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("mkdir %s: not a directory", name)
+		}
+		return nil
+	} else if !IsNotExist(err) {
+		return err
+	}
+
+	if parent := path.Dir(name); parent != name {
+		if err := c.MkdirAll(parent, mode); err != nil {
+			return err
+		}
+	}
+	return c.Mkdir(name, mode)
+}
+
+// Remove removes the file name.
+func (c *Client) Remove(name string) error {
+	_, err := c.call(fxpRemove, fxpStatus, func(p *buffer) {
+		p.string(name)
+	})
+	return pathError("remove", name, err)
+}
+
+func (c *Client) closeHandle(handle string) error {
+	_, err := c.call(fxpClose, fxpStatus, func(p *buffer) {
+		p.string(handle)
+	})
+	return err
+}
+
+// File is an open remote file. Reads and writes are sequential.
+type File struct {
+	c      *Client
+	name   string
+	handle string
+	offset uint64
+}
+
+// Read reads from the file.
+func (f *File) Read(b []byte) (int, error) {
+	if len(b) > chunkSize {
+		b = b[:chunkSize]
+	}
+	d, err := f.c.call(fxpRead, fxpData, func(p *buffer) {
+		p.string(f.handle)
+		p.uint64(f.offset)
+		p.uint32(uint32(len(b)))
+	})
+	if err == io.EOF {
+		return 0, io.EOF
+	} else if err != nil {
+		return 0, pathError("read", f.name, err)
+	}
+	n := copy(b, d.data())
+	f.offset += uint64(n)
+	return n, d.err
+}
+
+func (f *File) sendWrite(b []byte) (<-chan response, error) {
+	ch, err := f.c.send(fxpWrite, func(p *buffer) {
+		p.string(f.handle)
+		p.uint64(f.offset)
+		p.data(b)
+	})
+	if err == nil {
+		f.offset += uint64(len(b))
+	}
+	return ch, err
+}
+
+// Write writes to the file.
+func (f *File) Write(b []byte) (int, error) {
+	var n int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		ch, err := f.sendWrite(chunk)
+		if err == nil {
+			_, err = f.c.wait(ch, fxpStatus)
+		}
+		if err != nil {
+			return n, pathError("write", f.name, err)
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// ReadFrom writes everything read from r to the file, keeping several
+// writes in flight to not wait on the round trip for each. It is used
+// by io.Copy.
+func (f *File) ReadFrom(r io.Reader) (int64, error) {
+	var pending []<-chan response
+	var n int64
+	var err error
+
+	for err == nil {
+		if len(pending) == writeWindow {
+			if _, err = f.c.wait(pending[0], fxpStatus); err != nil {
+				break
+			}
+			pending = pending[1:]
+		}
+
+		buf := make([]byte, chunkSize)
+		m, rerr := io.ReadFull(r, buf)
+		if m > 0 {
+			var ch <-chan response
+			if ch, err = f.sendWrite(buf[:m]); err != nil {
+				break
+			}
+			pending = append(pending, ch)
+			n += int64(m)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		err = rerr
+	}
+
+	// collect the remaining responses; the first error wins
+	for _, ch := range pending {
+		if _, werr := f.c.wait(ch, fxpStatus); err == nil {
+			err = werr
+		}
+	}
+	return n, pathError("write", f.name, err)
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	return pathError("close", f.name, f.c.closeHandle(f.handle))
+}
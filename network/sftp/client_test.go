@@ -0,0 +1,312 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sftp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// server is a minimal SFTP server rooted in a local directory, serving
+// requests one at a time.
+type server struct {
+	root    string
+	handles map[string]*os.File
+	r       io.Reader
+	w       io.Writer
+}
+
+func (s *server) serve() {
+	if _, _, err := readPacket(s.r); err != nil {
+		return
+	}
+	p := newPacket(fxpVersion)
+	p.uint32(protocolVersion)
+	s.w.Write(p.bytes())
+
+	for {
+		typ, data, err := readPacket(s.r)
+		if err != nil {
+			return
+		}
+		d := &decoder{b: data}
+		id := d.uint32()
+		s.w.Write(s.handle(typ, id, d).bytes())
+	}
+}
+
+func (s *server) status(id uint32, err error) *buffer {
+	p := newPacket(fxpStatus)
+	p.uint32(id)
+	switch {
+	case err == nil:
+		p.uint32(statusOK)
+	case err == io.EOF:
+		p.uint32(statusEOF)
+	case os.IsNotExist(err):
+		p.uint32(statusNoSuchFile)
+	default:
+		p.uint32(statusFailure)
+	}
+	p.string(fmt.Sprint(err))
+	p.string("")
+	return p
+}
+
+func (s *server) fileAttrs(fi os.FileInfo) *attrs {
+	st := fi.Sys().(*syscall.Stat_t)
+	perm := permissions(fi.Mode())
+	if fi.IsDir() {
+		perm |= modeDir
+	} else {
+		perm |= modeRegular
+	}
+	return &attrs{
+		flags: attrSize | attrUIDGID | attrPermissions,
+		size:  uint64(fi.Size()),
+		uid:   st.Uid,
+		gid:   st.Gid,
+		perm:  perm,
+	}
+}
+
+func (s *server) handle(typ byte, id uint32, d *decoder) *buffer {
+	switch typ {
+	case fxpOpen:
+		name := filepath.Join(s.root, d.string())
+		flags := d.uint32()
+		a := d.attrs()
+		osflags := os.O_RDONLY
+		if flags&fxfWrite != 0 {
+			osflags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		}
+		f, err := os.OpenFile(name, osflags, fileMode(a.perm))
+		if err != nil {
+			return s.status(id, err)
+		}
+		handle := strconv.Itoa(len(s.handles))
+		s.handles[handle] = f
+		p := newPacket(fxpHandle)
+		p.uint32(id)
+		p.string(handle)
+		return p
+	case fxpOpendir:
+		name := filepath.Join(s.root, d.string())
+		f, err := os.Open(name)
+		if err != nil {
+			return s.status(id, err)
+		}
+		handle := strconv.Itoa(len(s.handles))
+		s.handles[handle] = f
+		p := newPacket(fxpHandle)
+		p.uint32(id)
+		p.string(handle)
+		return p
+	case fxpClose:
+		handle := d.string()
+		err := s.handles[handle].Close()
+		delete(s.handles, handle)
+		return s.status(id, err)
+	case fxpRead:
+		f := s.handles[d.string()]
+		off := d.uint64()
+		buf := make([]byte, d.uint32())
+		n, err := f.ReadAt(buf, int64(off))
+		if n == 0 {
+			return s.status(id, err)
+		}
+		p := newPacket(fxpData)
+		p.uint32(id)
+		p.data(buf[:n])
+		return p
+	case fxpWrite:
+		f := s.handles[d.string()]
+		off := d.uint64()
+		_, err := f.WriteAt(d.data(), int64(off))
+		return s.status(id, err)
+	case fxpReaddir:
+		f := s.handles[d.string()]
+		fis, err := f.Readdir(0)
+		if len(fis) == 0 {
+			return s.status(id, io.EOF)
+		} else if err != nil {
+			return s.status(id, err)
+		}
+		p := newPacket(fxpName)
+		p.uint32(id)
+		p.uint32(uint32(len(fis)))
+		for _, fi := range fis {
+			p.string(fi.Name())
+			p.string(fi.Name())
+			p.attrs(s.fileAttrs(fi))
+		}
+		return p
+	case fxpStat, fxpLstat:
+		fi, err := os.Stat(filepath.Join(s.root, d.string()))
+		if err != nil {
+			return s.status(id, err)
+		}
+		p := newPacket(fxpAttrs)
+		p.uint32(id)
+		p.attrs(s.fileAttrs(fi))
+		return p
+	case fxpSetstat:
+		name := filepath.Join(s.root, d.string())
+		a := d.attrs()
+		var err error
+		if a.flags&attrPermissions != 0 {
+			err = os.Chmod(name, fileMode(a.perm))
+		}
+		return s.status(id, err)
+	case fxpMkdir:
+		name := filepath.Join(s.root, d.string())
+		return s.status(id, os.Mkdir(name, fileMode(d.attrs().perm)))
+	case fxpRemove:
+		return s.status(id, os.Remove(filepath.Join(s.root, d.string())))
+	}
+	return s.status(id, fmt.Errorf("unsupported request %d", typ))
+}
+
+func newTestClient(t *testing.T) (*Client, string) {
+	root, err := ioutil.TempDir("", "mantle-sftp-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	s := &server{
+		root:    root,
+		handles: make(map[string]*os.File),
+		r:       sr,
+		w:       sw,
+	}
+	go func() {
+		s.serve()
+		sw.Close()
+	}()
+
+	c, err := NewClient(cr, cw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, root
+}
+
+func TestTransfer(t *testing.T) {
+	c, root := newTestClient(t)
+	defer os.RemoveAll(root)
+	defer c.Close()
+
+	if err := c.MkdirAll("/a/b", 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	// large enough to need many pipelined writes
+	data := make([]byte, 20*chunkSize+123)
+	rand.Read(data)
+
+	f, err := c.Create("/a/b/file", 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := io.Copy(f, bytes.NewReader(data)); err != nil || n != int64(len(data)) {
+		t.Fatalf("copied %d bytes: %v", n, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	local, err := ioutil.ReadFile(filepath.Join(root, "a/b/file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(local, data) {
+		t.Errorf("uploaded data differs")
+	}
+
+	fi, err := c.Stat("/a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(data)) || fi.Mode() != 0640 {
+		t.Errorf("got size %d mode %v, expected %d %v", fi.Size(), fi.Mode(), len(data), os.FileMode(0640))
+	}
+
+	f, err = c.Open("/a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(remote, data) {
+		t.Errorf("downloaded data differs")
+	}
+
+	if err := c.Chmod("/a/b/file", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(filepath.Join(root, "a/b/file")); err != nil || fi.Mode() != 0600 {
+		t.Errorf("chmod left mode %v: %v", fi.Mode(), err)
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	c, root := newTestClient(t)
+	defer os.RemoveAll(root)
+	defer c.Close()
+
+	for _, name := range []string{"x", "y", "z"} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	fis, err := c.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[dir/ x y z]" {
+		t.Errorf("got entries %v", names)
+	}
+
+	if _, err := c.Stat("/missing"); !IsNotExist(err) {
+		t.Errorf("stat of missing file returned %v", err)
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// SFTP v3 (draft-ietf-secsh-filexfer-02)
+// https://tools.ietf.org/html/draft-ietf-secsh-filexfer-02
+package sftp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const protocolVersion = 3
+
+// packet types
+const (
+	fxpInit     = 1
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpRead     = 5
+	fxpWrite    = 6
+	fxpLstat    = 7
+	fxpFstat    = 8
+	fxpSetstat  = 9
+	fxpFsetstat = 10
+	fxpOpendir  = 11
+	fxpReaddir  = 12
+	fxpRemove   = 13
+	fxpMkdir    = 14
+	fxpRmdir    = 15
+	fxpRealpath = 16
+	fxpStat     = 17
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpData     = 103
+	fxpName     = 104
+	fxpAttrs    = 105
+)
+
+// open flags
+const (
+	fxfRead   = 0x01
+	fxfWrite  = 0x02
+	fxfAppend = 0x04
+	fxfCreat  = 0x08
+	fxfTrunc  = 0x10
+	fxfExcl   = 0x20
+)
+
+// attribute flags
+const (
+	attrSize        = 0x01
+	attrUIDGID      = 0x02
+	attrPermissions = 0x04
+	attrACModTime   = 0x08
+	attrExtended    = 0x80000000
+)
+
+// status codes
+const (
+	statusOK               = 0
+	statusEOF              = 1
+	statusNoSuchFile       = 2
+	statusPermissionDenied = 3
+	statusFailure          = 4
+)
+
+// file type bits of the permissions attribute
+const (
+	modeType    = 0170000
+	modeDir     = 0040000
+	modeRegular = 0100000
+	modeSymlink = 0120000
+	modeSetuid  = 04000
+	modeSetgid  = 02000
+	modeSticky  = 01000
+)
+
+// chunkSize is the payload of each READ and WRITE, small enough for
+// the 34000 byte packets all servers must accept.
+const chunkSize = 32768
+
+// short-hand to make the marshal functions less tedious
+var be = binary.BigEndian
+
+// StatusError is an error status returned by the server.
+type StatusError struct {
+	Code uint32
+	Msg  string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("sftp: %s (status %d)", e.Msg, e.Code)
+}
+
+// IsNotExist reports whether err is the server reporting that a file
+// doesn't exist.
+func IsNotExist(err error) bool {
+	if pe, ok := err.(*PathError); ok {
+		err = pe.Err
+	}
+	e, ok := err.(*StatusError)
+	return ok && e.Code == statusNoSuchFile
+}
+
+// buffer builds a packet.
+type buffer struct {
+	b []byte
+}
+
+func newPacket(typ byte) *buffer {
+	// length is filled in by bytes
+	return &buffer{b: []byte{0, 0, 0, 0, typ}}
+}
+
+func (b *buffer) uint32(v uint32) {
+	b.b = append(b.b, 0, 0, 0, 0)
+	be.PutUint32(b.b[len(b.b)-4:], v)
+}
+
+func (b *buffer) uint64(v uint64) {
+	b.b = append(b.b, 0, 0, 0, 0, 0, 0, 0, 0)
+	be.PutUint64(b.b[len(b.b)-8:], v)
+}
+
+func (b *buffer) string(s string) {
+	b.uint32(uint32(len(s)))
+	b.b = append(b.b, s...)
+}
+
+func (b *buffer) data(d []byte) {
+	b.uint32(uint32(len(d)))
+	b.b = append(b.b, d...)
+}
+
+func (b *buffer) attrs(a *attrs) {
+	if a == nil {
+		b.uint32(0)
+		return
+	}
+	b.uint32(a.flags)
+	if a.flags&attrSize != 0 {
+		b.uint64(a.size)
+	}
+	if a.flags&attrUIDGID != 0 {
+		b.uint32(a.uid)
+		b.uint32(a.gid)
+	}
+	if a.flags&attrPermissions != 0 {
+		b.uint32(a.perm)
+	}
+	if a.flags&attrACModTime != 0 {
+		b.uint32(a.atime)
+		b.uint32(a.mtime)
+	}
+}
+
+// bytes returns the packet, with its length set.
+func (b *buffer) bytes() []byte {
+	be.PutUint32(b.b, uint32(len(b.b)-4))
+	return b.b
+}
+
+// decoder parses a packet, recording the first error.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.b) < n {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) uint32() uint32 {
+	if v := d.take(4); v != nil {
+		return be.Uint32(v)
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if v := d.take(8); v != nil {
+		return be.Uint64(v)
+	}
+	return 0
+}
+
+func (d *decoder) data() []byte {
+	return d.take(int(d.uint32()))
+}
+
+func (d *decoder) string() string {
+	return string(d.data())
+}
+
+func (d *decoder) attrs() *attrs {
+	a := &attrs{flags: d.uint32()}
+	if a.flags&attrSize != 0 {
+		a.size = d.uint64()
+	}
+	if a.flags&attrUIDGID != 0 {
+		a.uid = d.uint32()
+		a.gid = d.uint32()
+	}
+	if a.flags&attrPermissions != 0 {
+		a.perm = d.uint32()
+	}
+	if a.flags&attrACModTime != 0 {
+		a.atime = d.uint32()
+		a.mtime = d.uint32()
+	}
+	if a.flags&attrExtended != 0 {
+		for n := d.uint32(); n > 0 && d.err == nil; n-- {
+			d.string()
+			d.string()
+		}
+	}
+	return a
+}
+
+// attrs are file attributes. flags says which fields are set.
+type attrs struct {
+	flags uint32
+	size  uint64
+	uid   uint32
+	gid   uint32
+	perm  uint32
+	atime uint32
+	mtime uint32
+}
+
+// permissions converts mode to the permissions attribute.
+func permissions(mode os.FileMode) uint32 {
+	perm := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		perm |= modeSetuid
+	}
+	if mode&os.ModeSetgid != 0 {
+		perm |= modeSetgid
+	}
+	if mode&os.ModeSticky != 0 {
+		perm |= modeSticky
+	}
+	return perm
+}
+
+// fileMode converts the permissions attribute to an os.FileMode.
+func fileMode(perm uint32) os.FileMode {
+	mode := os.FileMode(perm & 0777)
+	switch perm & modeType {
+	case modeDir:
+		mode |= os.ModeDir
+	case modeSymlink:
+		mode |= os.ModeSymlink
+	case modeRegular:
+	default:
+		// sockets, devices and pipes; none are transferred, so they
+		// only need to be told apart from regular files
+		if perm&modeType != 0 {
+			mode |= os.ModeDevice
+		}
+	}
+	if perm&modeSetuid != 0 {
+		mode |= os.ModeSetuid
+	}
+	if perm&modeSetgid != 0 {
+		mode |= os.ModeSetgid
+	}
+	if perm&modeSticky != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// FileInfo describes a remote file.
+type FileInfo struct {
+	name  string
+	attrs *attrs
+}
+
+func (fi *FileInfo) Name() string       { return fi.name }
+func (fi *FileInfo) Size() int64        { return int64(fi.attrs.size) }
+func (fi *FileInfo) Mode() os.FileMode  { return fileMode(fi.attrs.perm) }
+func (fi *FileInfo) ModTime() time.Time { return time.Unix(int64(fi.attrs.mtime), 0) }
+func (fi *FileInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *FileInfo) Sys() interface{}   { return nil }
+
+// UID and GID return the file's owner.
+func (fi *FileInfo) UID() int { return int(fi.attrs.uid) }
+func (fi *FileInfo) GID() int { return int(fi.attrs.gid) }
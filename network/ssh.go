@@ -18,6 +18,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
@@ -45,6 +46,7 @@ type SSHAgent struct {
 	Dialer
 	User     string
 	Socket   string
+	HostKeys *HostKeyStore // pins the host keys of machines connected to
 	sockDir  string
 	listener *net.UnixListener
 }
@@ -82,11 +84,19 @@ func NewSSHAgent(dialer Dialer) (*SSHAgent, error) {
 		return nil, err
 	}
 
+	hostKeys, err := NewHostKeyStore("")
+	if err != nil {
+		listener.Close()
+		os.RemoveAll(sockDir)
+		return nil, err
+	}
+
 	a := &SSHAgent{
 		Agent:    keyring,
 		Dialer:   dialer,
 		User:     defaultUser,
 		Socket:   sockPath,
+		HostKeys: hostKeys,
 		sockDir:  sockDir,
 		listener: listener,
 	}
@@ -104,9 +114,13 @@ func NewSSHAgent(dialer Dialer) (*SSHAgent, error) {
 	return a, nil
 }
 
-// Close closes the unix socket of the agent.
+// Close closes the unix socket of the agent, and its Dialer if that
+// needs closing.
 func (a *SSHAgent) Close() error {
 	a.listener.Close()
+	if c, ok := a.Dialer.(io.Closer); ok {
+		c.Close()
+	}
 	return os.RemoveAll(a.sockDir)
 }
 
@@ -128,8 +142,9 @@ func ensurePortSuffix(host string, port int) string {
 
 func (a *SSHAgent) newClient(host string, user string, auth []ssh.AuthMethod) (*ssh.Client, error) {
 	sshcfg := ssh.ClientConfig{
-		User: user,
-		Auth: auth,
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: a.HostKeys.Check,
 	}
 	addr := ensurePortSuffix(host, defaultPort)
 	tcpconn, err := a.Dial("tcp", addr)
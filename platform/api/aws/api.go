@@ -50,6 +50,16 @@ type Options struct {
 	AMI           string
 	InstanceType  string
 	SecurityGroup string
+
+	// Bastion is an SSH jump host, as [user@]host[:port], to reach
+	// instances through. If set, instances need no public IP address.
+	Bastion string
+	// BastionKey is the private key file to log into Bastion with,
+	// if not using $SSH_AUTH_SOCK
+	BastionKey string
+	// BastionKnownHosts is a known_hosts file with Bastion's host
+	// key, if not trusting the first key it presents
+	BastionKnownHosts string
 }
 
 type API struct {
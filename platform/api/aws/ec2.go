@@ -43,7 +43,7 @@ func (a *API) DeleteKey(name string) error {
 	return err
 }
 
-// CreateInstances creates EC2 instances with a given name tag, optional ssh key name, user data. The image ID, instance type, and security group set in the API will be used. CreateInstances will block until all instances are running and have an IP address.
+// CreateInstances creates EC2 instances with a given name tag, optional ssh key name, user data. The image ID, instance type, and security group set in the API will be used. CreateInstances will block until all instances are running and have an IP address, which is the private one if a bastion is used.
 func (a *API) CreateInstances(name, keyname, userdata string, count uint64) ([]*ec2.Instance, error) {
 	cnt := int64(count)
 
@@ -128,7 +128,11 @@ func (a *API) CreateInstances(name, keyname, userdata string, count uint64) ([]*
 
 		done = true
 		for _, i := range insts {
-			if *i.State.Name != ec2.InstanceStateNameRunning || i.PublicIpAddress == nil {
+			ip := i.PublicIpAddress
+			if a.opts.Bastion != "" {
+				ip = i.PrivateIpAddress
+			}
+			if *i.State.Name != ec2.InstanceStateNameRunning || ip == nil {
 				done = false
 				break
 			}
@@ -41,6 +41,13 @@ type Options struct {
 	Network     string
 	JSONKeyFile string
 	ServiceAuth bool
+
+	// Bastion is an SSH jump host, as [user@]host[:port], to reach
+	// instances through. If set, instances get no external IP address.
+	Bastion           string
+	BastionKey        string
+	BastionKnownHosts string
+
 	*platform.Options
 }
 
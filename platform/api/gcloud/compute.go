@@ -73,16 +73,18 @@ func (a *API) mkinstance(userdata, name string, keys []*agent.Key) *compute.Inst
 		},
 		NetworkInterfaces: []*compute.NetworkInterface{
 			&compute.NetworkInterface{
-				AccessConfigs: []*compute.AccessConfig{
-					&compute.AccessConfig{
-						Type: "ONE_TO_ONE_NAT",
-						Name: "External NAT",
-					},
-				},
 				Network: instancePrefix + "/global/networks/" + a.options.Network,
 			},
 		},
 	}
+	if a.options.Bastion == "" {
+		instance.NetworkInterfaces[0].AccessConfigs = []*compute.AccessConfig{
+			&compute.AccessConfig{
+				Type: "ONE_TO_ONE_NAT",
+				Name: "External NAT",
+			},
+		}
+	}
 	// add cloud config
 	if userdata != "" {
 		instance.Metadata.Items = append(instance.Metadata.Items, &compute.MetadataItems{
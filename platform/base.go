@@ -16,10 +16,11 @@ package platform
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -48,12 +49,26 @@ func NewBaseCluster(basename string, rconf *RuntimeConfig) (*BaseCluster, error)
 	return NewBaseClusterWithDialer(basename, rconf, network.NewRetryDialer())
 }
 
+// NewDialer returns a dialer for reaching machines' SSH servers, going
+// through opts.Proxy if set.
+func NewDialer(opts *Options) (network.Dialer, error) {
+	dialer := network.NewRetryDialer()
+	if opts.Proxy == "" {
+		return dialer, nil
+	}
+	return network.NewProxyDialer(opts.Proxy, dialer)
+}
+
 func NewBaseClusterWithDialer(basename string, rconf *RuntimeConfig, dialer network.Dialer) (*BaseCluster, error) {
 	agent, err := network.NewSSHAgent(dialer)
 	if err != nil {
 		return nil, err
 	}
 
+	if rconf.OutputDir != "" {
+		agent.HostKeys.File = filepath.Join(rconf.OutputDir, "known_hosts")
+	}
+
 	bc := &BaseCluster{
 		agent:      agent,
 		machmap:    make(map[string]Machine),
@@ -93,24 +108,33 @@ func (bc *BaseCluster) PasswordSSHClient(ip string, user string, password string
 }
 
 func (bc *BaseCluster) SSH(m Machine, cmd string) ([]byte, error) {
-	client, err := bc.SSHClient(m.IP())
+	session, release, err := NewSSHSession(m)
 	if err != nil {
 		return nil, err
 	}
 
-	defer client.Close()
+	defer release()
 
-	session, err := client.NewSession()
+	// stderr goes to the log rather than kola's own stderr, and
+	// isn't mixed into the output callers parse
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	out, err := session.Output(cmd)
+	out = bytes.TrimSpace(out)
+	if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+		plog.Infof("%s: %q: %s", m.ID(), cmd, msg)
+	}
+	return out, err
+}
+
+// Exec runs cmd on m, see Machine.Exec.
+func (bc *BaseCluster) Exec(ctx context.Context, m Machine, cmd string, opts *ExecOptions) (*ExecResult, error) {
+	session, release, err := NewSSHSession(m)
 	if err != nil {
 		return nil, err
 	}
 
-	defer session.Close()
-
-	session.Stderr = os.Stderr
-	out, err := session.Output(cmd)
-	out = bytes.TrimSpace(out)
-	return out, err
+	return execSession(ctx, session, release, cmd, opts)
 }
 
 func (bc *BaseCluster) Machines() []Machine {
@@ -134,12 +158,50 @@ func (bc *BaseCluster) DelMach(m Machine) {
 	defer bc.machlock.Unlock()
 	delete(bc.machmap, m.ID())
 	bc.consolemap[m.ID()] = m.ConsoleOutput()
+	CloseSSHClient(m)
+	if err := bc.agent.HostKeys.Forget(m.IP()); err != nil {
+		plog.Warningf("forgetting host key of %s: %v", m.ID(), err)
+	}
+}
+
+// HostKeys returns the store pinning the SSH host keys of the cluster's
+// machines. Connecting to a machine whose host key changed, e.g. after
+// a reboot, fails with a *network.HostKeyChangedError.
+func (bc *BaseCluster) HostKeys() *network.HostKeyStore {
+	return bc.agent.HostKeys
+}
+
+// ExpectConsoleHostKeys waits for the console of the machine at ip, as
+// returned by getConsole, to show the machine's host key fingerprints
+// and has the first connection to it verify them.
+func (bc *BaseCluster) ExpectConsoleHostKeys(ip string, getConsole func() (string, error)) error {
+	return util.Retry(sshRetries, sshTimeout, func() error {
+		console, err := getConsole()
+		if err != nil {
+			return err
+		}
+		fingerprints := network.ParseConsoleFingerprints(console)
+		if len(fingerprints) == 0 {
+			return fmt.Errorf("no host key fingerprints on the console of %s", ip)
+		}
+		bc.agent.HostKeys.Expect(ip, fingerprints)
+		return nil
+	})
 }
 
 func (bc *BaseCluster) Keys() ([]*agent.Key, error) {
 	return bc.agent.List()
 }
 
+// AddKey adds a private key to the cluster's SSH agent, so that it is
+// offered when connecting to machines and copied into rendered userdata.
+func (bc *BaseCluster) AddKey(key interface{}, comment string) error {
+	return bc.agent.Add(agent.AddedKey{
+		PrivateKey: key,
+		Comment:    comment,
+	})
+}
+
 func (bc *BaseCluster) RenderUserData(userdata *conf.UserData, ignitionVars map[string]string) (*conf.Conf, error) {
 	if userdata == nil {
 		userdata = conf.Ignition(`{"ignition": {"version": "2.0.0"}}`)
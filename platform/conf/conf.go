@@ -121,6 +121,11 @@ func (u *UserData) Subst(old, new string) *UserData {
 	return &ret
 }
 
+// Contains reports whether substr appears in the unrendered userdata.
+func (u *UserData) Contains(substr string) bool {
+	return strings.Contains(u.data, substr)
+}
+
 func (u *UserData) IsIgnition() bool {
 	return u.kind == kindIgnition
 }
@@ -249,6 +254,36 @@ func (c *Conf) CopyKeys(keys []*agent.Key) {
 	}
 }
 
+// AddSystemdUnitDropin adds a drop-in named dropin with the given
+// contents to the systemd unit service.
+func (c *Conf) AddSystemdUnitDropin(service, dropin, contents string) {
+	if c.ignitionV1 != nil {
+		c.ignitionV1.Systemd.Units = append(c.ignitionV1.Systemd.Units, v1types.SystemdUnit{
+			Name: v1types.SystemdUnitName(service),
+			DropIns: []v1types.SystemdUnitDropIn{{
+				Name:     v1types.SystemdUnitDropInName(dropin),
+				Contents: contents,
+			}},
+		})
+	} else if c.ignitionV2 != nil {
+		c.ignitionV2.Systemd.Units = append(c.ignitionV2.Systemd.Units, v2types.SystemdUnit{
+			Name: v2types.SystemdUnitName(service),
+			DropIns: []v2types.SystemdUnitDropIn{{
+				Name:     v2types.SystemdUnitDropInName(dropin),
+				Contents: contents,
+			}},
+		})
+	} else if c.cloudconfig != nil {
+		c.cloudconfig.CoreOS.Units = append(c.cloudconfig.CoreOS.Units, cci.Unit{
+			Name: service,
+			DropIns: []cci.UnitDropIn{{
+				Name:    dropin,
+				Content: contents,
+			}},
+		})
+	}
+}
+
 func keysToStrings(keys []*agent.Key) (keyStrs []string) {
 	for _, key := range keys {
 		keyStrs = append(keyStrs, key.String())
@@ -0,0 +1,216 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/coreos/mantle/util"
+)
+
+// ExecOptions contains optional settings for running a command with
+// Machine.Exec or StartExec.
+type ExecOptions struct {
+	// Stdin is fed to the command's standard input.
+	Stdin io.Reader
+
+	// Env sets environment variables for the command. sshd on the
+	// machine doesn't need to accept them; they are exported by the
+	// remote shell before the command runs.
+	Env map[string]string
+
+	// Stdout and Stderr, if set, receive the command's output as it
+	// is produced instead of it being collected in the ExecResult.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// ExecResult is the outcome of a command that ran to completion.
+type ExecResult struct {
+	// Stdout and Stderr hold the command's output, untrimmed, unless
+	// ExecOptions redirected it.
+	Stdout []byte
+	Stderr []byte
+
+	// ExitStatus is the command's exit status. A nonzero status is
+	// not an error.
+	ExitStatus int
+}
+
+// ExecSession is a command started with StartExec.
+type ExecSession struct {
+	// Stdout and Stderr stream the command's output unless
+	// ExecOptions redirected it. Both must be drained concurrently or
+	// the command may block.
+	Stdout io.Reader
+	Stderr io.Reader
+
+	session *ssh.Session
+	release func()
+	ctx     context.Context
+	stop    func()
+}
+
+// StartExec starts a command over SSH on m. The command is killed if
+// ctx is done before it finishes. The caller must call Wait.
+func StartExec(ctx context.Context, m Machine, cmd string, opts *ExecOptions) (*ExecSession, error) {
+	session, release, err := NewSSHSession(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating SSH session: %v", err)
+	}
+	return startExec(ctx, session, release, cmd, opts, true)
+}
+
+// Wait waits for the command to exit and returns its exit status.
+func (s *ExecSession) Wait() (int, error) {
+	defer s.release()
+	err := s.session.Wait()
+	s.stop()
+
+	if ctxErr := s.ctx.Err(); err != nil && ctxErr != nil {
+		return -1, ctxErr
+	}
+
+	switch err := err.(type) {
+	case nil:
+		return 0, nil
+	case *ssh.ExitError:
+		if err.Signal() != "" {
+			return -1, fmt.Errorf("killed by signal %s: %s", err.Signal(), err.Msg())
+		}
+		return err.ExitStatus(), nil
+	default:
+		return -1, err
+	}
+}
+
+// execSession runs a command in session, collecting its output.
+// release is called once the command exits.
+func execSession(ctx context.Context, session *ssh.Session, release func(), cmd string, opts *ExecOptions) (*ExecResult, error) {
+	if opts == nil {
+		opts = &ExecOptions{}
+	}
+
+	var stdout, stderr bytes.Buffer
+	o := *opts
+	if o.Stdout == nil {
+		o.Stdout = &stdout
+	}
+	if o.Stderr == nil {
+		o.Stderr = &stderr
+	}
+
+	s, err := startExec(ctx, session, release, cmd, &o, false)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := s.Wait()
+	res := &ExecResult{
+		ExitStatus: status,
+	}
+	if opts.Stdout == nil {
+		res.Stdout = stdout.Bytes()
+	}
+	if opts.Stderr == nil {
+		res.Stderr = stderr.Bytes()
+	}
+	return res, err
+}
+
+func startExec(ctx context.Context, session *ssh.Session, release func(), cmd string, opts *ExecOptions, pipes bool) (*ExecSession, error) {
+	if opts == nil {
+		opts = &ExecOptions{}
+	}
+
+	s := &ExecSession{
+		session: session,
+		release: release,
+		ctx:     ctx,
+	}
+
+	var err error
+	session.Stdin = opts.Stdin
+	session.Stdout = opts.Stdout
+	session.Stderr = opts.Stderr
+	if pipes && opts.Stdout == nil {
+		if s.Stdout, err = session.StdoutPipe(); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	if pipes && opts.Stderr == nil {
+		if s.Stderr, err = session.StderrPipe(); err != nil {
+			release()
+			return nil, err
+		}
+	}
+
+	cmd, err = withEnv(cmd, opts.Env)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if err := session.Start(cmd); err != nil {
+		release()
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	s.stop = func() { close(done) }
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Signal(ssh.SIGKILL)
+			session.Close()
+		case <-done:
+		}
+	}()
+
+	return s, nil
+}
+
+// envName matches the environment variable names the shell can export.
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// withEnv prefixes cmd with shell exports of env.
+func withEnv(cmd string, env map[string]string) (string, error) {
+	if len(env) == 0 {
+		return cmd, nil
+	}
+
+	var names []string
+	for name := range env {
+		if !envName.MatchString(name) {
+			return "", fmt.Errorf("invalid environment variable name %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var exports []string
+	for _, name := range names {
+		exports = append(exports, fmt.Sprintf("export %s=%s;", name, util.ShellQuote(env[name])))
+	}
+	return strings.Join(exports, " ") + " " + cmd, nil
+}
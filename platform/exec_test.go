@@ -0,0 +1,159 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/coreos/mantle/network/mockssh"
+)
+
+func newSession(t *testing.T, client *ssh.Client) (*ssh.Session, func()) {
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session, func() { session.Close() }
+}
+
+func TestExecOutput(t *testing.T) {
+	client := mockssh.NewMockClient(func(s *mockssh.Session) {
+		in, _ := ioutil.ReadAll(s.Stdin)
+		fmt.Fprintf(s.Stdout, "out: %s\n", in)
+		fmt.Fprintf(s.Stderr, "err: %s\n", s.Exec)
+		s.Exit(3)
+	})
+	defer client.Close()
+
+	session, release := newSession(t, client)
+	res, err := execSession(context.Background(), session, release, "cmd", &ExecOptions{
+		Stdin: bytes.NewBufferString("input"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Stdout) != "out: input\n" {
+		t.Errorf("got stdout %q", res.Stdout)
+	}
+	if string(res.Stderr) != "err: cmd\n" {
+		t.Errorf("got stderr %q", res.Stderr)
+	}
+	if res.ExitStatus != 3 {
+		t.Errorf("got exit status %d, wanted 3", res.ExitStatus)
+	}
+}
+
+func TestExecEnv(t *testing.T) {
+	const expect = `export A='1'; export B='it'\''s'; cmd`
+	client := mockssh.NewMockClient(func(s *mockssh.Session) {
+		if s.Exec != expect {
+			t.Errorf("got %q wanted %q", s.Exec, expect)
+		}
+		s.Exit(0)
+	})
+	defer client.Close()
+
+	session, release := newSession(t, client)
+	_, err := execSession(context.Background(), session, release, "cmd", &ExecOptions{
+		Env: map[string]string{"B": "it's", "A": "1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExecEnvInvalidName(t *testing.T) {
+	client := mockssh.NewMockClient(func(s *mockssh.Session) {
+		t.Errorf("command %q should not have run", s.Exec)
+		s.Exit(0)
+	})
+	defer client.Close()
+
+	for _, name := range []string{"", "1A", "A B", "A;rm", "A=B"} {
+		session, release := newSession(t, client)
+		_, err := execSession(context.Background(), session, release, "cmd", &ExecOptions{
+			Env: map[string]string{name: "x"},
+		})
+		if err == nil {
+			t.Errorf("expected an error for name %q", name)
+		}
+	}
+}
+
+func TestExecMissingStatus(t *testing.T) {
+	client := mockssh.NewMockClient(func(s *mockssh.Session) {
+		s.Close()
+	})
+	defer client.Close()
+
+	session, release := newSession(t, client)
+	if _, err := execSession(context.Background(), session, release, "cmd", nil); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestExecTimeout(t *testing.T) {
+	client := mockssh.NewMockClient(func(s *mockssh.Session) {
+		io.Copy(ioutil.Discard, s.Stdin)
+		s.Exit(0)
+	})
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// stdin is never closed so the command runs until killed
+	r, w := io.Pipe()
+	defer w.Close()
+
+	session, release := newSession(t, client)
+	_, err := execSession(ctx, session, release, "cmd", &ExecOptions{Stdin: r})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got error %v, wanted %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestStartExecStreams(t *testing.T) {
+	client := mockssh.NewMockClient(func(s *mockssh.Session) {
+		fmt.Fprint(s.Stdout, "streamed")
+		s.Exit(0)
+	})
+	defer client.Close()
+
+	session, release := newSession(t, client)
+	s, err := startExec(context.Background(), session, release, "cmd", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(ioutil.Discard, s.Stderr)
+	out, err := ioutil.ReadAll(s.Stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := s.Wait(); status != 0 || err != nil {
+		t.Fatalf("got status %d, error %v", status, err)
+	}
+	if string(out) != "streamed" {
+		t.Errorf("got %q", out)
+	}
+}
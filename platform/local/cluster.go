@@ -17,12 +17,14 @@ package local
 import (
 	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 
 	"github.com/coreos/go-omaha/omaha"
+	"github.com/coreos/pkg/capnslog"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
 
@@ -30,21 +32,48 @@ import (
 	"github.com/coreos/mantle/network"
 	"github.com/coreos/mantle/network/ntp"
 	"github.com/coreos/mantle/platform"
+	"github.com/coreos/mantle/platform/conf"
 	"github.com/coreos/mantle/system/exec"
 	"github.com/coreos/mantle/system/ns"
 )
 
+var plog = capnslog.NewPackageLogger("github.com/coreos/mantle", "platform/local")
+
+// Options contains optional settings for a LocalCluster.
+type Options struct {
+	// TFTPRoot is served over TFTP to PXE clients so they can
+	// chainload iPXE. See DnsmasqOptions.
+	TFTPRoot string
+
+	// IPMode selects the address families of the cluster network.
+	// See DnsmasqOptions.
+	IPMode string
+
+	// RegistryArchives are `docker save` tarballs of images to serve
+	// from a registry in the cluster. If any are given, Docker on
+	// the machines uses the registry as a mirror of Docker Hub and
+	// may pull from it over plain HTTP.
+	RegistryArchives []string
+
+	// EtcdMembers is the number of members of the cluster's etcd,
+	// which serves discovery URLs and is available to tests through
+	// EtcdEndpoints and EtcdV3Endpoints. Defaults to 1.
+	EtcdMembers int
+}
+
 type LocalCluster struct {
 	destructor.MultiDestructor
 	*platform.BaseCluster
 	Dnsmasq     *Dnsmasq
+	HTTPServer  *HTTPServer
+	Registry    *Registry
 	NTPServer   *ntp.Server
 	OmahaServer *omaha.TrivialServer
 	SimpleEtcd  *SimpleEtcd
 	nshandle    netns.NsHandle
 }
 
-func NewLocalCluster(basename string, rconf *platform.RuntimeConfig) (*LocalCluster, error) {
+func NewLocalCluster(basename string, opts *Options, rconf *platform.RuntimeConfig) (*LocalCluster, error) {
 	lc := &LocalCluster{}
 
 	var err error
@@ -62,6 +91,19 @@ func NewLocalCluster(basename string, rconf *platform.RuntimeConfig) (*LocalClus
 	}
 	lc.AddDestructor(lc.BaseCluster)
 
+	members := opts.EtcdMembers
+	if members < 1 {
+		members = 1
+	}
+	etcdPeers, err := ListenEtcdPeers(members)
+	if err != nil {
+		lc.Destroy()
+		return nil, err
+	}
+	for _, l := range etcdPeers {
+		lc.AddCloser(l)
+	}
+
 	// dnsmasq and etcd much be launched in the new namespace
 	nsExit, err := ns.Enter(lc.nshandle)
 	if err != nil {
@@ -70,14 +112,42 @@ func NewLocalCluster(basename string, rconf *platform.RuntimeConfig) (*LocalClus
 	}
 	defer nsExit()
 
-	lc.Dnsmasq, err = NewDnsmasq()
+	lc.HTTPServer, err = NewHTTPServer(":80")
+	if err != nil {
+		lc.Destroy()
+		return nil, err
+	}
+	lc.AddDestructor(lc.HTTPServer)
+	lc.HTTPServer.AddFile("/boot.ipxe", []byte(ipxeChainScript))
+
+	if len(opts.RegistryArchives) > 0 {
+		lc.Registry, err = NewRegistry(":5000")
+		if err != nil {
+			lc.Destroy()
+			return nil, err
+		}
+		lc.AddDestructor(lc.Registry)
+
+		for _, archive := range opts.RegistryArchives {
+			if err := lc.Registry.LoadArchive(archive); err != nil {
+				lc.Destroy()
+				return nil, err
+			}
+		}
+	}
+
+	lc.Dnsmasq, err = NewDnsmasq(DnsmasqOptions{
+		TFTPRoot: opts.TFTPRoot,
+		IPXEPort: lc.HTTPServer.Port,
+		IPMode:   opts.IPMode,
+	})
 	if err != nil {
 		lc.Destroy()
 		return nil, err
 	}
 	lc.AddDestructor(lc.Dnsmasq)
 
-	lc.SimpleEtcd, err = NewSimpleEtcd()
+	lc.SimpleEtcd, err = NewSimpleEtcd(etcdPeers)
 	if err != nil {
 		lc.Destroy()
 		return nil, err
@@ -108,17 +178,56 @@ func (lc *LocalCluster) NewCommand(name string, arg ...string) exec.Cmd {
 	return cmd
 }
 
-func (lc *LocalCluster) etcdEndpoint() string {
-	// hackydoo
-	bridge := "br0"
+// BridgeIP returns the host's primary address on the given bridge, see
+// Interface.IP.
+func (lc *LocalCluster) BridgeIP(bridge string) net.IP {
 	for _, seg := range lc.Dnsmasq.Segments {
 		if bridge == seg.BridgeName {
-			return fmt.Sprintf("http://%s:%d", seg.BridgeIf.DHCPv4[0].IP, lc.SimpleEtcd.Port)
+			return seg.BridgeIf.IP()
 		}
 	}
 	panic("Not a valid bridge!")
 }
 
+func (lc *LocalCluster) etcdEndpoint() string {
+	// hackydoo
+	return "http://" + net.JoinHostPort(lc.BridgeIP("br0").String(), strconv.Itoa(lc.SimpleEtcd.Port))
+}
+
+// EtcdEndpoints returns the URLs machines on br0 use to reach the v2 API
+// of each member of SimpleEtcd.
+func (lc *LocalCluster) EtcdEndpoints() []string {
+	var endpoints []string
+	for _, m := range lc.SimpleEtcd.Members {
+		endpoints = append(endpoints, "http://"+net.JoinHostPort(lc.BridgeIP("br0").String(), strconv.Itoa(m.Port)))
+	}
+	return endpoints
+}
+
+// EtcdV3Endpoints returns the URLs machines on br0 use to reach the v3
+// gRPC API of each member of SimpleEtcd.
+func (lc *LocalCluster) EtcdV3Endpoints() []string {
+	var endpoints []string
+	for _, m := range lc.SimpleEtcd.Members {
+		endpoints = append(endpoints, "http://"+net.JoinHostPort(lc.BridgeIP("br0").String(), strconv.Itoa(m.GRPCPort)))
+	}
+	return endpoints
+}
+
+// HTTPURL returns the URL machines on br0 use to fetch urlPath from
+// HTTPServer.
+func (lc *LocalCluster) HTTPURL(urlPath string) string {
+	host := net.JoinHostPort(lc.BridgeIP("br0").String(), strconv.Itoa(lc.HTTPServer.Port))
+	return fmt.Sprintf("http://%s/%s", host, strings.TrimPrefix(urlPath, "/"))
+}
+
+// OmahaURL returns the update URL machines on br0 use to reach
+// OmahaServer.
+func (lc *LocalCluster) OmahaURL() string {
+	host := net.JoinHostPort(lc.BridgeIP("br0").String(), strconv.Itoa(lc.OmahaServer.Addr().(*net.TCPAddr).Port))
+	return fmt.Sprintf("http://%s/v1/update/", host)
+}
+
 func (lc *LocalCluster) GetDiscoveryURL(size int) (string, error) {
 	baseURL := fmt.Sprintf("%v/v2/keys/discovery/%v", lc.etcdEndpoint(), rand.Int())
 
@@ -174,6 +283,121 @@ func (lc *LocalCluster) NewTap(bridge string) (*TunTap, error) {
 	return tap, nil
 }
 
+// NewVeth creates a veth pair in the cluster's network namespace with one
+// end attached to bridge, and returns the name of the other end, which
+// has address hwaddr and can be moved into a container.
+func (lc *LocalCluster) NewVeth(bridge string, hwaddr net.HardwareAddr) (string, error) {
+	nsExit, err := ns.Enter(lc.nshandle)
+	if err != nil {
+		return "", err
+	}
+	defer nsExit()
+
+	// addresses are unique in the cluster, and so are names from them
+	suffix := fmt.Sprintf("%x", []byte(hwaddr[len(hwaddr)-3:]))
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: "vb" + suffix},
+		PeerName:  "vc" + suffix,
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return "", fmt.Errorf("veth failed: %v", err)
+	}
+
+	peer, err := netlink.LinkByName(veth.PeerName)
+	if err != nil {
+		netlink.LinkDel(veth)
+		return "", fmt.Errorf("veth peer failed: %v", err)
+	}
+
+	if err := netlink.LinkSetHardwareAddr(peer, hwaddr); err != nil {
+		netlink.LinkDel(veth)
+		return "", fmt.Errorf("veth address failed: %v", err)
+	}
+
+	br, err := netlink.LinkByName(bridge)
+	if err != nil {
+		netlink.LinkDel(veth)
+		return "", fmt.Errorf("bridge failed: %v", err)
+	}
+
+	if err := netlink.LinkSetMaster(veth, br.(*netlink.Bridge)); err != nil {
+		netlink.LinkDel(veth)
+		return "", fmt.Errorf("set master failed: %v", err)
+	}
+
+	if err := netlink.LinkSetUp(veth); err != nil {
+		netlink.LinkDel(veth)
+		return "", fmt.Errorf("veth up failed: %v", err)
+	}
+
+	return veth.PeerName, nil
+}
+
+// RemoveVeth deletes a veth pair created by NewVeth, given the name
+// NewVeth returned, if it is still in the cluster's network namespace.
+func (lc *LocalCluster) RemoveVeth(name string) error {
+	nsExit, err := ns.Enter(lc.nshandle)
+	if err != nil {
+		return err
+	}
+	defer nsExit()
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("veth lookup failed: %v", err)
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("veth delete failed: %v", err)
+	}
+	return nil
+}
+
+// RegistryHost returns the host and port machines on br0 use to reach
+// Registry, for use in image references.
+func (lc *LocalCluster) RegistryHost() string {
+	return net.JoinHostPort(lc.BridgeIP("br0").String(), strconv.Itoa(lc.Registry.Port))
+}
+
+// RenderUserData renders userdata like BaseCluster.RenderUserData, and
+// configures Docker to use Registry if the cluster has one. systemd can't
+// append to a variable, so configs that set DOCKER_OPTS themselves are
+// left alone and need to include the registry options.
+func (lc *LocalCluster) RenderUserData(userdata *conf.UserData, ignitionVars map[string]string) (*conf.Conf, error) {
+	conf, err := lc.BaseCluster.RenderUserData(userdata, ignitionVars)
+	if err != nil {
+		return nil, err
+	}
+
+	if lc.Registry != nil && userdata != nil && userdata.Contains("DOCKER_OPTS") {
+		plog.Warningf("not configuring Docker to use the cluster registry: userdata sets DOCKER_OPTS")
+	} else if lc.Registry != nil {
+		host := lc.RegistryHost()
+		conf.AddSystemdUnitDropin("docker.service", "10-kola-registry.conf", fmt.Sprintf(`[Service]
+Environment="DOCKER_OPTS=--registry-mirror=http://%s --insecure-registry=%s"
+`, host, host))
+	}
+
+	return conf, nil
+}
+
+// ForwardPort proxies connections to localAddr on the host to
+// remoteAddr inside the cluster's network namespace until the cluster is
+// destroyed. localAddr may use port 0 to pick a free port.
+func (lc *LocalCluster) ForwardPort(localAddr, remoteAddr string) (*network.PortForwarder, error) {
+	f, err := network.NewPortForwarder(localAddr, remoteAddr, network.NewNsDialer(lc.nshandle))
+	if err != nil {
+		return nil, err
+	}
+	lc.AddDestructor(f)
+	return f, nil
+}
+
+// GetNTPServer returns the NTP server the cluster's machines use, so that
+// tests can control the time they see.
+func (lc *LocalCluster) GetNTPServer() *ntp.Server {
+	return lc.NTPServer
+}
+
 func (lc *LocalCluster) GetNsHandle() netns.NsHandle {
 	return lc.nshandle
 }
@@ -16,7 +16,13 @@ package local
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"text/template"
 
 	"github.com/coreos/pkg/capnslog"
@@ -26,6 +32,20 @@ import (
 	"github.com/coreos/mantle/util"
 )
 
+const (
+	// IPModeDual assigns IPv4 and IPv6 addresses, preferring IPv4.
+	IPModeDual = "dual"
+
+	// IPModeIPv4 assigns only IPv4 addresses.
+	IPModeIPv4 = "ipv4"
+
+	// IPModeIPv6 assigns only IPv6 addresses.
+	IPModeIPv6 = "ipv6"
+)
+
+// IPModes lists the supported values of DnsmasqOptions.IPMode.
+var IPModes = []string{IPModeDual, IPModeIPv4, IPModeIPv6}
+
 type Interface struct {
 	HardwareAddr net.HardwareAddr
 	DHCPv4       []net.IPNet
@@ -33,6 +53,15 @@ type Interface struct {
 	//SLAAC net.IPAddr
 }
 
+// IP returns the interface's primary address: its first IPv4 address
+// if it has one, otherwise its first IPv6 address.
+func (i *Interface) IP() net.IP {
+	if len(i.DHCPv4) > 0 {
+		return i.DHCPv4[0].IP
+	}
+	return i.DHCPv6[0].IP
+}
+
 type Segment struct {
 	BridgeName string
 	BridgeIf   *Interface
@@ -40,9 +69,49 @@ type Segment struct {
 	nextIf     int
 }
 
+// DnsmasqOptions configures the network boot services of dnsmasq.
+type DnsmasqOptions struct {
+	// TFTPRoot enables the TFTP server, serving files from the given
+	// directory. PXE clients without iPXE built in are handed
+	// undionly.kpxe (BIOS), ipxe.efi (x86_64 UEFI) or ipxe-arm64.efi
+	// (arm64 UEFI) to chainload from it.
+	TFTPRoot string
+
+	// IPXEPort is the port of the HTTP server on each bridge address
+	// from which iPXE clients fetch boot.ipxe. iPXE boot is disabled
+	// if zero.
+	IPXEPort int
+
+	// IPMode selects which address families are assigned to the
+	// bridges and machines: IPModeDual (the default), IPModeIPv4 or
+	// IPModeIPv6.
+	IPMode string
+}
+
+// SRVRecord is a DNS SRV record served by dnsmasq.
+type SRVRecord struct {
+	Name     string // e.g. _etcd-server._tcp.br0.local
+	Target   string
+	Port     int
+	Priority int
+	Weight   int
+}
+
 type Dnsmasq struct {
 	Segments []*Segment
-	dnsmasq  *exec.ExecCmd
+	Options  DnsmasqOptions
+
+	// HostsFile holds the A and AAAA records added with AddHost.
+	HostsFile string
+
+	// ServersFile forwards queries for the names of records added
+	// with AddSRVRecord to the SRV server.
+	ServersFile string
+
+	mu      sync.Mutex
+	hosts   map[string][]net.IP
+	srv     *srvServer
+	dnsmasq *exec.ExecCmd
 }
 
 var configTemplate = template.Must(template.New("dnsmasq").Parse(`
@@ -56,29 +125,50 @@ quiet-ra
 
 no-resolv
 no-hosts
+addn-hosts={{.HostsFile}}
+servers-file={{.ServersFile}}
 enable-ra
 
 # point NTP at this host (0.0.0.0 and :: are special)
 dhcp-option=option:ntp-server,0.0.0.0
 dhcp-option=option6:ntp-server,[::]
 
-{{range .Segments}}
+{{if .Options.IPXEPort}}
+dhcp-match=set:ipxe,175
+{{end}}
+
+{{if .Options.TFTPRoot}}
+enable-tftp
+tftp-root={{.Options.TFTPRoot}}
+dhcp-match=set:efi-x86_64,option:client-arch,7
+dhcp-match=set:efi-x86_64,option:client-arch,9
+dhcp-match=set:efi-arm64,option:client-arch,11
+dhcp-boot=tag:!ipxe,tag:efi-x86_64,ipxe.efi
+dhcp-boot=tag:!ipxe,tag:efi-arm64,ipxe-arm64.efi
+dhcp-boot=tag:!ipxe,tag:!efi-x86_64,tag:!efi-arm64,undionly.kpxe
+{{end}}
+
+{{range $seg := .Segments}}
 domain={{.BridgeName}}.local
 
 {{range .BridgeIf.DHCPv4}}
-dhcp-range={{.IP}},static
+dhcp-range=set:{{$seg.BridgeName}},{{.IP}},static
+{{if $.Options.IPXEPort}}
+dhcp-boot=tag:ipxe,tag:{{$seg.BridgeName}},http://{{.IP}}:{{$.Options.IPXEPort}}/boot.ipxe
+{{end}}
 {{end}}
 
 {{range .BridgeIf.DHCPv6}}
-dhcp-range={{.IP}},ra-names,slaac
+dhcp-range={{.IP}},static,ra-names,slaac,64
 {{end}}
 
 {{range .Interfaces}}
-dhcp-host={{.HardwareAddr}}{{template "ips" .DHCPv4}}{{template "ips" .DHCPv6}}
+dhcp-host={{.HardwareAddr}}{{template "ips" .DHCPv4}}{{template "ips6" .DHCPv6}}
 {{end}}
 {{end}}
 
 {{define "ips"}}{{range .}}{{printf ",%s" .IP}}{{end}}{{end}}
+{{define "ips6"}}{{range .}}{{printf ",[%s]" .IP}}{{end}}{{end}}
 `))
 
 const (
@@ -86,26 +176,31 @@ const (
 	numSegments   = 3
 )
 
-func newInterface(s, i byte) *Interface {
-	return &Interface{
+func newInterface(s, i byte, mode string) *Interface {
+	iface := &Interface{
 		HardwareAddr: net.HardwareAddr{0x02, s, 0, 0, 0, i},
-		DHCPv4: []net.IPNet{{
+	}
+	if mode != IPModeIPv6 {
+		iface.DHCPv4 = []net.IPNet{{
 			IP:   net.IP{10, s, 0, i},
-			Mask: net.CIDRMask(24, 32)}},
-		DHCPv6: []net.IPNet{{
+			Mask: net.CIDRMask(24, 32)}}
+	}
+	if mode != IPModeIPv4 {
+		iface.DHCPv6 = []net.IPNet{{
 			IP:   net.IP{0xfd, s, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, i},
-			Mask: net.CIDRMask(64, 128)}},
+			Mask: net.CIDRMask(64, 128)}}
 	}
+	return iface
 }
 
-func newSegment(s byte) (*Segment, error) {
+func newSegment(s byte, mode string) (*Segment, error) {
 	seg := &Segment{
 		BridgeName: fmt.Sprintf("br%d", s),
-		BridgeIf:   newInterface(s, 1),
+		BridgeIf:   newInterface(s, 1, mode),
 	}
 
 	for i := byte(2); i < 2+numInterfaces; i++ {
-		seg.Interfaces = append(seg.Interfaces, newInterface(s, i))
+		seg.Interfaces = append(seg.Interfaces, newInterface(s, i, mode))
 	}
 
 	br := netlink.Bridge{
@@ -140,10 +235,19 @@ func newSegment(s byte) (*Segment, error) {
 	return seg, nil
 }
 
-func NewDnsmasq() (*Dnsmasq, error) {
-	dm := &Dnsmasq{}
+func NewDnsmasq(opts DnsmasqOptions) (*Dnsmasq, error) {
+	dm := &Dnsmasq{
+		Options: opts,
+		hosts:   make(map[string][]net.IP),
+	}
+	switch opts.IPMode {
+	case "", IPModeDual, IPModeIPv4, IPModeIPv6:
+	default:
+		return nil, fmt.Errorf("unsupported IP mode %q", opts.IPMode)
+	}
+
 	for s := byte(0); s < numSegments; s++ {
-		seg, err := newSegment(s)
+		seg, err := newSegment(s, opts.IPMode)
 		if err != nil {
 			return nil, fmt.Errorf("Network setup failed: %v", err)
 		}
@@ -160,31 +264,120 @@ func NewDnsmasq() (*Dnsmasq, error) {
 		return nil, fmt.Errorf("Network loopback setup failed: %v", err)
 	}
 
+	hosts, err := ioutil.TempFile("", "mantle-dnsmasq-hosts-")
+	if err != nil {
+		return nil, err
+	}
+	hosts.Close()
+	dm.HostsFile = hosts.Name()
+
+	servers, err := ioutil.TempFile("", "mantle-dnsmasq-servers-")
+	if err != nil {
+		os.Remove(dm.HostsFile)
+		return nil, err
+	}
+	servers.Close()
+	dm.ServersFile = servers.Name()
+
+	if dm.srv, err = newSRVServer(); err != nil {
+		os.Remove(dm.HostsFile)
+		os.Remove(dm.ServersFile)
+		return nil, err
+	}
+
+	if err := dm.start(); err != nil {
+		dm.srv.Close()
+		os.Remove(dm.HostsFile)
+		os.Remove(dm.ServersFile)
+		return nil, err
+	}
+
+	return dm, nil
+}
+
+// start runs dnsmasq in the current network namespace.
+func (dm *Dnsmasq) start() error {
 	dm.dnsmasq = exec.Command("dnsmasq", "--conf-file=-")
 	cfg, err := dm.dnsmasq.StdinPipe()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	out, err := dm.dnsmasq.StdoutPipe()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	dm.dnsmasq.Stderr = dm.dnsmasq.Stdout
 	go util.LogFrom(capnslog.INFO, out)
 
 	if err = dm.dnsmasq.Start(); err != nil {
 		cfg.Close()
-		return nil, err
+		return err
 	}
 
 	if err = configTemplate.Execute(cfg, dm); err != nil {
 		cfg.Close()
-		dm.Destroy()
-		return nil, err
+		dm.dnsmasq.Kill()
+		return err
 	}
 	cfg.Close()
 
-	return dm, nil
+	return nil
+}
+
+// AddHost serves A and AAAA records resolving name to ips, in addition
+// to any already added for name.
+func (dm *Dnsmasq) AddHost(name string, ips ...net.IP) error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.hosts[name] = append(dm.hosts[name], ips...)
+	return dm.reloadHosts()
+}
+
+// RemoveHost stops serving records for name.
+func (dm *Dnsmasq) RemoveHost(name string) error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	delete(dm.hosts, name)
+	return dm.reloadHosts()
+}
+
+// reloadHosts rewrites HostsFile and has dnsmasq reread it.
+func (dm *Dnsmasq) reloadHosts() error {
+	var names []string
+	for name := range dm.hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf []string
+	for _, name := range names {
+		for _, ip := range dm.hosts[name] {
+			buf = append(buf, fmt.Sprintf("%s %s\n", ip, name))
+		}
+	}
+
+	if err := ioutil.WriteFile(dm.HostsFile, []byte(strings.Join(buf, "")), 0644); err != nil {
+		return err
+	}
+	return dm.dnsmasq.Process.Signal(syscall.SIGHUP)
+}
+
+// AddSRVRecord serves rec, in addition to any records already added
+// for its name.
+func (dm *Dnsmasq) AddSRVRecord(rec SRVRecord) error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.srv.add(rec)
+
+	var buf []string
+	for _, name := range dm.srv.names() {
+		buf = append(buf, fmt.Sprintf("server=/%s/127.0.0.1#%d\n", name, dm.srv.Port()))
+	}
+	if err := ioutil.WriteFile(dm.ServersFile, []byte(strings.Join(buf, "")), 0644); err != nil {
+		return err
+	}
+	// this also drops cached answers for the name
+	return dm.dnsmasq.Process.Signal(syscall.SIGHUP)
 }
 
 func (dm *Dnsmasq) GetInterface(bridge string) (in *Interface) {
@@ -202,5 +395,15 @@ func (dm *Dnsmasq) GetInterface(bridge string) (in *Interface) {
 }
 
 func (dm *Dnsmasq) Destroy() error {
-	return dm.dnsmasq.Kill()
+	err := dm.dnsmasq.Kill()
+	if err2 := dm.srv.Close(); err == nil {
+		err = err2
+	}
+	if err2 := os.Remove(dm.HostsFile); err == nil {
+		err = err2
+	}
+	if err2 := os.Remove(dm.ServersFile); err == nil {
+		err = err2
+	}
+	return err
 }
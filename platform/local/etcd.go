@@ -25,79 +25,173 @@ import (
 	"github.com/coreos/etcd/etcdserver"
 	"github.com/coreos/etcd/etcdserver/api/v2http"
 	"github.com/coreos/etcd/pkg/types"
+	"google.golang.org/grpc"
 )
 
 const (
-	memberName  = "simple"
 	clusterName = "simple-cluster"
 	tempPrefix  = "simple-etcd-"
-
-	// No peer URL exists but etcd doesn't allow the value to be empty.
-	peerURL    = "http://localhost:0"
-	clusterCfg = memberName + "=" + peerURL
 )
 
-// SimpleEtcd provides a single node etcd server.
+// SimpleEtcd provides an etcd cluster with one or more members, each
+// serving the v2 API over HTTP and the v3 API over gRPC.
 type SimpleEtcd struct {
+	// Port is the v2 client port of the first member.
+	Port int
+
+	Members []*EtcdMember
+}
+
+// EtcdMember is a single member of a SimpleEtcd cluster.
+type EtcdMember struct {
+	Name string
+
+	// Port serves the v2 API and GRPCPort the v3 API, on all
+	// addresses of the network namespace the member was created in.
 	Port     int
-	listener net.Listener
-	server   *etcdserver.EtcdServer
-	dataDir  string
+	GRPCPort int
+
+	listener     net.Listener
+	grpcListener net.Listener
+	peerListener net.Listener
+	server       *etcdserver.EtcdServer
+	grpcServer   *grpc.Server
+	dataDir      string
 }
 
-func NewSimpleEtcd() (*SimpleEtcd, error) {
-	var err error
+// ListenEtcdPeers opens loopback listeners for the members of a
+// SimpleEtcd to talk to each other on. etcd dials its peers from
+// goroutines that may run in any network namespace, so these must be
+// opened in the host's namespace rather than a cluster's.
+func ListenEtcdPeers(members int) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for i := 0; i < members; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// NewSimpleEtcd starts an etcd cluster with a member for each of the
+// given peer listeners, see ListenEtcdPeers. The caller remains
+// responsible for closing the listeners.
+func NewSimpleEtcd(peers []net.Listener) (*SimpleEtcd, error) {
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("etcd cluster needs at least one member")
+	}
+
 	se := &SimpleEtcd{}
-	se.listener, err = net.Listen("tcp", ":0")
+	initialCluster := make(types.URLsMap)
+	for i, l := range peers {
+		m := &EtcdMember{
+			Name:         fmt.Sprintf("simple%d", i),
+			peerListener: l,
+		}
+		se.Members = append(se.Members, m)
+
+		peerURLs, err := types.NewURLs([]string{"http://" + l.Addr().String()})
+		if err != nil {
+			se.Destroy()
+			return nil, err
+		}
+		initialCluster[m.Name] = peerURLs
+	}
+
+	// members list each other's gRPC URLs, so all ports must be
+	// known before any member starts
+	grpcPorts := make(map[string]int)
+	for _, m := range se.Members {
+		if err := m.listen(); err != nil {
+			se.Destroy()
+			return nil, err
+		}
+		grpcPorts[m.Name] = m.GRPCPort
+	}
+
+	for _, m := range se.Members {
+		if err := m.start(initialCluster, grpcPorts); err != nil {
+			se.Destroy()
+			return nil, err
+		}
+	}
+	se.Port = se.Members[0].Port
+
+	return se, nil
+}
+
+func (m *EtcdMember) listen() error {
+	var err error
+	m.listener, err = net.Listen("tcp", ":0")
 	if err != nil {
-		return nil, err
+		return err
 	}
+	m.Port = m.listener.Addr().(*net.TCPAddr).Port
 
-	se.Port = se.listener.Addr().(*net.TCPAddr).Port
-	clientURLs, err := interfaceURLs(se.Port)
+	m.grpcListener, err = net.Listen("tcp", ":0")
 	if err != nil {
-		se.Destroy()
-		return nil, err
+		return err
 	}
+	m.GRPCPort = m.grpcListener.Addr().(*net.TCPAddr).Port
 
-	se.dataDir, err = ioutil.TempDir("", tempPrefix)
+	return nil
+}
+
+func (m *EtcdMember) start(initialCluster types.URLsMap, grpcPorts map[string]int) error {
+	clientURLs, err := interfaceURLs(m.Port)
 	if err != nil {
-		se.Destroy()
-		return nil, err
+		return err
 	}
 
-	peerURLs, err := types.NewURLs([]string{peerURL})
+	m.dataDir, err = ioutil.TempDir("", tempPrefix)
 	if err != nil {
-		se.Destroy()
-		return nil, err
+		return err
 	}
 
 	cfg := &etcdserver.ServerConfig{
-		Name:       memberName,
-		ClientURLs: clientURLs,
-		PeerURLs:   peerURLs,
-		DataDir:    se.dataDir,
-		InitialPeerURLsMap: types.URLsMap{
-			memberName: peerURLs,
-		},
-		NewCluster:    true,
-		TickMs:        100,
-		ElectionTicks: 10,
-	}
-
-	se.server, err = etcdserver.NewServer(cfg)
+		Name:                m.Name,
+		ClientURLs:          clientURLs,
+		PeerURLs:            initialCluster[m.Name],
+		DataDir:             m.dataDir,
+		InitialPeerURLsMap:  initialCluster,
+		InitialClusterToken: clusterName,
+		NewCluster:          true,
+		TickMs:              100,
+		ElectionTicks:       10,
+	}
+
+	m.server, err = etcdserver.NewServer(cfg)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	se.server.Start()
-	go http.Serve(se.listener,
-		v2http.NewClientHandler(se.server, cfg.ReqTimeout()))
+	m.server.Start()
+	go http.Serve(m.peerListener, v2http.NewPeerHandler(m.server))
+	go http.Serve(m.listener,
+		v2http.NewClientHandler(m.server, cfg.ReqTimeout()))
 
-	return se, nil
+	m.grpcServer = newV3Server(m.server, grpcPorts)
+	go m.grpcServer.Serve(m.grpcListener)
+
+	return nil
 }
 
 func (se *SimpleEtcd) Destroy() error {
+	var err error
+	for _, m := range se.Members {
+		if e := m.destroy(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (m *EtcdMember) destroy() error {
 	var err error
 	firstErr := func(e error) {
 		if e != nil && err == nil {
@@ -105,16 +199,22 @@ func (se *SimpleEtcd) Destroy() error {
 		}
 	}
 
-	if se.listener != nil {
-		firstErr(se.listener.Close())
+	if m.grpcServer != nil {
+		m.grpcServer.Stop()
+	} else if m.grpcListener != nil {
+		firstErr(m.grpcListener.Close())
+	}
+
+	if m.listener != nil {
+		firstErr(m.listener.Close())
 	}
 
-	if se.server != nil {
-		se.server.Stop()
+	if m.server != nil {
+		m.server.Stop()
 	}
 
-	if se.dataDir != "" {
-		firstErr(os.RemoveAll(se.dataDir))
+	if m.dataDir != "" {
+		firstErr(os.RemoveAll(m.dataDir))
 	}
 
 	return err
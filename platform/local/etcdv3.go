@@ -0,0 +1,513 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/lease"
+	"github.com/coreos/etcd/mvcc"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/coreos/etcd/version"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// v3Server is a minimal frontend for the etcd v3 gRPC API, which etcd
+// only ships as part of its main package. It covers what etcdctl and
+// the etcd clients in Container Linux use: keys, watches, leases,
+// listing members and status. Authentication and cluster maintenance
+// beyond that are not supported.
+type v3Server struct {
+	s *etcdserver.EtcdServer
+
+	// grpcPorts maps member names to the ports serving this API,
+	// which etcdserver doesn't know about.
+	grpcPorts map[string]int
+}
+
+// watchProgressInterval is how often watchers that asked for progress
+// notifications get one if they received no events.
+var watchProgressInterval = 10 * time.Minute
+
+func newV3Server(s *etcdserver.EtcdServer, grpcPorts map[string]int) *grpc.Server {
+	gs := grpc.NewServer()
+	v3 := &v3Server{s, grpcPorts}
+	pb.RegisterKVServer(gs, v3)
+	pb.RegisterWatchServer(gs, v3)
+	pb.RegisterLeaseServer(gs, v3)
+	pb.RegisterClusterServer(gs, v3)
+	pb.RegisterMaintenanceServer(gs, v3)
+	return gs
+}
+
+// header fills in the parts of a response header that etcdserver
+// leaves to the frontend.
+func (v3 *v3Server) header(h *pb.ResponseHeader) *pb.ResponseHeader {
+	if h == nil {
+		h = &pb.ResponseHeader{Revision: v3.s.KV().Rev()}
+	}
+	h.ClusterId = uint64(v3.s.Cluster().ID())
+	h.MemberId = uint64(v3.s.ID())
+	h.RaftTerm = v3.s.Term()
+	return h
+}
+
+func (v3 *v3Server) Range(ctx context.Context, r *pb.RangeRequest) (*pb.RangeResponse, error) {
+	resp, err := v3.s.Range(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header = v3.header(resp.Header)
+	return resp, nil
+}
+
+func (v3 *v3Server) Put(ctx context.Context, r *pb.PutRequest) (*pb.PutResponse, error) {
+	resp, err := v3.s.Put(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header = v3.header(resp.Header)
+	return resp, nil
+}
+
+func (v3 *v3Server) DeleteRange(ctx context.Context, r *pb.DeleteRangeRequest) (*pb.DeleteRangeResponse, error) {
+	resp, err := v3.s.DeleteRange(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header = v3.header(resp.Header)
+	return resp, nil
+}
+
+func (v3 *v3Server) Txn(ctx context.Context, r *pb.TxnRequest) (*pb.TxnResponse, error) {
+	resp, err := v3.s.Txn(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header = v3.header(resp.Header)
+	return resp, nil
+}
+
+func (v3 *v3Server) Compact(ctx context.Context, r *pb.CompactionRequest) (*pb.CompactionResponse, error) {
+	resp, err := v3.s.Compact(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header = v3.header(resp.Header)
+	return resp, nil
+}
+
+// Watch serves one watch stream, which may carry any number of watchers.
+// Options newer clients may set that etcd 3.0's protocol lacks, such as
+// event filters and previous values, are rejected as unimplemented.
+func (v3 *v3Server) Watch(stream pb.Watch_WatchServer) error {
+	ws := v3.s.Watchable().NewWatchStream()
+	defer ws.Close()
+
+	// watchers that asked for progress notifications, and whether
+	// they went without events since the last one
+	var progressMu sync.Mutex
+	progress := make(map[mvcc.WatchID]bool)
+
+	// gRPC streams can't be sent on concurrently, so all responses go
+	// out from one goroutine. Events are held back until the response
+	// creating their watcher is sent.
+	errc := make(chan error, 3)
+	ctrlc := make(chan *pb.WatchResponse, 16)
+	go func() {
+		send := func(resp *pb.WatchResponse) error {
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+			id := mvcc.WatchID(resp.WatchId)
+			progressMu.Lock()
+			if _, ok := progress[id]; ok && len(resp.Events) > 0 {
+				progress[id] = false
+			}
+			progressMu.Unlock()
+			return nil
+		}
+
+		created := make(map[mvcc.WatchID]bool)
+		pending := make(map[mvcc.WatchID][]*pb.WatchResponse)
+		for {
+			var err error
+			select {
+			case wresp, ok := <-ws.Chan():
+				if !ok {
+					return
+				}
+				events := make([]*mvccpb.Event, len(wresp.Events))
+				for i := range wresp.Events {
+					events[i] = &wresp.Events[i]
+				}
+				resp := &pb.WatchResponse{
+					Header:          v3.header(&pb.ResponseHeader{Revision: wresp.Revision}),
+					WatchId:         int64(wresp.WatchID),
+					Events:          events,
+					CompactRevision: wresp.CompactRevision,
+					Canceled:        wresp.CompactRevision != 0,
+				}
+				if !created[wresp.WatchID] {
+					pending[wresp.WatchID] = append(pending[wresp.WatchID], resp)
+					continue
+				}
+				err = send(resp)
+			case resp := <-ctrlc:
+				id := mvcc.WatchID(resp.WatchId)
+				err = send(resp)
+				if resp.Created {
+					created[id] = true
+					for _, p := range pending[id] {
+						if err == nil {
+							err = send(p)
+						}
+					}
+					delete(pending, id)
+				} else if resp.Canceled {
+					delete(created, id)
+					delete(pending, id)
+				}
+			case <-stream.Context().Done():
+				return
+			}
+			if err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(watchProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stream.Context().Done():
+				return
+			}
+
+			progressMu.Lock()
+			for id, quiet := range progress {
+				if quiet {
+					ws.RequestProgress(id)
+				}
+				progress[id] = true
+			}
+			progressMu.Unlock()
+		}
+	}()
+
+	reqc := make(chan *pb.WatchRequest)
+	go func() {
+		for {
+			req := &watchRequest{}
+			if err := stream.RecvMsg(req); err != nil {
+				errc <- err
+				return
+			}
+			if len(req.unsupported) > 0 {
+				errc <- grpc.Errorf(codes.Unimplemented, "watch options not supported: %v", req.unsupported)
+				return
+			}
+			select {
+			case reqc <- &req.WatchRequest:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+
+	streamErr := func(err error) error {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+
+	for {
+		var req *pb.WatchRequest
+		select {
+		case req = <-reqc:
+		case err := <-errc:
+			return streamErr(err)
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+
+		var resp *pb.WatchResponse
+		switch {
+		case req.GetCreateRequest() != nil:
+			cr := req.GetCreateRequest()
+			id := ws.Watch(cr.Key, cr.RangeEnd, cr.StartRevision)
+			if cr.ProgressNotify {
+				progressMu.Lock()
+				progress[id] = true
+				progressMu.Unlock()
+			}
+			resp = &pb.WatchResponse{
+				WatchId: int64(id),
+				Created: true,
+			}
+		case req.GetCancelRequest() != nil:
+			id := req.GetCancelRequest().WatchId
+			if ws.Cancel(mvcc.WatchID(id)) != nil {
+				continue
+			}
+			progressMu.Lock()
+			delete(progress, mvcc.WatchID(id))
+			progressMu.Unlock()
+			resp = &pb.WatchResponse{
+				WatchId:  id,
+				Canceled: true,
+			}
+		default:
+			continue
+		}
+
+		resp.Header = v3.header(&pb.ResponseHeader{Revision: ws.Rev()})
+		select {
+		case ctrlc <- resp:
+		case err := <-errc:
+			return streamErr(err)
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// watchRequest is a WatchRequest that also notes which options of its
+// create request etcd 3.0's protocol lacks; the generated code drops
+// unknown fields silently.
+type watchRequest struct {
+	pb.WatchRequest
+	unsupported []string
+}
+
+// fields of WatchCreateRequest added after etcd 3.0
+var newerWatchCreateFields = map[uint64]string{
+	5: "filters",
+	6: "prev_kv",
+}
+
+func (r *watchRequest) Unmarshal(data []byte) error {
+	if err := r.WatchRequest.Unmarshal(data); err != nil {
+		return err
+	}
+
+	r.unsupported = nil
+	return protoFields(data, func(num uint64, val []byte) error {
+		if num != 1 || r.GetCreateRequest() == nil {
+			return nil
+		}
+		// fields 1 to 4 are the ones known to WatchCreateRequest
+		return protoFields(val, func(num uint64, val []byte) error {
+			if num > 4 {
+				name, ok := newerWatchCreateFields[num]
+				if !ok {
+					name = fmt.Sprintf("field %d", num)
+				}
+				r.unsupported = append(r.unsupported, name)
+			}
+			return nil
+		})
+	})
+}
+
+var errBadProto = errors.New("malformed protobuf message")
+
+// protoFields calls fn with the number of each field of an encoded
+// protobuf message, and the contents of length-delimited fields.
+func protoFields(data []byte, fn func(num uint64, val []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errBadProto
+		}
+		data = data[n:]
+
+		var val []byte
+		switch key & 7 {
+		case 0: // varint
+			if _, n = binary.Uvarint(data); n <= 0 {
+				return errBadProto
+			}
+		case 1: // 64-bit
+			n = 8
+		case 2: // length-delimited
+			size, m := binary.Uvarint(data)
+			if m <= 0 || size > uint64(len(data)-m) {
+				return errBadProto
+			}
+			n = m + int(size)
+			val = data[m:n]
+		case 5: // 32-bit
+			n = 4
+		default:
+			return errBadProto
+		}
+		if n > len(data) {
+			return errBadProto
+		}
+		data = data[n:]
+
+		if err := fn(key>>3, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v3 *v3Server) LeaseGrant(ctx context.Context, r *pb.LeaseGrantRequest) (*pb.LeaseGrantResponse, error) {
+	resp, err := v3.s.LeaseGrant(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header = v3.header(resp.Header)
+	return resp, nil
+}
+
+func (v3 *v3Server) LeaseRevoke(ctx context.Context, r *pb.LeaseRevokeRequest) (*pb.LeaseRevokeResponse, error) {
+	resp, err := v3.s.LeaseRevoke(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header = v3.header(resp.Header)
+	return resp, nil
+}
+
+func (v3 *v3Server) LeaseKeepAlive(stream pb.Lease_LeaseKeepAliveServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		ttl, err := v3.s.LeaseRenew(lease.LeaseID(req.ID))
+		if err == lease.ErrLeaseNotFound {
+			ttl = 0
+		} else if err != nil {
+			return err
+		}
+
+		err = stream.Send(&pb.LeaseKeepAliveResponse{
+			Header: v3.header(nil),
+			ID:     req.ID,
+			TTL:    ttl,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// MemberList lists the URLs of the members' v3 API as client URLs, for
+// clients that sync their endpoints from it.
+func (v3 *v3Server) MemberList(ctx context.Context, r *pb.MemberListRequest) (*pb.MemberListResponse, error) {
+	var members []*pb.Member
+	for _, m := range v3.s.Cluster().Members() {
+		clientURLs, err := withPort(m.ClientURLs, v3.grpcPorts[m.Name])
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, &pb.Member{
+			ID:         uint64(m.ID),
+			Name:       m.Name,
+			PeerURLs:   m.PeerURLs,
+			ClientURLs: clientURLs,
+		})
+	}
+	return &pb.MemberListResponse{
+		Header:  v3.header(nil),
+		Members: members,
+	}, nil
+}
+
+// withPort returns the URLs with their port replaced.
+func withPort(urls []string, port int) ([]string, error) {
+	var ported []string
+	for _, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		host, _, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			return nil, err
+		}
+		u.Host = net.JoinHostPort(host, strconv.Itoa(port))
+		ported = append(ported, u.String())
+	}
+	return ported, nil
+}
+
+func (v3 *v3Server) MemberAdd(ctx context.Context, r *pb.MemberAddRequest) (*pb.MemberAddResponse, error) {
+	return nil, grpc.Errorf(codes.Unimplemented, "membership changes are not supported")
+}
+
+func (v3 *v3Server) MemberRemove(ctx context.Context, r *pb.MemberRemoveRequest) (*pb.MemberRemoveResponse, error) {
+	return nil, grpc.Errorf(codes.Unimplemented, "membership changes are not supported")
+}
+
+func (v3 *v3Server) MemberUpdate(ctx context.Context, r *pb.MemberUpdateRequest) (*pb.MemberUpdateResponse, error) {
+	return nil, grpc.Errorf(codes.Unimplemented, "membership changes are not supported")
+}
+
+func (v3 *v3Server) Status(ctx context.Context, r *pb.StatusRequest) (*pb.StatusResponse, error) {
+	return &pb.StatusResponse{
+		Header:    v3.header(nil),
+		Version:   version.Version,
+		DbSize:    v3.s.Backend().Size(),
+		Leader:    uint64(v3.s.Leader()),
+		RaftIndex: v3.s.Index(),
+		RaftTerm:  v3.s.Term(),
+	}, nil
+}
+
+func (v3 *v3Server) Alarm(ctx context.Context, r *pb.AlarmRequest) (*pb.AlarmResponse, error) {
+	resp, err := v3.s.Alarm(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header = v3.header(resp.Header)
+	return resp, nil
+}
+
+func (v3 *v3Server) Defragment(ctx context.Context, r *pb.DefragmentRequest) (*pb.DefragmentResponse, error) {
+	return nil, grpc.Errorf(codes.Unimplemented, "defragmentation is not supported")
+}
+
+func (v3 *v3Server) Hash(ctx context.Context, r *pb.HashRequest) (*pb.HashResponse, error) {
+	return nil, grpc.Errorf(codes.Unimplemented, "hashing is not supported")
+}
+
+func (v3 *v3Server) Snapshot(r *pb.SnapshotRequest, stream pb.Maintenance_SnapshotServer) error {
+	return grpc.Errorf(codes.Unimplemented, "snapshots are not supported")
+}
@@ -0,0 +1,243 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// rawMessage sends pre-encoded protobuf, to set fields the vendored
+// protocol lacks.
+type rawMessage []byte
+
+func (m rawMessage) Marshal() ([]byte, error) { return m, nil }
+func (m rawMessage) Reset()                   {}
+func (m rawMessage) String() string           { return fmt.Sprintf("%x", []byte(m)) }
+func (m rawMessage) ProtoMessage()            {}
+
+func newTestEtcd(t *testing.T) (*SimpleEtcd, *grpc.ClientConn, func()) {
+	peers, err := ListenEtcdPeers(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closePeers := func() {
+		for _, l := range peers {
+			l.Close()
+		}
+	}
+
+	se, err := NewSimpleEtcd(peers)
+	if err != nil {
+		closePeers()
+		t.Fatal(err)
+	}
+
+	conn, err := grpc.Dial(fmt.Sprintf("127.0.0.1:%d", se.Members[0].GRPCPort),
+		grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(10*time.Second))
+	if err != nil {
+		se.Destroy()
+		closePeers()
+		t.Fatal(err)
+	}
+
+	return se, conn, func() {
+		conn.Close()
+		se.Destroy()
+		closePeers()
+	}
+}
+
+func TestV3KV(t *testing.T) {
+	_, conn, cleanup := newTestEtcd(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	kv := pb.NewKVClient(conn)
+	if _, err := kv.Put(ctx, &pb.PutRequest{Key: []byte("foo"), Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := kv.Range(ctx, &pb.RangeRequest{Key: []byte("foo")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 || string(resp.Kvs[0].Value) != "bar" {
+		t.Errorf("got %v, wanted foo=bar", resp.Kvs)
+	}
+	if resp.Header.ClusterId == 0 || resp.Header.MemberId == 0 || resp.Header.Revision == 0 {
+		t.Errorf("incomplete header %+v", resp.Header)
+	}
+}
+
+func TestV3Watch(t *testing.T) {
+	old := watchProgressInterval
+	watchProgressInterval = 100 * time.Millisecond
+	defer func() { watchProgressInterval = old }()
+
+	_, conn, cleanup := newTestEtcd(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	stream, err := pb.NewWatchClient(conn).Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(cr *pb.WatchCreateRequest) int64 {
+		err := stream.Send(&pb.WatchRequest{
+			RequestUnion: &pb.WatchRequest_CreateRequest{CreateRequest: cr},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resp.Created {
+			t.Fatalf("expected a created response, got %+v", resp)
+		}
+		return resp.WatchId
+	}
+
+	id := create(&pb.WatchCreateRequest{Key: []byte("foo")})
+	if _, err := pb.NewKVClient(conn).Put(ctx, &pb.PutRequest{Key: []byte("foo"), Value: []byte("baz")}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.WatchId != id || len(resp.Events) != 1 {
+		t.Fatalf("got %+v, wanted one event for watch %d", resp, id)
+	}
+	if ev := resp.Events[0]; ev.Type != mvccpb.PUT || string(ev.Kv.Value) != "baz" {
+		t.Errorf("got event %+v, wanted put of baz", ev)
+	}
+
+	// a watcher starting in the past is created before it gets events
+	past := create(&pb.WatchCreateRequest{Key: []byte("foo"), StartRevision: 1})
+	resp, err = stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.WatchId != past || len(resp.Events) != 1 || string(resp.Events[0].Kv.Value) != "baz" {
+		t.Fatalf("got %+v, wanted the earlier put for watch %d", resp, past)
+	}
+
+	// a quiet watcher asking for progress hears from the server
+	quiet := create(&pb.WatchCreateRequest{Key: []byte("quiet"), ProgressNotify: true})
+	resp, err = stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.WatchId != quiet || len(resp.Events) != 0 || resp.Header.Revision == 0 {
+		t.Errorf("got %+v, wanted a progress notification for watch %d", resp, quiet)
+	}
+
+	// create request for "foo" with prev_kv, which etcd 3.0 lacks
+	if err := stream.SendMsg(rawMessage{0x0a, 0x07, 0x0a, 0x03, 'f', 'o', 'o', 0x30, 0x01}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err = stream.Recv(); err != nil {
+			break
+		}
+	}
+	if grpc.Code(err) != codes.Unimplemented || !strings.Contains(err.Error(), "prev_kv") {
+		t.Errorf("got %v, wanted prev_kv to be unimplemented", err)
+	}
+}
+
+func TestV3Lease(t *testing.T) {
+	_, conn, cleanup := newTestEtcd(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	lc := pb.NewLeaseClient(conn)
+	grant, err := lc.LeaseGrant(ctx, &pb.LeaseGrantRequest{TTL: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv := pb.NewKVClient(conn)
+	if _, err := kv.Put(ctx, &pb.PutRequest{Key: []byte("leased"), Value: []byte("x"), Lease: grant.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	ka, err := lc.LeaseKeepAlive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ka.Send(&pb.LeaseKeepAliveRequest{ID: grant.ID}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ka.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != grant.ID || resp.TTL <= 0 {
+		t.Errorf("got keepalive %+v for lease %d", resp, grant.ID)
+	}
+
+	if _, err := lc.LeaseRevoke(ctx, &pb.LeaseRevokeRequest{ID: grant.ID}); err != nil {
+		t.Fatal(err)
+	}
+	rresp, err := kv.Range(ctx, &pb.RangeRequest{Key: []byte("leased")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rresp.Kvs) != 0 {
+		t.Errorf("key outlived its revoked lease: %v", rresp.Kvs)
+	}
+}
+
+func TestV3MemberList(t *testing.T) {
+	se, conn, cleanup := newTestEtcd(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := pb.NewClusterClient(conn).MemberList(ctx, &pb.MemberListRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Members) != 1 || resp.Members[0].Name != se.Members[0].Name {
+		t.Fatalf("got members %+v", resp.Members)
+	}
+	port := ":" + strconv.Itoa(se.Members[0].GRPCPort)
+	for _, u := range resp.Members[0].ClientURLs {
+		if !strings.HasSuffix(u, port) {
+			t.Errorf("client URL %s isn't the gRPC port %s", u, port)
+		}
+	}
+}
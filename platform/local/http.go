@@ -0,0 +1,193 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+type httpFile struct {
+	data      []byte
+	localPath string
+}
+
+type httpFailure struct {
+	count  int
+	status int
+}
+
+// HTTPRequest records a request handled by an HTTPServer.
+type HTTPRequest struct {
+	Time       time.Time
+	Method     string
+	Path       string
+	RemoteAddr string
+	UserAgent  string
+	Status     int
+}
+
+// HTTPServer serves files to the machines in a LocalCluster and keeps a
+// log of the requests it handled.
+type HTTPServer struct {
+	Port     int
+	listener net.Listener
+
+	mu       sync.Mutex
+	files    map[string]httpFile
+	failures map[string]*httpFailure
+	requests []HTTPRequest
+}
+
+// NewHTTPServer starts an HTTP server listening on addr in the current
+// network namespace.
+func NewHTTPServer(addr string) (*HTTPServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &HTTPServer{
+		Port:     listener.Addr().(*net.TCPAddr).Port,
+		listener: listener,
+		files:    make(map[string]httpFile),
+		failures: make(map[string]*httpFailure),
+	}
+	go http.Serve(listener, s)
+
+	return s, nil
+}
+
+// AddFile serves data at the given URL path.
+func (s *HTTPServer) AddFile(urlPath string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[cleanPath(urlPath)] = httpFile{data: data}
+}
+
+// AddLocalFile serves the contents of the local file at the given URL
+// path. The file is read on each request, not when it is added.
+func (s *HTTPServer) AddLocalFile(urlPath, localPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[cleanPath(urlPath)] = httpFile{localPath: localPath}
+}
+
+// RemoveFile stops serving the given URL path.
+func (s *HTTPServer) RemoveFile(urlPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, cleanPath(urlPath))
+}
+
+// FailRequests answers the next count requests for the given URL path
+// with the HTTP status code status instead of the file, e.g. to test
+// that clients retry.
+func (s *HTTPServer) FailRequests(urlPath string, count, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[cleanPath(urlPath)] = &httpFailure{count: count, status: status}
+}
+
+// Requests returns the log of requests handled so far.
+func (s *HTTPServer) Requests() []HTTPRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]HTTPRequest(nil), s.requests...)
+}
+
+// RequestsFor returns the log of requests handled so far for the given
+// URL path.
+func (s *HTTPServer) RequestsFor(urlPath string) []HTTPRequest {
+	urlPath = cleanPath(urlPath)
+
+	var reqs []HTTPRequest
+	for _, r := range s.Requests() {
+		if r.Path == urlPath {
+			reqs = append(reqs, r)
+		}
+	}
+	return reqs
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	urlPath := cleanPath(r.URL.Path)
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+	s.mu.Lock()
+	f, ok := s.files[urlPath]
+	failure := s.failures[urlPath]
+	if failure != nil {
+		failure.count--
+		if failure.count <= 0 {
+			delete(s.failures, urlPath)
+		}
+	}
+	s.mu.Unlock()
+
+	switch {
+	case failure != nil:
+		http.Error(sw, http.StatusText(failure.status), failure.status)
+	case !ok:
+		http.NotFound(sw, r)
+	case f.localPath != "":
+		http.ServeFile(sw, r, f.localPath)
+	default:
+		http.ServeContent(sw, r, path.Base(urlPath), time.Time{}, bytes.NewReader(f.data))
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, HTTPRequest{
+		Time:       time.Now(),
+		Method:     r.Method,
+		Path:       urlPath,
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+		Status:     sw.status,
+	})
+	s.mu.Unlock()
+}
+
+func (s *HTTPServer) Destroy() error {
+	return s.listener.Close()
+}
+
+// VerificationHash returns the hash of data in the "sha512-<hex>" form
+// Ignition expects in verification sections.
+func VerificationHash(data []byte) string {
+	sum := sha512.Sum512(data)
+	return "sha512-" + hex.EncodeToString(sum[:])
+}
+
+func cleanPath(urlPath string) string {
+	return path.Clean("/" + urlPath)
+}
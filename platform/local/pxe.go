@@ -0,0 +1,51 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// dnsmasq points every iPXE client at boot.ipxe, which chains to a
+// script named after the client's MAC address.
+const ipxeChainScript = `#!ipxe
+chain pxe/${net0/mac:hexhyp}.ipxe
+`
+
+// PXEBoot configures the machine with the given MAC address to network
+// boot the kernel and initrd at the given URLs with the kernel command
+// line cmdline.
+func (lc *LocalCluster) PXEBoot(mac net.HardwareAddr, kernelURL, initrdURL, cmdline string) {
+	initrdName := initrdURL[strings.LastIndex(initrdURL, "/")+1:]
+	script := fmt.Sprintf(`#!ipxe
+kernel %s initrd=%s %s
+initrd %s
+boot
+`, kernelURL, initrdName, cmdline, initrdURL)
+
+	lc.HTTPServer.AddFile(pxeScriptPath(mac), []byte(script))
+}
+
+// RemovePXEBoot removes the network boot configuration for the given
+// MAC address.
+func (lc *LocalCluster) RemovePXEBoot(mac net.HardwareAddr) {
+	lc.HTTPServer.RemoveFile(pxeScriptPath(mac))
+}
+
+func pxeScriptPath(mac net.HardwareAddr) string {
+	return "/pxe/" + strings.Replace(mac.String(), ":", "-", -1) + ".ipxe"
+}
@@ -0,0 +1,419 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mediaTypeManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeConfig   = "application/vnd.docker.container.image.v1+json"
+	mediaTypeLayer    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+var (
+	manifestPath = regexp.MustCompile(`^/v2/(.+)/manifests/([^/]+)$`)
+	blobPath     = regexp.MustCompile(`^/v2/(.+)/blobs/(sha256:[0-9a-f]{64})$`)
+	tagsPath     = regexp.MustCompile(`^/v2/(.+)/tags/list$`)
+)
+
+type registryDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	Digest    string `json:"digest"`
+}
+
+type registryManifest struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	MediaType     string               `json:"mediaType"`
+	Config        registryDescriptor   `json:"config"`
+	Layers        []registryDescriptor `json:"layers"`
+}
+
+// Registry is a read-only Docker Registry HTTP API V2 server holding
+// images loaded from `docker save` archives, so that machines can pull
+// them without internet access.
+type Registry struct {
+	Port     int
+	listener net.Listener
+	blobDir  string
+
+	mu        sync.Mutex
+	manifests map[string][]byte            // digest to manifest
+	tags      map[string]map[string]string // repository to tag to digest
+}
+
+// NewRegistry starts a registry listening on addr in the current network
+// namespace.
+func NewRegistry(addr string) (*Registry, error) {
+	blobDir, err := ioutil.TempDir("", "mantle-registry-")
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		os.RemoveAll(blobDir)
+		return nil, err
+	}
+
+	r := &Registry{
+		Port:      listener.Addr().(*net.TCPAddr).Port,
+		listener:  listener,
+		blobDir:   blobDir,
+		manifests: make(map[string][]byte),
+		tags:      make(map[string]map[string]string),
+	}
+	go http.Serve(listener, r)
+
+	return r, nil
+}
+
+// Repository returns the name under which the registry serves the image
+// reference name, which may include a registry host: any host is
+// dropped, and Docker Hub's implicit "library/" prefix is added.
+func Repository(name string) string {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		name = parts[1]
+	}
+	if !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	return name
+}
+
+// LoadArchive adds the images in a tarball written by `docker save`,
+// optionally gzipped, under the repository names and tags they were
+// saved with.
+func (r *Registry) LoadArchive(path string) error {
+	dir, err := ioutil.TempDir("", "mantle-registry-load-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := extractArchive(path, dir); err != nil {
+		return fmt.Errorf("extracting %s: %v", path, err)
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return fmt.Errorf("%s is not a docker save archive: %v", path, err)
+	}
+	var images []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	if err := json.Unmarshal(buf, &images); err != nil {
+		return fmt.Errorf("parsing manifest.json in %s: %v", path, err)
+	}
+
+	// layers are often shared between the images of an archive
+	layers := make(map[string]registryDescriptor)
+	for _, image := range images {
+		manifest := registryManifest{
+			SchemaVersion: 2,
+			MediaType:     mediaTypeManifest,
+		}
+
+		manifest.Config, err = r.addBlob(filepath.Join(dir, filepath.Clean("/"+image.Config)), mediaTypeConfig, false)
+		if err != nil {
+			return err
+		}
+
+		for _, layer := range image.Layers {
+			desc, ok := layers[layer]
+			if !ok {
+				desc, err = r.addBlob(filepath.Join(dir, filepath.Clean("/"+layer)), mediaTypeLayer, true)
+				if err != nil {
+					return err
+				}
+				layers[layer] = desc
+			}
+			manifest.Layers = append(manifest.Layers, desc)
+		}
+
+		if err := r.addManifest(manifest, image.RepoTags); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractArchive extracts the regular files of a tarball into dir.
+func extractArchive(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	in := bufio.NewReader(f)
+	var tr *tar.Reader
+	if magic, err := in.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		tr = tar.NewReader(zr)
+	} else {
+		tr = tar.NewReader(in)
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// keep names from escaping dir
+		dst := filepath.Join(dir, filepath.Clean("/"+hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		out, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		if err2 := out.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// addBlob copies a file into the registry's blob store, compressing it
+// first if requested.
+func (r *Registry) addBlob(path, mediaType string, compress bool) (registryDescriptor, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return registryDescriptor{}, err
+	}
+	defer src.Close()
+
+	tmp, err := ioutil.TempFile(r.blobDir, "tmp-")
+	if err != nil {
+		return registryDescriptor{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	counter := &countWriter{}
+	dst := io.MultiWriter(tmp, hash, counter)
+
+	if compress {
+		zw := gzip.NewWriter(dst)
+		if _, err := io.Copy(zw, src); err != nil {
+			return registryDescriptor{}, err
+		}
+		if err := zw.Close(); err != nil {
+			return registryDescriptor{}, err
+		}
+	} else if _, err := io.Copy(dst, src); err != nil {
+		return registryDescriptor{}, err
+	}
+
+	desc := registryDescriptor{
+		MediaType: mediaType,
+		Size:      counter.n,
+		Digest:    "sha256:" + hex.EncodeToString(hash.Sum(nil)),
+	}
+	if err := os.Rename(tmp.Name(), r.blobPath(desc.Digest)); err != nil {
+		return registryDescriptor{}, err
+	}
+	return desc, nil
+}
+
+func (r *Registry) addManifest(manifest registryManifest, repoTags []string) error {
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(buf)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.manifests[digest] = buf
+	for _, repoTag := range repoTags {
+		repo, tag := repoTag, "latest"
+		// a colon after the last slash separates the tag
+		if i := strings.LastIndex(repoTag, ":"); i > strings.LastIndex(repoTag, "/") {
+			repo, tag = repoTag[:i], repoTag[i+1:]
+		}
+		repo = Repository(repo)
+		if r.tags[repo] == nil {
+			r.tags[repo] = make(map[string]string)
+		}
+		r.tags[repo][tag] = digest
+	}
+	return nil
+}
+
+// Images returns the "repository:tag" names of the images served.
+func (r *Registry) Images() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var images []string
+	for repo, tags := range r.tags {
+		for tag := range tags {
+			images = append(images, repo+":"+tag)
+		}
+	}
+	sort.Strings(images)
+	return images
+}
+
+func (r *Registry) blobPath(digest string) string {
+	return filepath.Join(r.blobDir, strings.Replace(digest, ":", "-", 1))
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+	if req.Method != "GET" && req.Method != "HEAD" {
+		registryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "registry is read-only")
+		return
+	}
+
+	urlPath := cleanPath(req.URL.Path)
+	if m := manifestPath.FindStringSubmatch(urlPath); m != nil {
+		r.serveManifest(w, req, m[1], m[2])
+	} else if m := blobPath.FindStringSubmatch(urlPath); m != nil {
+		r.serveBlob(w, req, m[2])
+	} else if m := tagsPath.FindStringSubmatch(urlPath); m != nil {
+		r.serveTags(w, m[1])
+	} else if urlPath == "/v2" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	} else {
+		registryError(w, http.StatusNotFound, "UNSUPPORTED", "unknown endpoint")
+	}
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, repo, ref string) {
+	r.mu.Lock()
+	digest := ref
+	if !strings.HasPrefix(ref, "sha256:") {
+		digest = r.tags[repo][ref]
+	}
+	buf, ok := r.manifests[digest]
+	r.mu.Unlock()
+
+	if !ok {
+		registryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+		return
+	}
+
+	w.Header().Set("Content-Type", mediaTypeManifest)
+	w.Header().Set("Docker-Content-Digest", digest)
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(buf))
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, req *http.Request, digest string) {
+	f, err := os.Open(r.blobPath(digest))
+	if err != nil {
+		registryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown")
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest)
+	http.ServeContent(w, req, "", time.Time{}, f)
+}
+
+func (r *Registry) serveTags(w http.ResponseWriter, repo string) {
+	r.mu.Lock()
+	tags := []string{}
+	for tag := range r.tags[repo] {
+		tags = append(tags, tag)
+	}
+	r.mu.Unlock()
+
+	if len(tags) == 0 {
+		registryError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository unknown")
+		return
+	}
+	sort.Strings(tags)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name": repo,
+		"tags": tags,
+	})
+}
+
+func registryError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{
+			"code":    code,
+			"message": message,
+		}},
+	})
+}
+
+func (r *Registry) Destroy() error {
+	err := r.listener.Close()
+	if err2 := os.RemoveAll(r.blobDir); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// countWriter counts the bytes written to it.
+type countWriter struct {
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
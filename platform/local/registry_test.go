@@ -0,0 +1,285 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+const (
+	testConfig = `{"architecture":"amd64","os":"linux"}`
+	testLayer  = "layer contents"
+)
+
+func sha256Digest(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// writeArchive writes a `docker save` archive of two images sharing a
+// layer and a config.
+func writeArchive(t *testing.T, dir string) string {
+	files := []struct {
+		name, data string
+	}{
+		{"manifest.json", `[
+  {"Config": "abc.json", "RepoTags": ["busybox:latest", "busybox:1"], "Layers": ["0123/layer.tar"]},
+  {"Config": "abc.json", "RepoTags": ["quay.io/coreos/etcd:v3"], "Layers": ["0123/layer.tar"]}
+]`},
+		{"abc.json", testConfig},
+		{"0123/layer.tar", testLayer},
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:     f.name,
+			Mode:     0644,
+			Size:     int64(len(f.data)),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "images.tar")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestRegistry(t *testing.T) (*Registry, *httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "kola-registry-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRegistry("127.0.0.1:0")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		r.Destroy()
+		os.RemoveAll(dir)
+	}
+
+	if err := r.LoadArchive(writeArchive(t, dir)); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(r)
+	return r, srv, func() {
+		srv.Close()
+		cleanup()
+	}
+}
+
+func get(t *testing.T, method, url string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestRepository(t *testing.T) {
+	for name, expect := range map[string]string{
+		"busybox":                 "library/busybox",
+		"coreos/etcd":             "coreos/etcd",
+		"quay.io/coreos/etcd":     "coreos/etcd",
+		"localhost/busybox":       "library/busybox",
+		"10.0.0.1:5000/busybox":   "library/busybox",
+		"docker.io/library/nginx": "library/nginx",
+	} {
+		if repo := Repository(name); repo != expect {
+			t.Errorf("Repository(%q) = %q, wanted %q", name, repo, expect)
+		}
+	}
+}
+
+func TestRegistryLoadArchive(t *testing.T) {
+	r, _, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	images := r.Images()
+	expect := []string{"coreos/etcd:v3", "library/busybox:1", "library/busybox:latest"}
+	if !reflect.DeepEqual(images, expect) {
+		t.Errorf("got images %q, wanted %q", images, expect)
+	}
+
+	// both images are the same, so they share a manifest
+	if len(r.manifests) != 1 {
+		t.Errorf("got %d manifests, wanted 1", len(r.manifests))
+	}
+	blobs, err := filepath.Glob(filepath.Join(r.blobDir, "sha256-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 2 {
+		t.Errorf("got blobs %q, wanted one config and one layer", blobs)
+	}
+}
+
+func TestRegistryManifest(t *testing.T) {
+	_, srv, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	resp, body := get(t, "GET", srv.URL+"/v2/")
+	if resp.StatusCode != http.StatusOK || string(body) != "{}" {
+		t.Errorf("/v2/: got %s %q", resp.Status, body)
+	}
+
+	resp, body = get(t, "GET", srv.URL+"/v2/library/busybox/manifests/latest")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("manifest by tag: got %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != mediaTypeManifest {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest != sha256Digest(body) {
+		t.Errorf("got Docker-Content-Digest %q, wanted %q", digest, sha256Digest(body))
+	}
+
+	var manifest registryManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.SchemaVersion != 2 || manifest.MediaType != mediaTypeManifest {
+		t.Errorf("got schema %d media type %q", manifest.SchemaVersion, manifest.MediaType)
+	}
+	if manifest.Config.Digest != sha256Digest([]byte(testConfig)) || manifest.Config.Size != int64(len(testConfig)) {
+		t.Errorf("got config %+v", manifest.Config)
+	}
+	if len(manifest.Layers) != 1 || manifest.Layers[0].MediaType != mediaTypeLayer {
+		t.Errorf("got layers %+v", manifest.Layers)
+	}
+
+	resp, byDigest := get(t, "GET", srv.URL+"/v2/coreos/etcd/manifests/"+digest)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(byDigest, body) {
+		t.Errorf("manifest by digest: got %s %q", resp.Status, byDigest)
+	}
+
+	resp, head := get(t, "HEAD", srv.URL+"/v2/library/busybox/manifests/1")
+	if resp.StatusCode != http.StatusOK || len(head) != 0 {
+		t.Errorf("HEAD manifest: got %s with %d bytes", resp.Status, len(head))
+	}
+	if resp.Header.Get("Docker-Content-Digest") != digest || resp.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Errorf("HEAD manifest: got headers %v", resp.Header)
+	}
+
+	for _, path := range []string{
+		"/v2/library/busybox/manifests/2",
+		"/v2/library/alpine/manifests/latest",
+		"/v2/library/busybox/manifests/" + sha256Digest(nil),
+	} {
+		if resp, _ := get(t, "GET", srv.URL+path); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: got %s, wanted 404", path, resp.Status)
+		}
+	}
+
+	if resp, _ := get(t, "PUT", srv.URL+"/v2/library/busybox/manifests/latest"); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("PUT manifest: got %s, wanted 405", resp.Status)
+	}
+
+	resp, body = get(t, "GET", srv.URL+"/v2/library/busybox/tags/list")
+	var tags struct {
+		Name string
+		Tags []string
+	}
+	if err := json.Unmarshal(body, &tags); err != nil {
+		t.Fatal(err)
+	}
+	if tags.Name != "library/busybox" || !reflect.DeepEqual(tags.Tags, []string{"1", "latest"}) {
+		t.Errorf("tags/list: got %+v", tags)
+	}
+}
+
+func TestRegistryBlob(t *testing.T) {
+	_, srv, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	_, body := get(t, "GET", srv.URL+"/v2/library/busybox/manifests/latest")
+	var manifest registryManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, config := get(t, "GET", srv.URL+"/v2/library/busybox/blobs/"+manifest.Config.Digest)
+	if resp.StatusCode != http.StatusOK || string(config) != testConfig {
+		t.Errorf("config blob: got %s %q", resp.Status, config)
+	}
+
+	layer := manifest.Layers[0]
+	resp, compressed := get(t, "GET", srv.URL+"/v2/library/busybox/blobs/"+layer.Digest)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("layer blob: got %s", resp.Status)
+	}
+	if resp.Header.Get("Docker-Content-Digest") != layer.Digest || sha256Digest(compressed) != layer.Digest {
+		t.Errorf("layer blob doesn't match digest %s", layer.Digest)
+	}
+	if int64(len(compressed)) != layer.Size {
+		t.Errorf("got %d bytes of layer, wanted %d", len(compressed), layer.Size)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(zr); err != nil || string(data) != testLayer {
+		t.Errorf("layer blob: got %q, %v", data, err)
+	}
+
+	resp, head := get(t, "HEAD", srv.URL+"/v2/library/busybox/blobs/"+layer.Digest)
+	if resp.StatusCode != http.StatusOK || len(head) != 0 || resp.Header.Get("Content-Length") != strconv.FormatInt(layer.Size, 10) {
+		t.Errorf("HEAD blob: got %s with %d bytes, headers %v", resp.Status, len(head), resp.Header)
+	}
+
+	if resp, _ := get(t, "GET", srv.URL+"/v2/library/busybox/blobs/"+sha256Digest(nil)); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown blob: got %s, wanted 404", resp.Status)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DNS (RFC 1035) and SRV (RFC 2782) constants
+const (
+	dnsHeaderLen = 12
+
+	dnsFlagResponse      = 1 << 15
+	dnsFlagAuthoritative = 1 << 10
+	dnsFlagRecursion     = 1 << 8
+	dnsOpcodeMask        = 0xf << 11
+
+	dnsRcodeFormErr  = 1
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+	dnsClassIN = 1
+)
+
+var errBadQuery = errors.New("malformed DNS query")
+
+// srvServer answers DNS queries for SRV records. dnsmasq only reads SRV
+// records from its configuration, which it can't reload without
+// restarting, so it forwards queries for their names here instead.
+type srvServer struct {
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	records map[string][]SRVRecord
+}
+
+// newSRVServer serves SRV records on the loopback address of the
+// current network namespace.
+func newSRVServer() (*srvServer, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &srvServer{
+		conn:    conn,
+		records: make(map[string][]SRVRecord),
+	}
+	go s.serve()
+	return s, nil
+}
+
+// Port returns the UDP port the server listens on.
+func (s *srvServer) Port() int {
+	return s.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// add serves rec in addition to the records already served.
+func (s *srvServer) add(rec SRVRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := dnsName(rec.Name)
+	s.records[name] = append(s.records[name], rec)
+}
+
+// names returns the names records are served for, sorted.
+func (s *srvServer) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *srvServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		resp, err := s.answer(buf[:n])
+		if err != nil {
+			plog.Debugf("SRV server: query from %s: %v", addr, err)
+			continue
+		}
+		s.conn.WriteTo(resp, addr)
+	}
+}
+
+// answer returns the response to query.
+func (s *srvServer) answer(query []byte) ([]byte, error) {
+	if len(query) < dnsHeaderLen {
+		return nil, errBadQuery
+	}
+	flags := binary.BigEndian.Uint16(query[2:])
+	if flags&dnsFlagResponse != 0 {
+		return nil, errBadQuery
+	}
+
+	resp := make([]byte, dnsHeaderLen, 512)
+	copy(resp, query[:2]) // ID
+	respFlags := uint16(dnsFlagResponse|dnsFlagAuthoritative) | flags&(dnsOpcodeMask|dnsFlagRecursion)
+	reply := func(rcode uint16, answers int) []byte {
+		binary.BigEndian.PutUint16(resp[2:], respFlags|rcode)
+		binary.BigEndian.PutUint16(resp[6:], uint16(answers))
+		return resp
+	}
+
+	if flags&dnsOpcodeMask != 0 {
+		return reply(dnsRcodeNotImp, 0), nil
+	}
+	if binary.BigEndian.Uint16(query[4:]) != 1 {
+		return reply(dnsRcodeFormErr, 0), nil
+	}
+
+	// the question, echoed in the response
+	var labels []string
+	end := dnsHeaderLen
+	for {
+		if end >= len(query) {
+			return reply(dnsRcodeFormErr, 0), nil
+		}
+		n := int(query[end])
+		end++
+		if n == 0 {
+			break
+		}
+		if n > 63 || end+n > len(query) {
+			return reply(dnsRcodeFormErr, 0), nil
+		}
+		labels = append(labels, string(query[end:end+n]))
+		end += n
+	}
+	if end+4 > len(query) {
+		return reply(dnsRcodeFormErr, 0), nil
+	}
+	qtype := binary.BigEndian.Uint16(query[end:])
+	qclass := binary.BigEndian.Uint16(query[end+2:])
+	end += 4
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	resp = append(resp, query[dnsHeaderLen:end]...)
+
+	s.mu.Lock()
+	records, ok := s.records[dnsName(strings.Join(labels, "."))]
+	s.mu.Unlock()
+	if !ok {
+		return reply(dnsRcodeNXDomain, 0), nil
+	}
+	if (qtype != dnsTypeSRV && qtype != dnsTypeANY) || (qclass != dnsClassIN && qclass != dnsTypeANY) {
+		return reply(0, 0), nil
+	}
+
+	for _, rec := range records {
+		target, err := encodeDNSName(rec.Target)
+		if err != nil {
+			return nil, err
+		}
+		rr := make([]byte, 18, 18+len(target))
+		binary.BigEndian.PutUint16(rr[0:], 0xc000|dnsHeaderLen) // the question's name
+		binary.BigEndian.PutUint16(rr[2:], dnsTypeSRV)
+		binary.BigEndian.PutUint16(rr[4:], dnsClassIN)
+		// TTL 0, so records added later aren't hidden by caches
+		binary.BigEndian.PutUint16(rr[10:], uint16(6+len(target)))
+		binary.BigEndian.PutUint16(rr[12:], uint16(rec.Priority))
+		binary.BigEndian.PutUint16(rr[14:], uint16(rec.Weight))
+		binary.BigEndian.PutUint16(rr[16:], uint16(rec.Port))
+		resp = append(append(resp, rr...), target...)
+	}
+	return reply(0, len(records)), nil
+}
+
+// Close stops serving.
+func (s *srvServer) Close() error {
+	return s.conn.Close()
+}
+
+// dnsName normalizes name for comparisons.
+func dnsName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// encodeDNSName encodes name as a sequence of labels.
+func encodeDNSName(name string) ([]byte, error) {
+	var buf []byte
+	if name = strings.TrimSuffix(name, "."); name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid DNS name %q", name)
+			}
+			buf = append(buf, byte(len(label)))
+			buf = append(buf, label...)
+		}
+	}
+	return append(buf, 0), nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// dnsQuery encodes a query for name of type qtype with the given ID.
+func dnsQuery(t *testing.T, id uint16, name string, qtype uint16) []byte {
+	q := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(q[0:], id)
+	binary.BigEndian.PutUint16(q[2:], dnsFlagRecursion)
+	binary.BigEndian.PutUint16(q[4:], 1)
+	encoded, err := encodeDNSName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q = append(q, encoded...)
+	return append(q, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+}
+
+// srvAnswers decodes the SRV records in resp to query as
+// "priority weight port target" strings.
+func srvAnswers(t *testing.T, query, resp []byte) (rcode int, answers []string) {
+	if len(resp) < len(query) || !bytes.Equal(resp[:2], query[:2]) || !bytes.Equal(resp[dnsHeaderLen:len(query)], query[dnsHeaderLen:]) {
+		t.Fatalf("response %x doesn't match query %x", resp, query)
+	}
+	flags := binary.BigEndian.Uint16(resp[2:])
+	if flags&dnsFlagResponse == 0 || flags&dnsFlagAuthoritative == 0 || flags&dnsFlagRecursion == 0 {
+		t.Errorf("got flags %#x", flags)
+	}
+
+	rr := resp[len(query):]
+	for i := 0; i < int(binary.BigEndian.Uint16(resp[6:])); i++ {
+		if len(rr) < 18 || binary.BigEndian.Uint16(rr[2:]) != dnsTypeSRV {
+			t.Fatalf("bad answer %x", rr)
+		}
+		end := 12 + int(binary.BigEndian.Uint16(rr[10:]))
+		var target []byte
+		for data := rr[18:end]; data[0] != 0; data = data[1+data[0]:] {
+			target = append(append(target, data[1:1+data[0]]...), '.')
+		}
+		answers = append(answers, fmt.Sprintf("%d %d %d %s",
+			binary.BigEndian.Uint16(rr[12:]), binary.BigEndian.Uint16(rr[14:]),
+			binary.BigEndian.Uint16(rr[16:]), target))
+		rr = rr[end:]
+	}
+	return int(flags & 0xf), answers
+}
+
+func TestSRVServer(t *testing.T) {
+	s, err := newSRVServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.add(SRVRecord{Name: "_etcd-server._tcp.br0.local", Target: "m1.br0.local", Port: 2380, Priority: 0, Weight: 10})
+	s.add(SRVRecord{Name: "_etcd-server._tcp.br0.local.", Target: "m2.br0.local", Port: 2380, Priority: 0, Weight: 20})
+	s.add(SRVRecord{Name: "_kola._tcp.br0.local", Target: "peer.br0.local", Port: 2379, Priority: 10, Weight: 20})
+	if names := s.names(); len(names) != 2 || names[0] != "_etcd-server._tcp.br0.local" {
+		t.Errorf("got names %q", names)
+	}
+
+	conn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", s.Port()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for i, tt := range []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers []string
+	}{
+		{"_etcd-server._tcp.br0.local", dnsTypeSRV, 0, []string{"0 10 2380 m1.br0.local.", "0 20 2380 m2.br0.local."}},
+		{"_KOLA._tcp.br0.local.", dnsTypeANY, 0, []string{"10 20 2379 peer.br0.local."}},
+		{"_kola._tcp.br0.local", 1, 0, nil},
+		{"_other._tcp.br0.local", dnsTypeSRV, dnsRcodeNXDomain, nil},
+	} {
+		query := dnsQuery(t, uint16(i+1), tt.name, tt.qtype)
+		if _, err := conn.Write(query); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 512)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rcode, answers := srvAnswers(t, query, buf[:n])
+		if rcode != tt.rcode || fmt.Sprint(answers) != fmt.Sprint(tt.answers) {
+			t.Errorf("%s type %d: got rcode %d answers %q, wanted %d %q", tt.name, tt.qtype, rcode, answers, tt.rcode, tt.answers)
+		}
+	}
+}
+
+func TestSRVServerMalformed(t *testing.T) {
+	s := &srvServer{records: make(map[string][]SRVRecord)}
+
+	if _, err := s.answer([]byte{1, 2, 3}); err == nil {
+		t.Errorf("expected an error for a truncated header")
+	}
+
+	// a question running past the end
+	query := dnsQuery(t, 1, "a.b", dnsTypeSRV)
+	resp, err := s.answer(query[:len(query)-3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcode := binary.BigEndian.Uint16(resp[2:]) & 0xf; rcode != dnsRcodeFormErr {
+		t.Errorf("got rcode %d, wanted FORMERR", rcode)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/coreos/mantle/network"
 	"github.com/coreos/mantle/platform"
 	"github.com/coreos/mantle/platform/api/aws"
 	"github.com/coreos/mantle/platform/conf"
@@ -28,6 +29,9 @@ import (
 type cluster struct {
 	*platform.BaseCluster
 	api *aws.API
+
+	// bastion is set if machines are reached through a jump host
+	bastion bool
 }
 
 // NewCluster creates an instance of a Cluster suitable for spawning
@@ -42,7 +46,18 @@ func NewCluster(opts *aws.Options, rconf *platform.RuntimeConfig) (platform.Clus
 		return nil, err
 	}
 
-	bc, err := platform.NewBaseCluster(opts.BaseName, rconf)
+	dialer, err := platform.NewDialer(opts.Options)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Bastion != "" {
+		dialer, err = network.NewJumpDialer(opts.Bastion, opts.BastionKey, opts.BastionKnownHosts, dialer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bc, err := platform.NewBaseClusterWithDialer(opts.BaseName, rconf, dialer)
 	if err != nil {
 		return nil, err
 	}
@@ -50,6 +65,7 @@ func NewCluster(opts *aws.Options, rconf *platform.RuntimeConfig) (platform.Clus
 	ac := &cluster{
 		BaseCluster: bc,
 		api:         api,
+		bastion:     opts.Bastion != "",
 	}
 
 	if !rconf.NoSSHKeyInMetadata {
@@ -101,6 +117,16 @@ func (ac *cluster) NewMachine(userdata *conf.UserData) (platform.Machine, error)
 		return nil, err
 	}
 
+	if ac.RuntimeConf().ConsoleHostKeys {
+		err := ac.ExpectConsoleHostKeys(mach.IP(), func() (string, error) {
+			return ac.api.GetConsoleOutput(mach.ID(), false)
+		})
+		if err != nil {
+			mach.Destroy()
+			return nil, err
+		}
+	}
+
 	if mach.journal, err = platform.NewJournal(mach.dir); err != nil {
 		mach.Destroy()
 		return nil, err
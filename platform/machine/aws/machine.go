@@ -37,7 +37,12 @@ func (am *machine) ID() string {
 	return *am.mach.InstanceId
 }
 
+// IP returns the address the machine is reached at, the private one if
+// the cluster goes through a bastion.
 func (am *machine) IP() string {
+	if am.mach.PublicIpAddress == nil || am.cluster.bastion {
+		return am.PrivateIP()
+	}
 	return *am.mach.PublicIpAddress
 }
 
@@ -57,6 +62,10 @@ func (am *machine) SSH(cmd string) ([]byte, error) {
 	return am.cluster.SSH(am, cmd)
 }
 
+func (am *machine) Exec(ctx context.Context, cmd string, opts *platform.ExecOptions) (*platform.ExecResult, error) {
+	return am.cluster.Exec(ctx, am, cmd, opts)
+}
+
 func (m *machine) Reboot() error {
 	if err := platform.StartReboot(m); err != nil {
 		return err
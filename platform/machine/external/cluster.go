@@ -0,0 +1,190 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package external
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/coreos/pkg/capnslog"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/coreos/mantle/platform"
+	"github.com/coreos/mantle/platform/conf"
+)
+
+var (
+	plog = capnslog.NewPackageLogger("github.com/coreos/mantle", "platform/machine/external")
+)
+
+// Options contains options for clusters of pre-provisioned machines.
+type Options struct {
+	*platform.Options
+
+	// Inventory is the path of the inventory file listing the
+	// machines, see Inventory.
+	Inventory string
+}
+
+type cluster struct {
+	*platform.BaseCluster
+	inv *Inventory
+
+	mu sync.Mutex
+	// acquired counts how often each host was handed out
+	acquired map[string]int
+}
+
+// NewCluster creates a Cluster handing out the existing machines listed
+// in the inventory file instead of creating new ones.
+func NewCluster(opts *Options, rconf *platform.RuntimeConfig) (platform.Cluster, error) {
+	if opts.Inventory == "" {
+		return nil, fmt.Errorf("no inventory file given for external machines")
+	}
+	inv, err := LoadInventory(opts.Inventory)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer, err := platform.NewDialer(opts.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	bc, err := platform.NewBaseClusterWithDialer(opts.BaseName, rconf, dialer)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, h := range inv.Hosts {
+		if h.Key == "" {
+			continue
+		}
+		pem, err := ioutil.ReadFile(h.Key)
+		if err != nil {
+			bc.Destroy()
+			return nil, err
+		}
+		key, err := ssh.ParseRawPrivateKey(pem)
+		if err != nil {
+			bc.Destroy()
+			return nil, fmt.Errorf("parsing key for host %s: %v", h.Name, err)
+		}
+		if err := bc.AddKey(key, h.Key); err != nil {
+			bc.Destroy()
+			return nil, err
+		}
+	}
+
+	ec := &cluster{
+		BaseCluster: bc,
+		inv:         inv,
+		acquired:    make(map[string]int),
+	}
+
+	return ec, nil
+}
+
+// NewMachine hands out a free host from the inventory, after running
+// the provision hook with the path of the rendered userdata in
+// $KOLA_USERDATA. Without a provision hook, only tests without userdata
+// can get machines.
+func (ec *cluster) NewMachine(userdata *conf.UserData) (platform.Machine, error) {
+	// the test would run on a host its config was never applied to
+	if userdata != nil && ec.inv.Provision == "" {
+		return nil, fmt.Errorf("inventory has no provision hook to apply userdata with")
+	}
+
+	host, err := ec.inv.acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	// a test may get the same host again after destroying it
+	ec.mu.Lock()
+	ec.acquired[host.Name]++
+	n := ec.acquired[host.Name]
+	ec.mu.Unlock()
+
+	mach := &machine{
+		cluster: ec,
+		host:    host,
+		id:      fmt.Sprintf("%s-%d", host.Name, n),
+	}
+
+	conf, err := ec.RenderUserData(userdata, map[string]string{
+		"$public_ipv4":  addrHost(host.Address),
+		"$private_ipv4": addrHost(host.PrivateAddress),
+	})
+	if err != nil {
+		ec.inv.release(host)
+		return nil, err
+	}
+
+	mach.dir = filepath.Join(ec.RuntimeConf().OutputDir, mach.ID())
+	if err := os.Mkdir(mach.dir, 0777); err != nil {
+		ec.inv.release(host)
+		return nil, err
+	}
+
+	confPath := filepath.Join(mach.dir, "user-data")
+	if err := conf.WriteFile(confPath); err != nil {
+		ec.inv.release(host)
+		return nil, err
+	}
+
+	if err := ec.inv.runHook(ec.inv.Provision, host, "KOLA_USERDATA="+confPath); err != nil {
+		mach.Destroy()
+		return nil, err
+	}
+
+	if mach.journal, err = platform.NewJournal(mach.dir); err != nil {
+		mach.Destroy()
+		return nil, err
+	}
+
+	if err := mach.journal.Start(context.TODO(), mach); err != nil {
+		mach.Destroy()
+		return nil, err
+	}
+
+	if err := platform.CheckMachine(mach); err != nil {
+		mach.Destroy()
+		return nil, fmt.Errorf("machine %q failed basic checks: %v", mach.ID(), err)
+	}
+
+	if err := platform.EnableSelinux(mach); err != nil {
+		mach.Destroy()
+		return nil, err
+	}
+
+	ec.AddMach(mach)
+
+	return mach, nil
+}
+
+// addrHost returns the host part of addr, which may include a port.
+func addrHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
@@ -0,0 +1,164 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package external
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// Inventory lists the pre-provisioned machines an external cluster
+// may use. It is read from a JSON file like:
+//
+//	{
+//	  "hosts": [
+//	    {"name": "lab1", "address": "192.0.2.10", "user": "core", "key": "lab.pem"}
+//	  ],
+//	  "provision": "./reinstall.sh",
+//	  "cleanup": "./wipe.sh"
+//	}
+//
+// Relative paths are relative to the inventory file.
+type Inventory struct {
+	Hosts []Host `json:"hosts"`
+
+	// Provision, if set, is a shell command run before a host is
+	// handed out, e.g. to reinstall it with the test's user data.
+	Provision string `json:"provision"`
+
+	// Cleanup, if set, is a shell command run when a host is
+	// released.
+	Cleanup string `json:"cleanup"`
+
+	dir string
+}
+
+// Host is a machine in an Inventory.
+type Host struct {
+	// Name identifies the host; it must be unique.
+	Name string `json:"name"`
+
+	// Address is the host's public address, as host[:port].
+	Address string `json:"address"`
+
+	// PrivateAddress, if set, is the host's address on the network
+	// shared with the other hosts.
+	PrivateAddress string `json:"private_address"`
+
+	// User is the user to log in as. Defaults to core.
+	User string `json:"user"`
+
+	// Key is a private key file to log in with. Without it, the host
+	// must accept the cluster's generated key, e.g. after Provision
+	// installed the user data including it.
+	Key string `json:"key"`
+}
+
+// LoadInventory reads an Inventory from path.
+func LoadInventory(path string) (*Inventory, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	inv := &Inventory{
+		dir: filepath.Dir(path),
+	}
+	if err := json.Unmarshal(data, inv); err != nil {
+		return nil, fmt.Errorf("parsing inventory %s: %v", path, err)
+	}
+
+	names := make(map[string]bool)
+	for i := range inv.Hosts {
+		h := &inv.Hosts[i]
+		if h.Name == "" || h.Address == "" {
+			return nil, fmt.Errorf("inventory %s: host %d needs a name and address", path, i)
+		}
+		if names[h.Name] {
+			return nil, fmt.Errorf("inventory %s: duplicate host %q", path, h.Name)
+		}
+		names[h.Name] = true
+
+		if h.User == "" {
+			h.User = "core"
+		}
+		if h.PrivateAddress == "" {
+			h.PrivateAddress = h.Address
+		}
+		if h.Key != "" && !filepath.IsAbs(h.Key) {
+			h.Key = filepath.Join(inv.dir, h.Key)
+		}
+	}
+	if len(inv.Hosts) == 0 {
+		return nil, fmt.Errorf("inventory %s lists no hosts", path)
+	}
+
+	return inv, nil
+}
+
+// runHook runs hook, if set, for host with the given extra environment.
+func (inv *Inventory) runHook(hook string, h *Host, env ...string) error {
+	if hook == "" {
+		return nil
+	}
+
+	cmd := exec.Command("sh", "-c", hook)
+	cmd.Dir = inv.dir
+	cmd.Env = append(os.Environ(),
+		"KOLA_HOST="+h.Name,
+		"KOLA_ADDRESS="+h.Address,
+		"KOLA_PRIVATE_ADDRESS="+h.PrivateAddress,
+		"KOLA_USER="+h.User)
+	cmd.Env = append(cmd.Env, env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%q for host %s failed: %v: %s", hook, h.Name, err, out)
+	}
+	return nil
+}
+
+// hosts in use by any cluster, by inventory directory and name, so
+// parallel tests don't share them
+var (
+	inUseMu sync.Mutex
+	inUse   = make(map[string]bool)
+)
+
+// acquire claims a free host.
+func (inv *Inventory) acquire() (*Host, error) {
+	inUseMu.Lock()
+	defer inUseMu.Unlock()
+
+	for i := range inv.Hosts {
+		key := filepath.Join(inv.dir, inv.Hosts[i].Name)
+		if !inUse[key] {
+			inUse[key] = true
+			return &inv.Hosts[i], nil
+		}
+	}
+	return nil, fmt.Errorf("all %d inventory hosts are in use", len(inv.Hosts))
+}
+
+// release frees a host claimed by acquire.
+func (inv *Inventory) release(h *Host) {
+	inUseMu.Lock()
+	defer inUseMu.Unlock()
+	delete(inUse, filepath.Join(inv.dir, h.Name))
+}
@@ -0,0 +1,150 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package external
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeInventory(t *testing.T, data string) (string, func()) {
+	dir, err := ioutil.TempDir("", "kola-inventory-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "inventory.json")
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadInventory(t *testing.T) {
+	path, cleanup := writeInventory(t, `{
+  "hosts": [
+    {"name": "a", "address": "192.0.2.1", "key": "lab.pem"},
+    {"name": "b", "address": "192.0.2.2", "private_address": "10.0.0.2", "user": "admin", "key": "/keys/b.pem"}
+  ],
+  "provision": "./reinstall.sh"
+}`)
+	defer cleanup()
+
+	inv, err := LoadInventory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inv.Hosts) != 2 {
+		t.Fatalf("got %d hosts, wanted 2", len(inv.Hosts))
+	}
+
+	a, b := inv.Hosts[0], inv.Hosts[1]
+	if a.User != "core" {
+		t.Errorf("got default user %q, wanted core", a.User)
+	}
+	if a.PrivateAddress != "192.0.2.1" {
+		t.Errorf("got default private address %q, wanted the public one", a.PrivateAddress)
+	}
+	if expect := filepath.Join(filepath.Dir(path), "lab.pem"); a.Key != expect {
+		t.Errorf("got relative key %q, wanted %q", a.Key, expect)
+	}
+	if b.User != "admin" || b.PrivateAddress != "10.0.0.2" || b.Key != "/keys/b.pem" {
+		t.Errorf("explicit settings changed: %+v", b)
+	}
+	if inv.Provision != "./reinstall.sh" || inv.dir != filepath.Dir(path) {
+		t.Errorf("got provision %q in %q", inv.Provision, inv.dir)
+	}
+}
+
+func TestLoadInventoryInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		desc string
+		data string
+	}{
+		{"no hosts", `{"hosts": []}`},
+		{"missing name", `{"hosts": [{"address": "192.0.2.1"}]}`},
+		{"missing address", `{"hosts": [{"name": "a"}]}`},
+		{"duplicate", `{"hosts": [{"name": "a", "address": "192.0.2.1"}, {"name": "a", "address": "192.0.2.2"}]}`},
+		{"not json", `hosts: []`},
+	} {
+		path, cleanup := writeInventory(t, tt.data)
+		if _, err := LoadInventory(path); err == nil {
+			t.Errorf("%s: expected an error", tt.desc)
+		}
+		cleanup()
+	}
+}
+
+func TestAcquireRelease(t *testing.T) {
+	inv := &Inventory{
+		Hosts: []Host{{Name: "a"}, {Name: "b"}},
+		dir:   "/inventory",
+	}
+	// another inventory's hosts of the same name are distinct
+	other := &Inventory{
+		Hosts: []Host{{Name: "a"}},
+		dir:   "/other",
+	}
+
+	h1, err := inv.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := inv.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h1.Name == h2.Name {
+		t.Fatalf("host %s handed out twice", h1.Name)
+	}
+	if _, err := inv.acquire(); err == nil {
+		t.Fatal("expected an error with all hosts in use")
+	}
+
+	h3, err := other.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.release(h3)
+
+	inv.release(h1)
+	h4, err := inv.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h4.Name != h1.Name {
+		t.Errorf("got host %s, wanted released host %s", h4.Name, h1.Name)
+	}
+	inv.release(h2)
+	inv.release(h4)
+}
+
+func TestAddrHost(t *testing.T) {
+	for addr, expect := range map[string]string{
+		"192.0.2.10":       "192.0.2.10",
+		"192.0.2.10:2222":  "192.0.2.10",
+		"lab1.example.com": "lab1.example.com",
+		"lab1:22":          "lab1",
+		"fd00::1":          "fd00::1",
+		"[fd00::1]":        "fd00::1",
+		"[fd00::1]:2222":   "fd00::1",
+	} {
+		if host := addrHost(addr); host != expect {
+			t.Errorf("addrHost(%q) = %q, expected %q", addr, host, expect)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package external
+
+import (
+	"context"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/coreos/mantle/platform"
+)
+
+type machine struct {
+	cluster *cluster
+	host    *Host
+	id      string
+	dir     string
+	journal *platform.Journal
+}
+
+// ID returns the host's name, numbered by how many times the cluster
+// has handed out the host.
+func (em *machine) ID() string {
+	return em.id
+}
+
+func (em *machine) IP() string {
+	return addrHost(em.host.Address)
+}
+
+func (em *machine) PrivateIP() string {
+	return addrHost(em.host.PrivateAddress)
+}
+
+func (em *machine) SSHClient() (*ssh.Client, error) {
+	return em.cluster.UserSSHClient(em.host.Address, em.host.User)
+}
+
+func (em *machine) PasswordSSHClient(user string, password string) (*ssh.Client, error) {
+	return em.cluster.PasswordSSHClient(em.host.Address, user, password)
+}
+
+func (em *machine) SSH(cmd string) ([]byte, error) {
+	return em.cluster.SSH(em, cmd)
+}
+
+func (em *machine) Exec(ctx context.Context, cmd string, opts *platform.ExecOptions) (*platform.ExecResult, error) {
+	return em.cluster.Exec(ctx, em, cmd, opts)
+}
+
+func (em *machine) Reboot() error {
+	if err := platform.StartReboot(em); err != nil {
+		return err
+	}
+	if err := em.journal.Start(context.TODO(), em); err != nil {
+		return err
+	}
+	if err := platform.CheckMachine(em); err != nil {
+		return err
+	}
+	if err := platform.EnableSelinux(em); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Destroy runs the cleanup hook and returns the host to the inventory.
+// The host itself keeps running.
+func (em *machine) Destroy() error {
+	if em.journal != nil {
+		if err := em.journal.Destroy(); err != nil {
+			plog.Errorf("stopping journal of %s: %v", em.ID(), err)
+		}
+	}
+
+	em.cluster.DelMach(em)
+	// provisioning the host again may give it new keys
+	if err := em.cluster.HostKeys().Forget(em.host.Address); err != nil {
+		plog.Warningf("forgetting host key of %s: %v", em.ID(), err)
+	}
+
+	defer em.cluster.inv.release(em.host)
+	return em.cluster.inv.runHook(em.cluster.inv.Cleanup, em.host)
+}
+
+// ConsoleOutput returns nothing; there is no access to the consoles of
+// external machines.
+func (em *machine) ConsoleOutput() string {
+	return ""
+}
@@ -24,6 +24,7 @@ import (
 
 	"github.com/coreos/pkg/capnslog"
 
+	"github.com/coreos/mantle/network"
 	"github.com/coreos/mantle/platform"
 	"github.com/coreos/mantle/platform/api/gcloud"
 	"github.com/coreos/mantle/platform/conf"
@@ -44,7 +45,18 @@ func NewCluster(opts *gcloud.Options, rconf *platform.RuntimeConfig) (platform.C
 		return nil, err
 	}
 
-	bc, err := platform.NewBaseCluster(opts.BaseName, rconf)
+	dialer, err := platform.NewDialer(opts.Options)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Bastion != "" {
+		dialer, err = network.NewJumpDialer(opts.Bastion, opts.BastionKey, opts.BastionKnownHosts, dialer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bc, err := platform.NewBaseClusterWithDialer(opts.BaseName, rconf, dialer)
 	if err != nil {
 		return nil, err
 	}
@@ -101,6 +113,16 @@ func (gc *cluster) NewMachine(userdata *conf.UserData) (platform.Machine, error)
 		return nil, err
 	}
 
+	if gc.RuntimeConf().ConsoleHostKeys {
+		err := gc.ExpectConsoleHostKeys(gm.IP(), func() (string, error) {
+			return gc.api.GetConsoleOutput(gm.name)
+		})
+		if err != nil {
+			gm.Destroy()
+			return nil, err
+		}
+	}
+
 	if gm.journal, err = platform.NewJournal(gm.dir); err != nil {
 		gm.Destroy()
 		return nil, err
@@ -24,7 +24,12 @@ func (gm *machine) ID() string {
 	return gm.name
 }
 
+// IP returns the address the machine is reached at, the internal one
+// if it has no external one because the cluster goes through a bastion.
 func (gm *machine) IP() string {
+	if gm.extIP == "" {
+		return gm.intIP
+	}
 	return gm.extIP
 }
 
@@ -44,6 +49,10 @@ func (gm *machine) SSH(cmd string) ([]byte, error) {
 	return gm.gc.SSH(gm, cmd)
 }
 
+func (gm *machine) Exec(ctx context.Context, cmd string, opts *platform.ExecOptions) (*platform.ExecResult, error) {
+	return gm.gc.Exec(ctx, gm, cmd, opts)
+}
+
 func (m *machine) Reboot() error {
 	if err := platform.StartReboot(m); err != nil {
 		return err
@@ -0,0 +1,338 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nspawn runs machines as systemd-nspawn containers booting the
+// USR partition of a disk image, for tests that only exercise userspace.
+// Each container has its own network namespace, connected to the
+// cluster's bridge like QEMU machines. There is no kernel, initramfs or
+// Ignition of the machine's own, so only cloud-configs and scripts are
+// applied as userdata.
+package nspawn
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/pkg/capnslog"
+	"github.com/satori/go.uuid"
+
+	"github.com/coreos/mantle/platform"
+	"github.com/coreos/mantle/platform/conf"
+	"github.com/coreos/mantle/platform/local"
+	"github.com/coreos/mantle/platform/machine/qemu"
+	"github.com/coreos/mantle/system/exec"
+	"github.com/coreos/mantle/system/ns"
+	"github.com/coreos/mantle/util"
+)
+
+// usrPartition is the number of the disk image partition holding /usr.
+const usrPartition = 3
+
+type Cluster struct {
+	*local.LocalCluster
+	opts *qemu.Options
+
+	mu sync.Mutex
+
+	// loop is the cluster's own loop device for the disk image, so
+	// tearing down its partitions leaves other clusters' alone
+	loop string
+
+	// usr is where the image's USR partition is mounted, to be
+	// bind mounted read-only into each container
+	usr string
+}
+
+var (
+	plog = capnslog.NewPackageLogger("github.com/coreos/mantle", "kola/platform/machine/nspawn")
+)
+
+// NewCluster creates a Cluster instance, suitable for running containers
+// from the disk image in opts. Only the options for booting from disk
+// apply.
+func NewCluster(opts *qemu.Options, rconf *platform.RuntimeConfig) (platform.Cluster, error) {
+	if opts.BootMode != "" && opts.BootMode != qemu.BootDisk {
+		return nil, fmt.Errorf("boot mode %q requires the qemu platform", opts.BootMode)
+	}
+	if opts.TPM {
+		return nil, fmt.Errorf("TPMs require the qemu platform")
+	}
+
+	lc, err := local.NewLocalCluster(opts.BaseName, &local.Options{
+		IPMode: opts.IPMode,
+
+		RegistryArchives: opts.RegistryArchives,
+		EtcdMembers:      opts.EtcdMembers,
+	}, rconf)
+	if err != nil {
+		return nil, err
+	}
+
+	nc := &Cluster{
+		LocalCluster: lc,
+		opts:         opts,
+	}
+
+	if err := nc.mountUsr(); err != nil {
+		lc.Destroy()
+		return nil, err
+	}
+
+	return nc, nil
+}
+
+// mountUsr mounts the USR partition of the disk image read-only.
+func (nc *Cluster) mountUsr() error {
+	out, err := exec.Command("losetup", "--find", "--show", "--read-only", nc.opts.DiskImage).Output()
+	if err != nil {
+		return fmt.Errorf("attaching %s to a loop device: %v", nc.opts.DiskImage, err)
+	}
+	nc.loop = strings.TrimSpace(string(out))
+
+	if err := exec.Command("kpartx", "-avr", nc.loop).Run(); err != nil {
+		nc.removePartitions()
+		return fmt.Errorf("setting up partitions of %s: %v", nc.opts.DiskImage, err)
+	}
+	mapperNode := fmt.Sprintf("/dev/mapper/%sp%d", filepath.Base(nc.loop), usrPartition)
+
+	err = util.Retry(1000, 5*time.Millisecond, func() error {
+		if _, err := os.Stat(mapperNode); !os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("timed out waiting for device node")
+	})
+	if err != nil {
+		nc.removePartitions()
+		return err
+	}
+
+	nc.usr, err = ioutil.TempDir("", "kola-nspawn-usr-")
+	if err != nil {
+		nc.removePartitions()
+		return fmt.Errorf("making temporary directory: %v", err)
+	}
+
+	if err := exec.Command("mount", "-o", "ro", mapperNode, nc.usr).Run(); err != nil {
+		os.Remove(nc.usr)
+		nc.removePartitions()
+		return fmt.Errorf("mounting USR partition %s on %s: %v", mapperNode, nc.usr, err)
+	}
+
+	return nil
+}
+
+// removePartitions tears down the partitions of the cluster's loop
+// device and detaches it.
+func (nc *Cluster) removePartitions() error {
+	var err error
+	if err2 := exec.Command("kpartx", "-d", nc.loop).Run(); err2 != nil {
+		err = fmt.Errorf("tearing down partitions of %s: %v", nc.loop, err2)
+	}
+	if err2 := exec.Command("losetup", "--detach", nc.loop).Run(); err == nil && err2 != nil {
+		err = fmt.Errorf("detaching %s: %v", nc.loop, err2)
+	}
+	return err
+}
+
+func (nc *Cluster) NewMachine(userdata *conf.UserData) (platform.Machine, error) {
+	id := uuid.NewV4()
+
+	// hacky solution for cloud config ip substitution
+	// NOTE: escaping is not supported
+	nc.mu.Lock()
+	netif := nc.Dnsmasq.GetInterface("br0")
+	ip := netif.IP().String()
+
+	conf, err := nc.RenderUserData(userdata, map[string]string{
+		"$public_ipv4":  ip,
+		"$private_ipv4": ip,
+	})
+	nc.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// the default config is Ignition too, but only carries SSH keys
+	if userdata != nil && conf.IsIgnition() {
+		return nil, fmt.Errorf("Ignition configs can't be applied to nspawn containers")
+	}
+
+	dir := filepath.Join(nc.RuntimeConf().OutputDir, id.String())
+	if err := os.Mkdir(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	journal, err := platform.NewJournal(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	nm := &machine{
+		nc:          nc,
+		id:          id.String(),
+		netif:       netif,
+		journal:     journal,
+		root:        filepath.Join(dir, "rootfs"),
+		consolePath: filepath.Join(dir, "console.txt"),
+	}
+
+	if err := nc.setupRoot(nm.root, conf); err != nil {
+		os.RemoveAll(nm.root)
+		return nil, err
+	}
+
+	iface, err := nc.NewVeth("br0", netif.HardwareAddr)
+	if err != nil {
+		os.RemoveAll(nm.root)
+		return nil, err
+	}
+
+	console, err := os.Create(nm.consolePath)
+	if err != nil {
+		nc.RemoveVeth(iface)
+		os.RemoveAll(nm.root)
+		return nil, err
+	}
+	defer console.Close()
+
+	nspawnCmd := []string{"systemd-nspawn",
+		"--quiet",
+		"--boot",
+		"--register=no",
+		"--machine=" + nm.id,
+		"--directory=" + nm.root,
+		"--bind-ro=" + nc.usr + ":/usr",
+		"--network-interface=" + iface,
+	}
+
+	plog.Debugf("NewMachine: %q", nspawnCmd)
+
+	// started in the cluster's network namespace, where the veth is
+	nm.nspawn = nc.NewCommand(nspawnCmd[0], nspawnCmd[1:]...).(*ns.Cmd)
+	nm.nspawn.Stdout = console
+	nm.nspawn.Stderr = console
+
+	// once started, the container owns the veth, which goes away
+	// with it
+	if err := nm.nspawn.Start(); err != nil {
+		nc.RemoveVeth(iface)
+		os.RemoveAll(nm.root)
+		return nil, err
+	}
+
+	if err := nc.Dnsmasq.AddHost(nm.hostname(), nm.addrs()...); err != nil {
+		nm.Destroy()
+		return nil, err
+	}
+
+	if err := nm.journal.Start(context.TODO(), nm); err != nil {
+		nm.Destroy()
+		return nil, err
+	}
+
+	if err := platform.CheckMachine(nm); err != nil {
+		nm.Destroy()
+		return nil, err
+	}
+
+	// SELinux can't be enforced in just a container, so unlike the
+	// other platforms it is left as the host has it.
+
+	nc.AddMach(nm)
+
+	return nm, nil
+}
+
+// setupRoot creates the writable root directory of a container, which
+// systemd populates on first boot like a freshly installed root
+// filesystem. Userdata is left where coreos-cloudinit looks for it, and
+// the cluster's SSH keys are authorized for core since Ignition doesn't
+// run in containers.
+func (nc *Cluster) setupRoot(root string, conf *conf.Conf) error {
+	for _, dir := range []string{"etc", "var/lib/coreos-install", "home/core/.ssh"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return err
+		}
+	}
+
+	for _, link := range []string{"bin", "sbin", "lib", "lib64"} {
+		if err := os.Symlink(filepath.Join("usr", link), filepath.Join(root, link)); err != nil {
+			return err
+		}
+	}
+
+	// systemd-nspawn looks for os-release before /usr is mounted
+	osRelease, err := ioutil.ReadFile(filepath.Join(nc.usr, "lib/os-release"))
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "etc/os-release"), osRelease, 0644); err != nil {
+		return err
+	}
+
+	if !conf.IsIgnition() && conf.String() != "" {
+		if err := conf.WriteFile(filepath.Join(root, "var/lib/coreos-install/user_data")); err != nil {
+			return err
+		}
+	}
+
+	if !nc.RuntimeConf().NoSSHKeyInUserData {
+		keys, err := nc.Keys()
+		if err != nil {
+			return err
+		}
+		var authorized []byte
+		for _, key := range keys {
+			authorized = append(authorized, key.String()+"\n"...)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, "home/core/.ssh/authorized_keys"), authorized, 0600); err != nil {
+			return err
+		}
+	}
+
+	// core's UID and GID in the image
+	for _, path := range []string{"home/core", "home/core/.ssh", "home/core/.ssh/authorized_keys"} {
+		if err := os.Lchown(filepath.Join(root, path), 500, 500); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Destroy destroys the containers and the rest of the cluster, then
+// unmounts the USR partition.
+func (nc *Cluster) Destroy() error {
+	err := nc.LocalCluster.Destroy()
+
+	if err2 := exec.Command("umount", nc.usr).Run(); err2 != nil {
+		if err == nil {
+			err = fmt.Errorf("unmounting %s: %v", nc.usr, err2)
+		}
+		return err
+	}
+	if err2 := os.Remove(nc.usr); err == nil && err2 != nil {
+		err = err2
+	}
+	if err2 := nc.removePartitions(); err == nil && err2 != nil {
+		err = err2
+	}
+	return err
+}
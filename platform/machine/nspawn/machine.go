@@ -0,0 +1,155 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nspawn
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/coreos/mantle/platform"
+	"github.com/coreos/mantle/platform/local"
+	"github.com/coreos/mantle/system/ns"
+)
+
+// stopTimeout is how long a container may take to power off before it
+// is killed.
+const stopTimeout = 30 * time.Second
+
+type machine struct {
+	nc          *Cluster
+	id          string
+	nspawn      *ns.Cmd
+	netif       *local.Interface
+	journal     *platform.Journal
+	root        string
+	consolePath string
+	console     string
+}
+
+func (m *machine) ID() string {
+	return m.id
+}
+
+func (m *machine) IP() string {
+	return m.netif.IP().String()
+}
+
+func (m *machine) PrivateIP() string {
+	return m.netif.IP().String()
+}
+
+// hostname returns the name the machine's addresses are registered
+// under in the cluster's DNS.
+func (m *machine) hostname() string {
+	return m.id + ".br0.local"
+}
+
+func (m *machine) addrs() []net.IP {
+	var ips []net.IP
+	for _, addr := range m.netif.DHCPv4 {
+		ips = append(ips, addr.IP)
+	}
+	for _, addr := range m.netif.DHCPv6 {
+		ips = append(ips, addr.IP)
+	}
+	return ips
+}
+
+func (m *machine) SSHClient() (*ssh.Client, error) {
+	return m.nc.SSHClient(m.IP())
+}
+
+func (m *machine) PasswordSSHClient(user string, password string) (*ssh.Client, error) {
+	return m.nc.PasswordSSHClient(m.IP(), user, password)
+}
+
+func (m *machine) SSH(cmd string) ([]byte, error) {
+	return m.nc.SSH(m, cmd)
+}
+
+func (m *machine) Exec(ctx context.Context, cmd string, opts *platform.ExecOptions) (*platform.ExecResult, error) {
+	return m.nc.Exec(ctx, m, cmd, opts)
+}
+
+// Reboot isn't supported; systemd-nspawn exits when its container
+// reboots, and tests that reboot aren't container-safe anyway.
+func (m *machine) Reboot() error {
+	return fmt.Errorf("nspawn containers can't be rebooted")
+}
+
+// Destroy powers off the container, killing it if that takes too long,
+// and removes its root directory.
+func (m *machine) Destroy() error {
+	err := m.stop()
+	if err2 := m.journal.Destroy(); err == nil && err2 != nil {
+		err = err2
+	}
+
+	buf, err2 := ioutil.ReadFile(m.consolePath)
+	if err2 == nil {
+		m.console = string(buf)
+	} else if err == nil {
+		err = err2
+	}
+
+	if err2 := os.RemoveAll(m.root); err == nil && err2 != nil {
+		err = err2
+	}
+
+	if err2 := m.nc.Dnsmasq.RemoveHost(m.hostname()); err == nil && err2 != nil {
+		err = err2
+	}
+
+	m.nc.DelMach(m)
+
+	return err
+}
+
+// stop asks systemd-nspawn to power off the container, which it does on
+// SIGTERM, and waits for it to exit.
+func (m *machine) stop() error {
+	done := make(chan error, 1)
+	go func() {
+		done <- m.nspawn.Wait()
+	}()
+
+	if err := m.nspawn.Process.Signal(syscall.SIGTERM); err != nil {
+		return m.nspawn.Process.Kill()
+	}
+
+	select {
+	case <-done:
+		// the exit status says how the container's init exited
+		return nil
+	case <-time.After(stopTimeout):
+		plog.Warningf("killing container %s after it didn't power off in %v", m.id, stopTimeout)
+		if err := m.nspawn.Process.Kill(); err != nil {
+			return err
+		}
+		<-done
+		return nil
+	}
+}
+
+func (m *machine) ConsoleOutput() string {
+	return m.console
+}
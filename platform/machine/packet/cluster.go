@@ -44,7 +44,12 @@ func NewCluster(opts *packet.Options, rconf *platform.RuntimeConfig) (platform.C
 		return nil, err
 	}
 
-	bc, err := platform.NewBaseCluster(opts.BaseName, rconf)
+	dialer, err := platform.NewDialer(opts.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	bc, err := platform.NewBaseClusterWithDialer(opts.BaseName, rconf, dialer)
 	if err != nil {
 		return nil, err
 	}
@@ -57,6 +57,10 @@ func (pm *machine) SSH(cmd string) ([]byte, error) {
 	return pm.cluster.SSH(pm, cmd)
 }
 
+func (pm *machine) Exec(ctx context.Context, cmd string, opts *platform.ExecOptions) (*platform.ExecResult, error) {
+	return pm.cluster.Exec(ctx, pm, cmd, opts)
+}
+
 func (m *machine) Reboot() error {
 	if err := platform.StartReboot(m); err != nil {
 		return err
@@ -0,0 +1,177 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// BoardConfig describes how to emulate the machines of a board.
+type BoardConfig struct {
+	// Arch is the GOARCH of hosts that can run the board with KVM.
+	// Other hosts emulate it with TCG.
+	Arch string
+
+	// Binary is the QEMU system emulator for the board.
+	Binary string
+
+	// Machine is the QEMU machine type. SecureBootMachine replaces it
+	// when Secure Boot is enforced, if the board needs a different one.
+	Machine           string
+	SecureBootMachine string
+
+	// KVMCPU and TCGCPU are the CPU models used with each accelerator.
+	KVMCPU string
+	TCGCPU string
+
+	// VirtioSuffix is appended to virtio device names, e.g. "pci".
+	VirtioSuffix string
+
+	// Console is the kernel's name for the first serial port.
+	Console string
+
+	// TPMDevice is the device model of emulated TPMs.
+	TPMDevice string
+
+	// SecurePflash restricts writes to the UEFI variable store to SMM
+	// when Secure Boot is enforced.
+	SecurePflash bool
+
+	// HotplugNIC is set if NICs can be added to running machines,
+	// which restoring them from snapshots requires.
+	HotplugNIC bool
+
+	// BIOS is the default image passed via -bios, looked up by QEMU in
+	// its data directory. ImageBIOS, if set, is used instead, from the
+	// board's image directory.
+	BIOS      string
+	ImageBIOS string
+
+	// UEFICode and UEFIVars are the default UEFI firmware images in
+	// the board's image directory, by firmware mode.
+	UEFICode map[string]string
+	UEFIVars map[string]string
+}
+
+// UEFI firmware images produced by the qemu_uefi and qemu_uefi_secure
+// image formats.
+var (
+	coreosUEFICode = map[string]string{
+		FirmwareUEFI:       "coreos_production_qemu_uefi_efi_code.fd",
+		FirmwareUEFISecure: "coreos_production_qemu_uefi_secure_efi_code.fd",
+	}
+	coreosUEFIVars = map[string]string{
+		FirmwareUEFI:       "coreos_production_qemu_uefi_efi_vars.fd",
+		FirmwareUEFISecure: "coreos_production_qemu_uefi_secure_efi_vars.fd",
+	}
+)
+
+// Boards holds the configuration of each supported board. New boards
+// only need an entry here.
+var Boards = map[string]*BoardConfig{
+	"amd64-usr": {
+		Arch:   "amd64",
+		Binary: "qemu-system-x86_64",
+		// Secure Boot on x86 needs SMM, which requires q35
+		Machine:           "pc",
+		SecureBootMachine: "q35,smm=on",
+		KVMCPU:            "host",
+		TCGCPU:            "qemu64",
+		VirtioSuffix:      "pci",
+		Console:           "ttyS0",
+		TPMDevice:         "tpm-tis",
+		SecurePflash:      true,
+		HotplugNIC:        true,
+		BIOS:              "bios-256k.bin",
+		UEFICode:          coreosUEFICode,
+		UEFIVars:          coreosUEFIVars,
+	},
+	"arm64-usr": {
+		Arch:         "arm64",
+		Binary:       "qemu-system-aarch64",
+		Machine:      "virt",
+		KVMCPU:       "host",
+		TCGCPU:       "cortex-a57",
+		VirtioSuffix: "device",
+		Console:      "ttyAMA0",
+		TPMDevice:    "tpm-tis-device",
+		// there is no BIOS, so -bios loads UEFI
+		ImageBIOS: "coreos_production_qemu_uefi_efi_code.fd",
+		UEFICode:  coreosUEFICode,
+		UEFIVars:  coreosUEFIVars,
+	},
+}
+
+var (
+	kvmOnce      sync.Once
+	kvmAvailable bool
+
+	// hasKVM is replaced in tests.
+	hasKVM = detectKVM
+)
+
+// detectKVM reports whether this host can run virtual machines with KVM.
+func detectKVM() bool {
+	kvmOnce.Do(func() {
+		f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+		if err != nil {
+			plog.Warningf("KVM unavailable, falling back to TCG: %v", err)
+			return
+		}
+		f.Close()
+		kvmAvailable = true
+	})
+	return kvmAvailable
+}
+
+// useKVM reports whether the board runs natively on this host.
+func (b *BoardConfig) useKVM() bool {
+	return b.Arch == runtime.GOARCH && hasKVM()
+}
+
+// board returns the configuration of the cluster's board.
+func (o *Options) board() (*BoardConfig, error) {
+	b, ok := Boards[o.Board]
+	if !ok {
+		return nil, fmt.Errorf("unsupported board %q", o.Board)
+	}
+	return b, nil
+}
+
+// accelArgs returns the QEMU arguments selecting the machine type, the
+// accelerator and the CPU model. KVM is used when the host can run the
+// board natively, TCG otherwise.
+func (o *Options) accelArgs(b *BoardConfig) []string {
+	machine := b.Machine
+	if o.IsSecureBoot() && b.SecureBootMachine != "" {
+		machine = b.SecureBootMachine
+	}
+
+	if b.useKVM() {
+		return []string{
+			"-machine", machine + ",accel=kvm",
+			"-cpu", b.KVMCPU,
+		}
+	}
+
+	plog.Debugf("Emulating %s with TCG", o.Board)
+	return []string{
+		"-machine", machine + ",accel=tcg",
+		"-cpu", b.TCGCPU,
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemu
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestBoardLookup(t *testing.T) {
+	for name, b := range Boards {
+		o := &Options{Board: name}
+		got, err := o.board()
+		if err != nil {
+			t.Errorf("board %s: %v", name, err)
+			continue
+		}
+		if got != b {
+			t.Errorf("board %s: got the config of another board", name)
+		}
+		if b.Arch == "" || b.Binary == "" || b.Machine == "" || b.VirtioSuffix == "" {
+			t.Errorf("board %s: incomplete config %+v", name, b)
+		}
+	}
+
+	o := &Options{Board: "pdp11-usr"}
+	if _, err := o.board(); err == nil {
+		t.Error("expected an error for an unknown board")
+	}
+}
+
+func TestAccelArgs(t *testing.T) {
+	defer func(f func() bool) { hasKVM = f }(hasKVM)
+
+	native := &BoardConfig{
+		Arch:              runtime.GOARCH,
+		Machine:           "pc",
+		SecureBootMachine: "q35,smm=on",
+		KVMCPU:            "host",
+		TCGCPU:            "qemu64",
+	}
+	foreign := &BoardConfig{
+		Arch:    "not-" + runtime.GOARCH,
+		Machine: "virt",
+		KVMCPU:  "host",
+		TCGCPU:  "cortex-a57",
+	}
+
+	for _, tt := range []struct {
+		desc     string
+		board    *BoardConfig
+		firmware string
+		kvm      bool
+		expect   []string
+	}{
+		{"native with kvm", native, FirmwareBIOS, true, []string{"-machine", "pc,accel=kvm", "-cpu", "host"}},
+		{"native without kvm", native, FirmwareBIOS, false, []string{"-machine", "pc,accel=tcg", "-cpu", "qemu64"}},
+		{"secure boot", native, FirmwareUEFISecure, true, []string{"-machine", "q35,smm=on,accel=kvm", "-cpu", "host"}},
+		{"foreign with kvm", foreign, FirmwareBIOS, true, []string{"-machine", "virt,accel=tcg", "-cpu", "cortex-a57"}},
+		{"foreign secure boot", foreign, FirmwareUEFISecure, false, []string{"-machine", "virt,accel=tcg", "-cpu", "cortex-a57"}},
+	} {
+		kvm := tt.kvm
+		hasKVM = func() bool { return kvm }
+
+		o := &Options{Firmware: tt.firmware}
+		if got := o.accelArgs(tt.board); !reflect.DeepEqual(got, tt.expect) {
+			t.Errorf("%s: got %q, wanted %q", tt.desc, got, tt.expect)
+		}
+	}
+}
+
+func TestSetDefaultFirmware(t *testing.T) {
+	o := &Options{Board: "arm64-usr", Firmware: FirmwareUEFI}
+	if err := o.SetDefaultFirmware("/images"); err != nil {
+		t.Fatal(err)
+	}
+	if o.BIOSImage != "/images/coreos_production_qemu_uefi_efi_code.fd" {
+		t.Errorf("got BIOS %q", o.BIOSImage)
+	}
+	if o.UEFIVars != "/images/coreos_production_qemu_uefi_efi_vars.fd" {
+		t.Errorf("got UEFI vars %q", o.UEFIVars)
+	}
+
+	o = &Options{Board: "amd64-usr", BIOSImage: "custom.bin"}
+	if err := o.SetDefaultFirmware("/images"); err != nil {
+		t.Fatal(err)
+	}
+	if o.BIOSImage != "custom.bin" || o.UEFICode != "" {
+		t.Errorf("got BIOS %q and UEFI code %q", o.BIOSImage, o.UEFICode)
+	}
+
+	o = &Options{Board: "amd64-usr", Firmware: "coreboot"}
+	if err := o.SetDefaultFirmware("/images"); err == nil {
+		t.Error("expected an error for unknown firmware")
+	}
+}
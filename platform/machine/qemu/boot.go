@@ -0,0 +1,123 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemu
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/coreos/mantle/platform/conf"
+)
+
+const (
+	// BootDisk boots machines from a copy-on-write overlay of DiskImage.
+	BootDisk = "disk"
+
+	// BootPXE network boots machines from PXEKernel and PXEInitrd,
+	// with the machine's config served over HTTP.
+	BootPXE = "pxe"
+
+	// BootISO boots machines from ISOImage attached as a CD-ROM, with
+	// the machine's config on a config drive.
+	BootISO = "iso"
+)
+
+// BootModes lists the supported values of Options.BootMode.
+var BootModes = []string{BootDisk, BootPXE, BootISO}
+
+const (
+	pxeKernelPath = "/pxe/vmlinuz"
+	pxeInitrdPath = "/pxe/initrd.cpio.gz"
+)
+
+// setupPXE serves the PXE kernel and initrd for all machines in the
+// cluster.
+func (qc *Cluster) setupPXE() error {
+	if qc.opts.PXEKernel == "" || qc.opts.PXEInitrd == "" {
+		return fmt.Errorf("pxe boot requires both kernel and initrd images")
+	}
+
+	qc.HTTPServer.AddLocalFile(pxeKernelPath, qc.opts.PXEKernel)
+	qc.HTTPServer.AddLocalFile(pxeInitrdPath, qc.opts.PXEInitrd)
+	return nil
+}
+
+// BootMode returns the mode the cluster's machines boot in, see
+// BootModes.
+func (qc *Cluster) BootMode() string {
+	if qc.opts.BootMode == "" {
+		return BootDisk
+	}
+	return qc.opts.BootMode
+}
+
+// pxeConfigPath returns the URL path of a PXE booted machine's config.
+func pxeConfigPath(id string) string {
+	return path.Join("/machines", id, "config")
+}
+
+// PXEConfigURL returns the URL a PXE booted machine fetches its config
+// from, which is served until the machine is destroyed.
+func (qc *Cluster) PXEConfigURL(id string) string {
+	return qc.HTTPURL(pxeConfigPath(id))
+}
+
+// pxeBoot serves the machine's config over HTTP and points its network
+// boot at the cluster's PXE kernel and initrd. confPath is either an
+// Ignition config or a config drive directory.
+func (qc *Cluster) pxeBoot(qm *machine, conf *conf.Conf, confPath string) error {
+	b, err := qc.opts.board()
+	if err != nil {
+		return err
+	}
+
+	cmdline := []string{
+		"console=" + b.Console + ",115200n8",
+		"coreos.first_boot=1",
+	}
+
+	configPath := pxeConfigPath(qm.id)
+	configURL := qc.HTTPURL(configPath)
+	if conf.IsIgnition() {
+		qc.HTTPServer.AddLocalFile(configPath, confPath)
+		cmdline = append(cmdline, "coreos.config.url="+configURL)
+	} else {
+		qc.HTTPServer.AddLocalFile(configPath, path.Join(confPath, "openstack/latest/user_data"))
+		cmdline = append(cmdline, "cloud-config-url="+configURL)
+	}
+
+	qc.PXEBoot(qm.netif.HardwareAddr,
+		qc.HTTPURL(pxeKernelPath),
+		qc.HTTPURL(pxeInitrdPath),
+		strings.Join(cmdline, " "))
+	return nil
+}
+
+// removePXEBoot stops serving the network boot of qm.
+func (qc *Cluster) removePXEBoot(qm *machine) {
+	qc.RemovePXEBoot(qm.netif.HardwareAddr)
+	qc.HTTPServer.RemoveFile(pxeConfigPath(qm.id))
+}
+
+// isoArgs returns the QEMU arguments attaching ISOImage as the boot
+// CD-ROM. SCSI is used since the arm64 virt machine has no IDE bus.
+func (qc *Cluster) isoArgs() []string {
+	return []string{
+		"-drive", "if=none,id=cd,media=cdrom,readonly=on,format=raw,file=" + qc.opts.ISOImage,
+		"-device", qc.opts.Virtio("scsi", "id=scsi"),
+		"-device", "scsi-cd,bus=scsi.0,drive=cd,bootindex=1",
+	}
+}
@@ -20,7 +20,6 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
 
 	"github.com/coreos/pkg/capnslog"
@@ -29,8 +28,8 @@ import (
 	"github.com/coreos/mantle/platform"
 	"github.com/coreos/mantle/platform/conf"
 	"github.com/coreos/mantle/platform/local"
-	"github.com/coreos/mantle/system/exec"
 	"github.com/coreos/mantle/system/ns"
+	"github.com/coreos/mantle/util"
 )
 
 // Options contains QEMU-specific options for the cluster.
@@ -43,6 +42,57 @@ type Options struct {
 	// It can be a plain name, or a full path.
 	BIOSImage string
 
+	// Firmware selects how machines boot: FirmwareBIOS (the default),
+	// FirmwareUEFI or FirmwareUEFISecure.
+	Firmware string
+
+	// UEFICode and UEFIVars are the OVMF/AAVMF code and variable store
+	// images attached as pflash drives in the UEFI firmware modes.
+	UEFICode string
+	UEFIVars string
+
+	// BootMode selects where machines boot from: BootDisk (the
+	// default), BootPXE or BootISO.
+	BootMode string
+
+	// ISOImage is the ISO attached to machines in BootISO mode.
+	ISOImage string
+
+	// PXEKernel and PXEInitrd are the kernel and initramfs served to
+	// machines in BootPXE mode.
+	PXEKernel string
+	PXEInitrd string
+
+	// TFTPRoot is served over TFTP so that firmware without iPXE
+	// built in can chainload it when network booting.
+	TFTPRoot string
+
+	// BlankDiskSize, if set, attaches an empty disk of the given size
+	// (e.g. "8G") to machines that don't boot from DiskImage.
+	BlankDiskSize string
+
+	// TPM attaches an emulated TPM 2.0 to each machine, with its
+	// state kept in the machine's output directory.
+	TPM bool
+
+	// IPMode selects the address families of the cluster network:
+	// local.IPModeDual (the default), local.IPModeIPv4 or
+	// local.IPModeIPv6.
+	IPMode string
+
+	// RegistryArchives are `docker save` tarballs of images served to
+	// machines from a registry in the cluster.
+	RegistryArchives []string
+
+	// EtcdMembers is the number of members of the cluster's local
+	// etcd. Defaults to 1.
+	EtcdMembers int
+
+	// SnapshotCacheDir, if set, caches snapshots of booted machines
+	// that are restored instead of booting machines for tests that
+	// allow it.
+	SnapshotCacheDir string
+
 	*platform.Options
 }
 
@@ -55,6 +105,9 @@ type Cluster struct {
 
 	mu sync.Mutex
 	*local.LocalCluster
+
+	snapshotKeyOnce sync.Once
+	snapshotKeyErr  error
 }
 
 var (
@@ -64,7 +117,17 @@ var (
 // NewCluster creates a Cluster instance, suitable for running virtual
 // machines in QEMU.
 func NewCluster(opts *Options, rconf *platform.RuntimeConfig) (platform.Cluster, error) {
-	lc, err := local.NewLocalCluster(opts.BaseName, rconf)
+	if _, err := opts.board(); err != nil {
+		return nil, err
+	}
+
+	lc, err := local.NewLocalCluster(opts.BaseName, &local.Options{
+		TFTPRoot: opts.TFTPRoot,
+		IPMode:   opts.IPMode,
+
+		RegistryArchives: opts.RegistryArchives,
+		EtcdMembers:      opts.EtcdMembers,
+	}, rconf)
 	if err != nil {
 		return nil, err
 	}
@@ -74,10 +137,46 @@ func NewCluster(opts *Options, rconf *platform.RuntimeConfig) (platform.Cluster,
 		LocalCluster: lc,
 	}
 
+	switch opts.BootMode {
+	case "", BootDisk:
+	case BootPXE:
+		if err := qc.setupPXE(); err != nil {
+			qc.Destroy()
+			return nil, err
+		}
+	case BootISO:
+		if qc.opts.ISOImage == "" {
+			qc.Destroy()
+			return nil, fmt.Errorf("iso boot requires an ISO image")
+		}
+	default:
+		qc.Destroy()
+		return nil, fmt.Errorf("unsupported boot mode %q", opts.BootMode)
+	}
+
 	return qc, nil
 }
 
 func (qc *Cluster) NewMachine(userdata *conf.UserData) (platform.Machine, error) {
+	var snap *snapshot
+	if qc.snapshotEligible(userdata) {
+		var err error
+		snap, err = qc.getSnapshot(userdata)
+		if err != nil {
+			plog.Warningf("Booting without snapshot: %v", err)
+		}
+	}
+
+	qm, err := qc.newMachine(userdata, snap)
+	if err != nil {
+		return nil, err
+	}
+	return qm, nil
+}
+
+// newMachine boots a machine, restoring it from snap if set. If snap is
+// being saved the machine is booted as its template instead.
+func (qc *Cluster) newMachine(userdata *conf.UserData, snap *snapshot) (*machine, error) {
 	id := uuid.NewV4()
 
 	dir := filepath.Join(qc.RuntimeConf().OutputDir, id.String())
@@ -89,7 +188,7 @@ func (qc *Cluster) NewMachine(userdata *conf.UserData) (platform.Machine, error)
 	// NOTE: escaping is not supported
 	qc.mu.Lock()
 	netif := qc.Dnsmasq.GetInterface("br0")
-	ip := strings.Split(netif.DHCPv4[0].String(), "/")[0]
+	ip := netif.IP().String()
 
 	conf, err := qc.RenderUserData(userdata, map[string]string{
 		"$public_ipv4":  ip,
@@ -102,16 +201,20 @@ func (qc *Cluster) NewMachine(userdata *conf.UserData) (platform.Machine, error)
 	qc.mu.Unlock()
 
 	var confPath string
-	if conf.IsIgnition() {
-		confPath = filepath.Join(dir, "ignition.json")
-		if err := conf.WriteFile(confPath); err != nil {
-			return nil, err
-		}
-	} else {
+	if snap != nil && snap.save {
+		confPath, err = WriteConfig(conf, snap.dir)
+	} else if snap != nil {
+		// restored machines already ran the template's config but
+		// must be started with the same devices
+		confPath = snap.path(snapshotConfigFile)
+	} else if qc.opts.BootMode == BootISO {
+		// the ISO can only read configs from a config drive
 		confPath, err = local.MakeConfigDrive(conf, dir)
-		if err != nil {
-			return nil, err
-		}
+	} else {
+		confPath, err = WriteConfig(conf, dir)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	journal, err := platform.NewJournal(dir)
@@ -127,54 +230,92 @@ func (qc *Cluster) NewMachine(userdata *conf.UserData) (platform.Machine, error)
 		consolePath: filepath.Join(dir, "console.txt"),
 	}
 
-	var qmCmd []string
-	switch qc.opts.Board {
-	case "amd64-usr":
-		qmCmd = []string{
-			"qemu-system-x86_64",
-			"-machine", "accel=kvm",
-			"-cpu", "host",
+	// set once QEMU runs, after which Destroy cleans up
+	var started bool
+	defer func() {
+		if !started {
+			qm.journal.Destroy()
+			qm.destroySwtpm()
+			qm.removeQMP()
 		}
-	case "arm64-usr":
-		qmCmd = []string{
-			"qemu-system-aarch64",
-			"-machine", "virt",
-			"-cpu", "cortex-a57",
+	}()
+
+	qmCmd, err := qc.opts.MachineCommand(qm.id, dir, qm.consolePath)
+	if err != nil {
+		return nil, err
+	}
+
+	netArgs := "netdev=tap,mac=" + qm.netif.HardwareAddr.String()
+	qmCmd = append(qmCmd, "-netdev", "tap,id=tap,fd=3")
+
+	if snap != nil {
+		// the socket path may be too long in the output directory
+		qm.qmpDir, err = ioutil.TempDir("", "mantle-qmp-")
+		if err != nil {
+			return nil, err
+		}
+		qmCmd = append(qmCmd, "-qmp", "unix:"+qm.qmpSocket()+",server,nowait")
+		netArgs += ",id=" + snapshotNIC
+	}
+
+	var diskFile *os.File
+	switch qc.opts.BootMode {
+	case BootPXE:
+		defer func() {
+			if !started {
+				qc.removePXEBoot(qm)
+			}
+		}()
+		err = qc.pxeBoot(qm, conf, confPath)
+		netArgs += ",bootindex=1"
+		if err == nil && qc.opts.BlankDiskSize != "" {
+			diskFile, err = setupBlankDisk(qc.opts.BlankDiskSize)
+		}
+	case BootISO:
+		qmCmd = append(qmCmd, qc.opts.configDriveArgs(confPath)...)
+		qmCmd = append(qmCmd, qc.isoArgs()...)
+		if qc.opts.BlankDiskSize != "" {
+			diskFile, err = setupBlankDisk(qc.opts.BlankDiskSize)
 		}
 	default:
-		panic(qc.opts.Board)
+		qmCmd = append(qmCmd, qc.opts.ConfigArgs(conf, confPath)...)
+		if snap != nil {
+			diskFile, err = snapshotDisk(qc.opts.DiskImage, snap)
+		} else {
+			diskFile, err = SetupDisk(qc.opts.DiskImage)
+		}
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	qmMac := qm.netif.HardwareAddr.String()
-	qmCmd = append(qmCmd,
-		"-bios", qc.opts.BIOSImage,
-		"-smp", "1",
-		"-m", "1024",
-		"-uuid", qm.id,
-		"-display", "none",
-		"-add-fd", "fd=4,set=1",
-		"-drive", "if=none,id=blk,format=qcow2,file=/dev/fdset/1",
-		"-device", qc.virtio("blk", "drive=blk"),
-		"-netdev", "tap,id=tap,fd=3",
-		"-device", qc.virtio("net", "netdev=tap,mac="+qmMac),
-		"-chardev", "file,id=log,path="+qm.consolePath,
-		"-serial", "chardev:log",
-	)
-
-	if conf.IsIgnition() {
-		qmCmd = append(qmCmd,
-			"-fw_cfg", "name=opt/com.coreos/config,file="+confPath)
+	if snap != nil && !snap.save {
+		// the NIC is plugged in once the memory state is loaded
+		qmCmd = append(qmCmd, "-S", "-incoming",
+			"exec:gzip -dc < "+util.ShellQuote(snap.path(snapshotStateFile)))
 	} else {
+		qmCmd = append(qmCmd, "-device", qc.opts.Virtio("net", netArgs))
+	}
+
+	if diskFile != nil {
+		defer diskFile.Close()
 		qmCmd = append(qmCmd,
-			"-fsdev", "local,id=cfg,security_model=none,readonly,path="+confPath,
-			"-device", qc.virtio("9p", "fsdev=cfg,mount_tag=config-2"))
+			"-add-fd", "fd=4,set=1",
+			"-drive", "if=none,id=blk,format=qcow2,file=/dev/fdset/1",
+			"-device", qc.opts.Virtio("blk", "drive=blk"))
 	}
 
-	diskFile, err := setupDisk(qc.opts.DiskImage)
-	if err != nil {
-		return nil, err
+	if qc.opts.TPM {
+		b, err := qc.opts.board()
+		if err != nil {
+			return nil, err
+		}
+		qm.swtpm, err = newSwtpm(filepath.Join(dir, "tpm"))
+		if err != nil {
+			return nil, err
+		}
+		qmCmd = append(qmCmd, qm.swtpm.args(b)...)
 	}
-	defer diskFile.Close()
 
 	qc.mu.Lock()
 
@@ -193,78 +334,55 @@ func (qc *Cluster) NewMachine(userdata *conf.UserData) (platform.Machine, error)
 
 	cmd := qm.qemu.(*ns.Cmd)
 	cmd.Stderr = os.Stderr
-	cmd.ExtraFiles = append(cmd.ExtraFiles,
-		tap.File, // fd=3
-		diskFile, // fd=4
-	)
-
-	if err = qm.qemu.Start(); err != nil {
-		return nil, err
+	cmd.ExtraFiles = append(cmd.ExtraFiles, tap.File) // fd=3
+	if diskFile != nil {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, diskFile) // fd=4
 	}
 
-	if err := qm.journal.Start(context.TODO(), qm); err != nil {
-		qm.Destroy()
+	if err = qm.qemu.Start(); err != nil {
 		return nil, err
 	}
+	started = true
 
-	if err := platform.CheckMachine(qm); err != nil {
+	if err := qc.Dnsmasq.AddHost(qm.hostname(), qm.addrs()...); err != nil {
 		qm.Destroy()
 		return nil, err
 	}
 
-	if err := platform.EnableSelinux(qm); err != nil {
-		qm.Destroy()
-		return nil, err
+	if snap != nil && !snap.save {
+		if err := qm.restoreSnapshot(); err != nil {
+			qm.Destroy()
+			return nil, err
+		}
 	}
-	qc.AddMach(qm)
-
-	return qm, nil
-}
 
-// The virtio device name differs between machine types but otherwise
-// configuration is the same. Use this to help construct device args.
-func (qc *Cluster) virtio(device, args string) string {
-	var suffix string
-	switch qc.opts.Board {
-	case "amd64-usr":
-		suffix = "pci"
-	case "arm64-usr":
-		suffix = "device"
-	default:
-		panic(qc.opts.Board)
+	// restored machines don't print their host keys again
+	if qc.RuntimeConf().ConsoleHostKeys && (snap == nil || snap.save) {
+		err := qc.ExpectConsoleHostKeys(qm.IP(), func() (string, error) {
+			buf, err := ioutil.ReadFile(qm.consolePath)
+			return string(buf), err
+		})
+		if err != nil {
+			qm.Destroy()
+			return nil, err
+		}
 	}
-	return fmt.Sprintf("virtio-%s-%s,%s", device, suffix, args)
-}
 
-// Create a nameless temporary qcow2 image file backed by a raw image.
-func setupDisk(imageFile string) (*os.File, error) {
-	// a relative path would be interpreted relative to /tmp
-	backingFile, err := filepath.Abs(imageFile)
-	if err != nil {
-		return nil, err
-	}
-	// keep the COW image from breaking if the "latest" symlink changes
-	backingFile, err = filepath.EvalSymlinks(backingFile)
-	if err != nil {
+	if err := qm.journal.Start(context.TODO(), qm); err != nil {
+		qm.Destroy()
 		return nil, err
 	}
 
-	dstFile, err := ioutil.TempFile("", "mantle-qemu")
-	if err != nil {
+	if err := platform.CheckMachine(qm); err != nil {
+		qm.Destroy()
 		return nil, err
 	}
-	dstFileName := dstFile.Name()
-	defer os.Remove(dstFileName)
-	dstFile.Close()
-
-	qcowOpts := fmt.Sprintf("backing_file=%s,backing_fmt=raw,lazy_refcounts=on", backingFile)
-	qemuImg := exec.Command("qemu-img", "create", "-f", "qcow2",
-		"-o", qcowOpts, dstFileName)
-	qemuImg.Stderr = os.Stderr
 
-	if err := qemuImg.Run(); err != nil {
+	if err := platform.EnableSelinux(qm); err != nil {
+		qm.Destroy()
 		return nil, err
 	}
+	qc.AddMach(qm)
 
-	return os.OpenFile(dstFileName, os.O_RDWR, 0)
+	return qm, nil
 }
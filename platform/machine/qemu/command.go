@@ -0,0 +1,97 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemu
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/coreos/mantle/platform/conf"
+	"github.com/coreos/mantle/platform/local"
+)
+
+// MachineCommand returns the QEMU command line common to all machines:
+// the emulator, firmware, CPU, memory and serial console. Callers add
+// the disk, network and config arguments. Files needed by the firmware
+// are created in dir.
+func (o *Options) MachineCommand(id, dir, consolePath string) ([]string, error) {
+	b, err := o.board()
+	if err != nil {
+		return nil, err
+	}
+
+	qmCmd := []string{b.Binary}
+	qmCmd = append(qmCmd, o.accelArgs(b)...)
+
+	fwArgs, err := o.firmwareArgs(b, dir)
+	if err != nil {
+		return nil, err
+	}
+	qmCmd = append(qmCmd, fwArgs...)
+
+	qmCmd = append(qmCmd,
+		"-smp", "1",
+		"-m", "1024",
+		"-uuid", id,
+		"-display", "none",
+		"-chardev", "file,id=log,path="+consolePath,
+		"-serial", "chardev:log",
+	)
+
+	return qmCmd, nil
+}
+
+// The virtio device name differs between machine types but otherwise
+// configuration is the same. Use this to help construct device args.
+func (o *Options) Virtio(device, args string) string {
+	b, err := o.board()
+	if err != nil {
+		// MachineCommand has already rejected unknown boards
+		panic(err)
+	}
+	return fmt.Sprintf("virtio-%s-%s,%s", device, b.VirtioSuffix, args)
+}
+
+// WriteConfig writes conf into dir for a machine booting from disk and
+// returns the path to pass to ConfigArgs.
+func WriteConfig(conf *conf.Conf, dir string) (string, error) {
+	if !conf.IsIgnition() {
+		return local.MakeConfigDrive(conf, dir)
+	}
+
+	confPath := filepath.Join(dir, "ignition.json")
+	if err := conf.WriteFile(confPath); err != nil {
+		return "", err
+	}
+	return confPath, nil
+}
+
+// ConfigArgs returns the QEMU arguments passing the config written by
+// WriteConfig to a machine booting from disk.
+func (o *Options) ConfigArgs(conf *conf.Conf, confPath string) []string {
+	if conf.IsIgnition() {
+		return []string{"-fw_cfg", "name=opt/com.coreos/config,file=" + confPath}
+	}
+	return o.configDriveArgs(confPath)
+}
+
+// configDriveArgs returns the QEMU arguments exporting the config drive
+// directory at confPath to the machine.
+func (o *Options) configDriveArgs(confPath string) []string {
+	return []string{
+		"-fsdev", "local,id=cfg,security_model=none,readonly,path=" + confPath,
+		"-device", o.Virtio("9p", "fsdev=cfg,mount_tag=config-2"),
+	}
+}
@@ -127,3 +127,55 @@ func MakeDiskTemplate(inputPath, outputPath string) (result error) {
 
 	return
 }
+
+// SetupDisk creates a nameless temporary qcow2 image file backed by a raw
+// image.
+func SetupDisk(imageFile string) (*os.File, error) {
+	// a relative path would be interpreted relative to /tmp
+	backingFile, err := filepath.Abs(imageFile)
+	if err != nil {
+		return nil, err
+	}
+	// keep the COW image from breaking if the "latest" symlink changes
+	backingFile, err = filepath.EvalSymlinks(backingFile)
+	if err != nil {
+		return nil, err
+	}
+
+	qcowOpts := fmt.Sprintf("backing_file=%s,backing_fmt=raw,lazy_refcounts=on", backingFile)
+	return createDisk(qcowOpts, "")
+}
+
+// Create a nameless temporary empty qcow2 image file of the given size.
+func setupBlankDisk(size string) (*os.File, error) {
+	return createDisk("lazy_refcounts=on", size)
+}
+
+// Create a nameless temporary qcow2 image file with the given creation
+// options. The size may be empty if the image has a backing file.
+func createDisk(qcowOpts, size string) (*os.File, error) {
+	dstFile, err := ioutil.TempFile("", "mantle-qemu")
+	if err != nil {
+		return nil, err
+	}
+	dstFileName := dstFile.Name()
+	defer os.Remove(dstFileName)
+	dstFile.Close()
+
+	if err := createDiskFile(dstFileName, qcowOpts, size); err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(dstFileName, os.O_RDWR, 0)
+}
+
+// Create a qcow2 image file at path with the given creation options.
+func createDiskFile(path, qcowOpts, size string) error {
+	qemuArgs := []string{"create", "-f", "qcow2", "-o", qcowOpts, path}
+	if size != "" {
+		qemuArgs = append(qemuArgs, size)
+	}
+	qemuImg := exec.Command("qemu-img", qemuArgs...)
+	qemuImg.Stderr = os.Stderr
+	return qemuImg.Run()
+}
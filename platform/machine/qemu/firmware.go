@@ -0,0 +1,125 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/mantle/system"
+)
+
+const (
+	// FirmwareBIOS boots machines with the image passed via -bios.
+	FirmwareBIOS = "bios"
+
+	// FirmwareUEFI boots machines with OVMF/AAVMF pflash drives.
+	FirmwareUEFI = "uefi"
+
+	// FirmwareUEFISecure is FirmwareUEFI with Secure Boot enforced.
+	// The variable store must have the test keys already enrolled.
+	FirmwareUEFISecure = "uefi-secure"
+)
+
+// Firmwares lists the supported values of Options.Firmware.
+var Firmwares = []string{FirmwareBIOS, FirmwareUEFI, FirmwareUEFISecure}
+
+// IsUEFI reports whether the cluster boots machines with UEFI firmware.
+func (o *Options) IsUEFI() bool {
+	return o.Firmware == FirmwareUEFI || o.Firmware == FirmwareUEFISecure
+}
+
+// IsSecureBoot reports whether the cluster boots machines with Secure
+// Boot enforced.
+func (o *Options) IsSecureBoot() bool {
+	return o.Firmware == FirmwareUEFISecure
+}
+
+// SetDefaultFirmware fills in the firmware images not given for the
+// board and firmware mode, taking those built with the image from
+// imageDir.
+func (o *Options) SetDefaultFirmware(imageDir string) error {
+	b, err := o.board()
+	if err != nil {
+		return err
+	}
+
+	if o.BIOSImage == "" {
+		o.BIOSImage = b.BIOS
+		if b.ImageBIOS != "" {
+			o.BIOSImage = filepath.Join(imageDir, b.ImageBIOS)
+		}
+	}
+
+	switch o.Firmware {
+	case "", FirmwareBIOS:
+		return nil
+	case FirmwareUEFI, FirmwareUEFISecure:
+	default:
+		return fmt.Errorf("unsupported firmware %q", o.Firmware)
+	}
+
+	code, vars := b.UEFICode[o.Firmware], b.UEFIVars[o.Firmware]
+	if code == "" || vars == "" {
+		return fmt.Errorf("board %s has no %s firmware", o.Board, o.Firmware)
+	}
+	if o.UEFICode == "" {
+		o.UEFICode = filepath.Join(imageDir, code)
+	}
+	if o.UEFIVars == "" {
+		o.UEFIVars = filepath.Join(imageDir, vars)
+	}
+	return nil
+}
+
+// firmwareArgs returns the QEMU arguments for booting a machine with the
+// configured firmware on board b. In UEFI modes the variable store is copied into
+// dir so that each machine gets its own writable NVRAM.
+func (o *Options) firmwareArgs(b *BoardConfig, dir string) ([]string, error) {
+	switch o.Firmware {
+	case "", FirmwareBIOS:
+		return []string{"-bios", o.BIOSImage}, nil
+	case FirmwareUEFI, FirmwareUEFISecure:
+	default:
+		return nil, fmt.Errorf("unsupported firmware %q", o.Firmware)
+	}
+
+	if o.UEFICode == "" || o.UEFIVars == "" {
+		return nil, fmt.Errorf("%s firmware requires both code and vars images", o.Firmware)
+	}
+
+	vars := filepath.Join(dir, "efi_vars.fd")
+	if err := system.CopyRegularFile(o.UEFIVars, vars); err != nil {
+		return nil, fmt.Errorf("copying UEFI vars: %v", err)
+	}
+	// the template may be read-only but firmware must be able to write
+	if err := os.Chmod(vars, 0644); err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		"-drive", "if=pflash,format=raw,unit=0,readonly=on,file=" + o.UEFICode,
+		"-drive", "if=pflash,format=raw,unit=1,file=" + vars,
+	}
+
+	if o.IsSecureBoot() && b.SecurePflash {
+		// only code running in SMM may write to the variable store
+		args = append(args,
+			"-global", "driver=cfi.pflash01,property=secure,value=on")
+	}
+
+	return args, nil
+}
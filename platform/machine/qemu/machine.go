@@ -17,6 +17,9 @@ package qemu
 import (
 	"context"
 	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 
 	"golang.org/x/crypto/ssh"
 
@@ -31,6 +34,8 @@ type machine struct {
 	qemu        exec.Cmd
 	netif       *local.Interface
 	journal     *platform.Journal
+	swtpm       *swtpm
+	qmpDir      string
 	consolePath string
 	console     string
 }
@@ -40,11 +45,28 @@ func (m *machine) ID() string {
 }
 
 func (m *machine) IP() string {
-	return m.netif.DHCPv4[0].IP.String()
+	return m.netif.IP().String()
 }
 
 func (m *machine) PrivateIP() string {
-	return m.netif.DHCPv4[0].IP.String()
+	return m.netif.IP().String()
+}
+
+// hostname returns the name the machine's addresses are registered
+// under in the cluster's DNS.
+func (m *machine) hostname() string {
+	return m.id + ".br0.local"
+}
+
+func (m *machine) addrs() []net.IP {
+	var ips []net.IP
+	for _, addr := range m.netif.DHCPv4 {
+		ips = append(ips, addr.IP)
+	}
+	for _, addr := range m.netif.DHCPv6 {
+		ips = append(ips, addr.IP)
+	}
+	return ips
 }
 
 func (m *machine) SSHClient() (*ssh.Client, error) {
@@ -59,6 +81,10 @@ func (m *machine) SSH(cmd string) ([]byte, error) {
 	return m.qc.SSH(m, cmd)
 }
 
+func (m *machine) Exec(ctx context.Context, cmd string, opts *platform.ExecOptions) (*platform.ExecResult, error) {
+	return m.qc.Exec(ctx, m, cmd, opts)
+}
+
 func (m *machine) Reboot() error {
 	if err := platform.StartReboot(m); err != nil {
 		return err
@@ -80,6 +106,12 @@ func (m *machine) Destroy() error {
 	if err2 := m.journal.Destroy(); err == nil && err2 != nil {
 		err = err2
 	}
+	if err2 := m.destroySwtpm(); err == nil && err2 != nil {
+		err = err2
+	}
+	if err2 := m.removeQMP(); err == nil && err2 != nil {
+		err = err2
+	}
 
 	buf, err2 := ioutil.ReadFile(m.consolePath)
 	if err2 == nil {
@@ -88,11 +120,39 @@ func (m *machine) Destroy() error {
 		err = err2
 	}
 
+	if m.qc.opts.BootMode == BootPXE {
+		m.qc.removePXEBoot(m)
+	}
+
+	if err2 := m.qc.Dnsmasq.RemoveHost(m.hostname()); err == nil && err2 != nil {
+		err = err2
+	}
+
 	m.qc.DelMach(m)
 
 	return err
 }
 
+func (m *machine) destroySwtpm() error {
+	if m.swtpm == nil {
+		return nil
+	}
+	return m.swtpm.Destroy()
+}
+
+// qmpSocket returns the path of the QMP socket of machines that are
+// restored from or saved as snapshots.
+func (m *machine) qmpSocket() string {
+	return filepath.Join(m.qmpDir, "qmp.sock")
+}
+
+func (m *machine) removeQMP() error {
+	if m.qmpDir == "" {
+		return nil
+	}
+	return os.RemoveAll(m.qmpDir)
+}
+
 func (m *machine) ConsoleOutput() string {
 	return m.console
 }
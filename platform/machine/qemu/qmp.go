@@ -0,0 +1,142 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/coreos/mantle/util"
+)
+
+// qmpMessage is any message received from QEMU over QMP.
+type qmpMessage struct {
+	Event  string          `json:"event"`
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+}
+
+// qmpClient is a minimal synchronous QEMU Machine Protocol client.
+type qmpClient struct {
+	conn   net.Conn
+	dec    *json.Decoder
+	events []string
+}
+
+// dialQMP connects to the QMP server QEMU is starting on the unix
+// socket at path.
+func dialQMP(path string) (*qmpClient, error) {
+	var conn net.Conn
+	err := util.Retry(100, 100*time.Millisecond, func() (err error) {
+		conn, err = net.Dial("unix", path)
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf("connecting to QMP: %v", err)
+	}
+
+	c := &qmpClient{
+		conn: conn,
+		dec:  json.NewDecoder(conn),
+	}
+
+	// consume the greeting, then leave capabilities negotiation mode
+	var greeting json.RawMessage
+	if err := c.dec.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading QMP greeting: %v", err)
+	}
+	if err := c.execute("qmp_capabilities", nil, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// execute runs a QMP command and decodes its return value into result,
+// which may be nil.
+func (c *qmpClient) execute(command string, args, result interface{}) error {
+	req := map[string]interface{}{"execute": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+	if err := json.NewEncoder(c.conn).Encode(req); err != nil {
+		return fmt.Errorf("sending QMP command %s: %v", command, err)
+	}
+
+	for {
+		var msg qmpMessage
+		if err := c.dec.Decode(&msg); err != nil {
+			return fmt.Errorf("reading QMP response to %s: %v", command, err)
+		}
+		switch {
+		case msg.Event != "":
+			c.events = append(c.events, msg.Event)
+		case msg.Error != nil:
+			return fmt.Errorf("QMP command %s failed: %s: %s", command, msg.Error.Class, msg.Error.Desc)
+		case result != nil:
+			return json.Unmarshal(msg.Return, result)
+		default:
+			return nil
+		}
+	}
+}
+
+// waitEvent waits for QEMU to emit the named event, including events
+// received while waiting for command responses.
+func (c *qmpClient) waitEvent(event string, timeout time.Duration) error {
+	for i, e := range c.events {
+		if e == event {
+			c.events = append(c.events[:i], c.events[i+1:]...)
+			return nil
+		}
+	}
+
+	if err := c.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	for {
+		var msg qmpMessage
+		if err := c.dec.Decode(&msg); err != nil {
+			return fmt.Errorf("waiting for QMP event %s: %v", event, err)
+		}
+		if msg.Event == event {
+			return nil
+		}
+	}
+}
+
+// status returns the run state of the virtual machine.
+func (c *qmpClient) status() (string, error) {
+	var result struct {
+		Status string `json:"status"`
+	}
+	if err := c.execute("query-status", nil, &result); err != nil {
+		return "", err
+	}
+	return result.Status, nil
+}
+
+func (c *qmpClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,146 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemu
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveQMP runs a fake QMP server on a unix socket, answering each
+// command with the lines replies maps it to. Commands received are
+// sent to cmds.
+func serveQMP(t *testing.T, replies map[string][]string, cmds chan<- map[string]interface{}) (string, func()) {
+	dir, err := ioutil.TempDir("", "kola-qmp-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "qmp.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.Write([]byte(`{"QMP": {"version": {}, "capabilities": []}}` + "\n"))
+		s := bufio.NewScanner(conn)
+		for s.Scan() {
+			var req map[string]interface{}
+			if err := json.Unmarshal(s.Bytes(), &req); err != nil {
+				return
+			}
+			cmds <- req
+			lines, ok := replies[req["execute"].(string)]
+			if !ok {
+				lines = []string{`{"return": {}}`}
+			}
+			conn.Write([]byte(strings.Join(lines, "\n") + "\n"))
+		}
+	}()
+
+	return path, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestQMP(t *testing.T) {
+	cmds := make(chan map[string]interface{}, 10)
+	path, cleanup := serveQMP(t, map[string][]string{
+		"device_del": {
+			`{"event": "DEVICE_DELETED", "data": {"device": "nic0"}}`,
+			`{"return": {}}`,
+		},
+		"query-status": {`{"return": {"status": "inmigrate", "running": false}}`},
+		"cont":         {`{"error": {"class": "GenericError", "desc": "migration in progress"}}`},
+	}, cmds)
+	defer cleanup()
+
+	qmp, err := dialQMP(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qmp.Close()
+	if cmd := <-cmds; cmd["execute"] != "qmp_capabilities" {
+		t.Errorf("got %v, expected capabilities negotiation first", cmd)
+	}
+
+	// events arriving before the response are kept for waitEvent
+	if err := qmp.execute("device_del", map[string]string{"id": "nic0"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	cmd := <-cmds
+	if args, _ := cmd["arguments"].(map[string]interface{}); args["id"] != "nic0" {
+		t.Errorf("device_del sent arguments %v", cmd["arguments"])
+	}
+	if err := qmp.waitEvent("DEVICE_DELETED", time.Second); err != nil {
+		t.Errorf("buffered event: %v", err)
+	}
+
+	status, err := qmp.status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "inmigrate" {
+		t.Errorf("got status %q, expected inmigrate", status)
+	}
+	<-cmds
+
+	err = qmp.execute("cont", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "migration in progress") {
+		t.Errorf("got %v, expected the command's error", err)
+	}
+	<-cmds
+
+	// the event was consumed, so this must wait for a new one
+	if err := qmp.waitEvent("DEVICE_DELETED", 100*time.Millisecond); err == nil {
+		t.Errorf("event was delivered twice")
+	}
+}
+
+func TestQMPWaitEvent(t *testing.T) {
+	cmds := make(chan map[string]interface{}, 10)
+	path, cleanup := serveQMP(t, map[string][]string{
+		"stop": {`{"return": {}}`, `{"event": "STOP"}`},
+	}, cmds)
+	defer cleanup()
+
+	qmp, err := dialQMP(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qmp.Close()
+
+	if err := qmp.execute("stop", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := qmp.waitEvent("STOP", time.Second); err != nil {
+		t.Errorf("event after response: %v", err)
+	}
+}
@@ -0,0 +1,374 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemu
+
+// Machines of tests that allow it can be restored from a snapshot of a
+// machine that has already completed its first boot, rather than booting
+// from scratch. A template machine is booted once per disk image and
+// userdata, its NIC is unplugged, and its memory state is migrated to a
+// file next to its disk. New machines get a qcow2 overlay of the template
+// disk, load the memory state, and get a NIC with their own MAC address
+// plugged in before they are resumed.
+//
+// Restored machines share the template's machine ID, SSH host keys and
+// anything else generated on first boot, and their clocks start out
+// behind until NTP catches up. Snapshots are only supported on amd64
+// with BIOS firmware and Ignition configs, since 9p config drives and
+// UEFI variable stores can't be migrated. Templates are only locked
+// against concurrent creation within a single process. The cache must be
+// cleared by hand after upgrading QEMU.
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/coreos/mantle/platform/conf"
+	"github.com/coreos/mantle/util"
+)
+
+const (
+	snapshotKeyFile    = "id_rsa"
+	snapshotDiskFile   = "disk.qcow2"
+	snapshotStateFile  = "state.gz"
+	snapshotConfigFile = "ignition.json"
+
+	// the QMP id of the NIC that is swapped out around snapshots
+	snapshotNIC = "nic0"
+)
+
+var (
+	// snapshotLocks serializes creation of each template
+	snapshotLocksMu sync.Mutex
+	snapshotLocks   = make(map[string]*sync.Mutex)
+
+	// snapshotKeyLock serializes creation of the cache SSH key
+	snapshotKeyLock sync.Mutex
+)
+
+// snapshot is a cached template machine.
+type snapshot struct {
+	// dir holds the template disk, memory state and config.
+	dir string
+
+	// save is set while the template is being booted into dir, which
+	// is moved into place once the snapshot is complete.
+	save bool
+}
+
+func (s *snapshot) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+// snapshotEligible reports whether machines with the given userdata may
+// be restored from a snapshot.
+func (qc *Cluster) snapshotEligible(userdata *conf.UserData) bool {
+	rconf := qc.RuntimeConf()
+	b, err := qc.opts.board()
+	switch {
+	case err != nil, qc.opts.SnapshotCacheDir == "":
+		return false
+	case !rconf.AllowSnapshotBoot, rconf.NoSSHKeyInUserData:
+		return false
+	case qc.opts.BootMode != "" && qc.opts.BootMode != BootDisk:
+		return false
+	case !b.HotplugNIC, qc.opts.IsUEFI(), qc.opts.TPM:
+		return false
+	case userdata == nil:
+		return true
+	}
+
+	// each machine must get its own address substituted
+	return userdata.IsIgnition() &&
+		!userdata.Contains("$public_ipv4") &&
+		!userdata.Contains("$private_ipv4")
+}
+
+// snapshotHash identifies the template for the given userdata, naming
+// its directory in the cache.
+func (qc *Cluster) snapshotHash(userdata *conf.UserData) (string, error) {
+	if userdata == nil {
+		// match the default in RenderUserData
+		userdata = conf.Ignition(`{"ignition": {"version": "2.0.0"}}`)
+	}
+	// rendered without the per-cluster SSH keys
+	rendered, err := userdata.Render()
+	if err != nil {
+		return "", err
+	}
+
+	b, err := qc.opts.board()
+	if err != nil {
+		return "", err
+	}
+	image, err := filepath.Abs(qc.opts.DiskImage)
+	if err != nil {
+		return "", err
+	}
+	image, err = filepath.EvalSymlinks(image)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(image)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	// memory state can't be moved between accelerators
+	fmt.Fprintf(h, "board=%s\nkvm=%t\nbios=%s\nimage=%s\nsize=%d\nmtime=%d\n",
+		qc.opts.Board, b.useKVM(), qc.opts.BIOSImage,
+		image, info.Size(), info.ModTime().UnixNano())
+	h.Write(rendered.Bytes())
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// addSnapshotSSHKey adds the key authorized in all templates to the
+// cluster's SSH agent, creating it if the cache doesn't have one yet.
+func (qc *Cluster) addSnapshotSSHKey() error {
+	qc.snapshotKeyOnce.Do(func() {
+		var key *rsa.PrivateKey
+		key, qc.snapshotKeyErr = loadSnapshotSSHKey(qc.opts.SnapshotCacheDir)
+		if qc.snapshotKeyErr == nil {
+			qc.snapshotKeyErr = qc.AddKey(key, "core@snapshot")
+		}
+	})
+	return qc.snapshotKeyErr
+}
+
+func loadSnapshotSSHKey(cacheDir string) (*rsa.PrivateKey, error) {
+	snapshotKeyLock.Lock()
+	defer snapshotKeyLock.Unlock()
+
+	keyPath := filepath.Join(cacheDir, snapshotKeyFile)
+	buf, err := ioutil.ReadFile(keyPath)
+	if err == nil {
+		key, err := ssh.ParseRawPrivateKey(buf)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", keyPath, err)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an RSA key", keyPath)
+		}
+		return rsaKey, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(cacheDir, 0777); err != nil {
+		return nil, err
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	buf = pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	if err := ioutil.WriteFile(keyPath, buf, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// getSnapshot returns the template for the given userdata, booting and
+// saving it first if it isn't cached yet.
+func (qc *Cluster) getSnapshot(userdata *conf.UserData) (*snapshot, error) {
+	if err := qc.addSnapshotSSHKey(); err != nil {
+		return nil, fmt.Errorf("loading snapshot SSH key: %v", err)
+	}
+
+	hash, err := qc.snapshotHash(userdata)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotLocksMu.Lock()
+	lock, ok := snapshotLocks[hash]
+	if !ok {
+		lock = &sync.Mutex{}
+		snapshotLocks[hash] = lock
+	}
+	snapshotLocksMu.Unlock()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	snap := &snapshot{dir: filepath.Join(qc.opts.SnapshotCacheDir, hash)}
+	if _, err := os.Stat(snap.path(snapshotStateFile)); err == nil {
+		return snap, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	plog.Noticef("Creating snapshot %s", hash)
+	if err := qc.createSnapshot(userdata, snap.dir); err != nil {
+		return nil, fmt.Errorf("creating snapshot: %v", err)
+	}
+	return snap, nil
+}
+
+// createSnapshot boots a template machine and saves it to dir.
+func (qc *Cluster) createSnapshot(userdata *conf.UserData, dir string) error {
+	buildDir, err := ioutil.TempDir(filepath.Dir(dir), filepath.Base(dir)+".")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(buildDir)
+
+	qm, err := qc.newMachine(userdata, &snapshot{dir: buildDir, save: true})
+	if err != nil {
+		return err
+	}
+
+	err = qm.saveSnapshot(buildDir)
+	if err2 := qm.Destroy(); err == nil && err2 != nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+
+	// the template disk must be at its final path before overlays
+	// reference it, and the memory state marks the snapshot complete
+	return os.Rename(buildDir, dir)
+}
+
+// snapshotDisk returns the disk for a machine using snap.
+func snapshotDisk(image string, snap *snapshot) (*os.File, error) {
+	if !snap.save {
+		qcowOpts := fmt.Sprintf("backing_file=%s,backing_fmt=qcow2,lazy_refcounts=on",
+			snap.path(snapshotDiskFile))
+		return createDisk(qcowOpts, "")
+	}
+
+	backingFile, err := filepath.Abs(image)
+	if err != nil {
+		return nil, err
+	}
+	backingFile, err = filepath.EvalSymlinks(backingFile)
+	if err != nil {
+		return nil, err
+	}
+
+	diskPath := snap.path(snapshotDiskFile)
+	qcowOpts := fmt.Sprintf("backing_file=%s,backing_fmt=raw", backingFile)
+	if err := createDiskFile(diskPath, qcowOpts, ""); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(diskPath, os.O_RDWR, 0)
+}
+
+// saveSnapshot unplugs the NIC of a booted template machine and writes
+// its memory state to dir. QEMU exits once the state is written.
+func (m *machine) saveSnapshot(dir string) error {
+	qmp, err := dialQMP(m.qmpSocket())
+	if err != nil {
+		return err
+	}
+	defer qmp.Close()
+
+	if err := qmp.execute("device_del", map[string]string{"id": snapshotNIC}, nil); err != nil {
+		return err
+	}
+	if err := qmp.waitEvent("DEVICE_DELETED", time.Minute); err != nil {
+		return err
+	}
+
+	uri := "exec:gzip -c > " + util.ShellQuote(filepath.Join(dir, snapshotStateFile))
+	if err := qmp.execute("migrate", map[string]string{"uri": uri}, nil); err != nil {
+		return err
+	}
+
+	err = util.Retry(600, 500*time.Millisecond, func() error {
+		var result struct {
+			Status string `json:"status"`
+		}
+		if err := qmp.execute("query-migrate", nil, &result); err != nil {
+			return err
+		}
+		switch result.Status {
+		case "completed":
+			return nil
+		case "failed", "cancelled":
+			return fmt.Errorf("migration %s", result.Status)
+		default:
+			return fmt.Errorf("migration still %s", result.Status)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("saving memory state: %v", err)
+	}
+
+	// QEMU may close the connection before responding
+	if err := qmp.execute("quit", nil, nil); err != nil {
+		plog.Debugf("QMP quit: %v", err)
+	}
+	return nil
+}
+
+// restoreSnapshot waits for a machine started with -incoming to load its
+// memory state, plugs in its NIC and resumes it.
+func (m *machine) restoreSnapshot() error {
+	b, err := m.qc.opts.board()
+	if err != nil {
+		return err
+	}
+
+	qmp, err := dialQMP(m.qmpSocket())
+	if err != nil {
+		return err
+	}
+	defer qmp.Close()
+
+	err = util.Retry(600, 500*time.Millisecond, func() error {
+		status, err := qmp.status()
+		if err != nil {
+			return err
+		}
+		if status == "inmigrate" {
+			return fmt.Errorf("still loading memory state")
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("restoring memory state: %v", err)
+	}
+
+	err = qmp.execute("device_add", map[string]string{
+		"driver": "virtio-net-" + b.VirtioSuffix,
+		"netdev": "tap",
+		"mac":    m.netif.HardwareAddr.String(),
+		"id":     snapshotNIC,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	return qmp.execute("cont", nil, nil)
+}
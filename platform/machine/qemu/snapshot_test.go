@@ -0,0 +1,86 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coreos/mantle/platform/conf"
+)
+
+func TestSnapshotHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kola-snapshot-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "image.bin")
+	if err := ioutil.WriteFile(image, []byte("disk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "latest.bin")
+	if err := os.Symlink(image, link); err != nil {
+		t.Fatal(err)
+	}
+
+	hash := func(qc *Cluster, userdata *conf.UserData) string {
+		h, err := qc.snapshotHash(userdata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	qc := &Cluster{opts: &Options{Board: "amd64-usr", DiskImage: image}}
+	base := hash(qc, nil)
+
+	if h := hash(qc, conf.Ignition(`{"ignition": {"version": "2.0.0"}}`)); h != base {
+		t.Errorf("default userdata got a different template than no userdata")
+	}
+	if h := hash(&Cluster{opts: &Options{Board: "amd64-usr", DiskImage: link}}, nil); h != base {
+		t.Errorf("image symlink got a different template than its target")
+	}
+
+	for desc, h := range map[string]string{
+		"other userdata": hash(qc, conf.Ignition(`{"ignition": {"version": "2.0.0"}, "systemd": {"units": [{"name": "a.service", "enable": true}]}}`)),
+		"other board":    hash(&Cluster{opts: &Options{Board: "arm64-usr", DiskImage: image}}, nil),
+		"other BIOS":     hash(&Cluster{opts: &Options{Board: "amd64-usr", DiskImage: image, BIOSImage: "other.bin"}}, nil),
+	} {
+		if h == base {
+			t.Errorf("%s got the same template", desc)
+		}
+	}
+
+	// a rebuilt image invalidates its templates
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(image, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if h := hash(qc, nil); h == base {
+		t.Errorf("modified image got the same template")
+	}
+
+	if _, err := (&Cluster{opts: &Options{Board: "amd64-usr", DiskImage: filepath.Join(dir, "missing.bin")}}).snapshotHash(nil); err == nil {
+		t.Errorf("expected an error for a missing image")
+	}
+	if _, err := (&Cluster{opts: &Options{Board: "mips-usr", DiskImage: image}}).snapshotHash(nil); err == nil {
+		t.Errorf("expected an error for an unknown board")
+	}
+}
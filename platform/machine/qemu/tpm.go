@@ -0,0 +1,90 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/coreos/mantle/system/exec"
+	"github.com/coreos/mantle/util"
+)
+
+// swtpm is an emulated TPM 2.0 attached to a single machine.
+type swtpm struct {
+	cmd     *exec.ExecCmd
+	sockDir string
+	socket  string
+}
+
+// newSwtpm starts swtpm with its persistent state and log in stateDir.
+func newSwtpm(stateDir string) (*swtpm, error) {
+	if err := os.MkdirAll(stateDir, 0777); err != nil {
+		return nil, err
+	}
+
+	// the output directory may be too long for a unix socket path
+	sockDir, err := ioutil.TempDir("", "mantle-swtpm-")
+	if err != nil {
+		return nil, err
+	}
+
+	t := &swtpm{
+		sockDir: sockDir,
+		socket:  filepath.Join(sockDir, "swtpm.sock"),
+	}
+	t.cmd = exec.Command("swtpm", "socket", "--tpm2",
+		"--tpmstate", "dir="+stateDir,
+		"--ctrl", "type=unixio,path="+t.socket,
+		"--log", "file="+filepath.Join(stateDir, "swtpm.log"),
+		"--terminate")
+	t.cmd.Stderr = os.Stderr
+
+	if err := t.cmd.Start(); err != nil {
+		os.RemoveAll(sockDir)
+		return nil, fmt.Errorf("starting swtpm: %v", err)
+	}
+
+	err = util.Retry(100, 50*time.Millisecond, func() error {
+		_, err := os.Stat(t.socket)
+		return err
+	})
+	if err != nil {
+		t.Destroy()
+		return nil, fmt.Errorf("waiting for swtpm socket: %v", err)
+	}
+
+	return t, nil
+}
+
+// args returns the QEMU arguments connecting the machine to the TPM.
+func (t *swtpm) args(board *BoardConfig) []string {
+	return []string{
+		"-chardev", "socket,id=chrtpm,path=" + t.socket,
+		"-tpmdev", "emulator,id=tpm0,chardev=chrtpm",
+		"-device", board.TPMDevice + ",tpmdev=tpm0",
+	}
+}
+
+func (t *swtpm) Destroy() error {
+	err := t.cmd.Kill()
+	if err2 := os.RemoveAll(t.sockDir); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,187 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package unprivqemu runs QEMU machines without root privileges. Each
+// machine gets its own QEMU user mode (slirp) network, so machines can
+// reach the outside world but not each other, and SSH is forwarded from
+// a port on the host's loopback address.
+package unprivqemu
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/pkg/capnslog"
+	"github.com/satori/go.uuid"
+
+	"github.com/coreos/mantle/platform"
+	"github.com/coreos/mantle/platform/conf"
+	"github.com/coreos/mantle/platform/local"
+	"github.com/coreos/mantle/platform/machine/qemu"
+	"github.com/coreos/mantle/system/exec"
+)
+
+// guestIP is the address QEMU user networking assigns to the guest.
+const guestIP = "10.0.2.15"
+
+type Cluster struct {
+	*platform.BaseCluster
+	opts *qemu.Options
+}
+
+var (
+	plog = capnslog.NewPackageLogger("github.com/coreos/mantle", "kola/platform/machine/unprivqemu")
+)
+
+// NewCluster creates a Cluster instance, suitable for running virtual
+// machines in QEMU as an unprivileged user. Only booting from disk is
+// supported; the firmware options apply as on the qemu platform, but
+// options for the local cluster's services and devices needing root are
+// rejected.
+func NewCluster(opts *qemu.Options, rconf *platform.RuntimeConfig) (platform.Cluster, error) {
+	if opts.BootMode != "" && opts.BootMode != qemu.BootDisk {
+		return nil, fmt.Errorf("boot mode %q requires the qemu platform", opts.BootMode)
+	}
+	if opts.IPMode == local.IPModeIPv6 {
+		return nil, fmt.Errorf("IP mode %q requires the qemu platform", opts.IPMode)
+	}
+	if opts.TPM {
+		return nil, fmt.Errorf("TPMs require the qemu platform")
+	}
+	if opts.SnapshotCacheDir != "" {
+		return nil, fmt.Errorf("snapshot boot requires the qemu platform")
+	}
+	// there is no local cluster serving these
+	if len(opts.RegistryArchives) > 0 {
+		return nil, fmt.Errorf("registry archives require the qemu platform")
+	}
+	if opts.EtcdMembers > 1 {
+		return nil, fmt.Errorf("a multi-member etcd cluster requires the qemu platform")
+	}
+
+	bc, err := platform.NewBaseCluster(opts.BaseName, rconf)
+	if err != nil {
+		return nil, err
+	}
+
+	qc := &Cluster{
+		BaseCluster: bc,
+		opts:        opts,
+	}
+
+	return qc, nil
+}
+
+func (qc *Cluster) NewMachine(userdata *conf.UserData) (platform.Machine, error) {
+	id := uuid.NewV4()
+
+	dir := filepath.Join(qc.RuntimeConf().OutputDir, id.String())
+	if err := os.Mkdir(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	conf, err := qc.RenderUserData(userdata, map[string]string{
+		"$public_ipv4":  guestIP,
+		"$private_ipv4": guestIP,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	confPath, err := qemu.WriteConfig(conf, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	journal, err := platform.NewJournal(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sshPort, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+
+	qm := &machine{
+		qc:          qc,
+		id:          id.String(),
+		sshPort:     sshPort,
+		journal:     journal,
+		consolePath: filepath.Join(dir, "console.txt"),
+	}
+
+	qmCmd, err := qc.opts.MachineCommand(qm.id, dir, qm.consolePath)
+	if err != nil {
+		return nil, err
+	}
+
+	qmCmd = append(qmCmd, qc.opts.ConfigArgs(conf, confPath)...)
+	qmCmd = append(qmCmd,
+		"-netdev", fmt.Sprintf("user,id=eth0,hostfwd=tcp:127.0.0.1:%d-:22", sshPort),
+		"-device", qc.opts.Virtio("net", "netdev=eth0"),
+		"-add-fd", "fd=3,set=1",
+		"-drive", "if=none,id=blk,format=qcow2,file=/dev/fdset/1",
+		"-device", qc.opts.Virtio("blk", "drive=blk"),
+	)
+
+	diskFile, err := qemu.SetupDisk(qc.opts.DiskImage)
+	if err != nil {
+		return nil, err
+	}
+	defer diskFile.Close()
+
+	plog.Debugf("NewMachine: %q", qmCmd)
+
+	cmd := exec.Command(qmCmd[0], qmCmd[1:]...)
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(cmd.ExtraFiles, diskFile) // fd=3
+	qm.qemu = cmd
+
+	if err = qm.qemu.Start(); err != nil {
+		return nil, err
+	}
+
+	if err := qm.journal.Start(context.TODO(), qm); err != nil {
+		qm.Destroy()
+		return nil, err
+	}
+
+	if err := platform.CheckMachine(qm); err != nil {
+		qm.Destroy()
+		return nil, err
+	}
+
+	if err := platform.EnableSelinux(qm); err != nil {
+		qm.Destroy()
+		return nil, err
+	}
+	qc.AddMach(qm)
+
+	return qm, nil
+}
+
+// freePort finds an unused TCP port on the loopback address. Another
+// process could take it before QEMU binds it, but that is unlikely.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unprivqemu
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/coreos/mantle/platform"
+	"github.com/coreos/mantle/system/exec"
+)
+
+type machine struct {
+	qc          *Cluster
+	id          string
+	qemu        exec.Cmd
+	sshPort     int
+	journal     *platform.Journal
+	consolePath string
+	console     string
+}
+
+func (m *machine) ID() string {
+	return m.id
+}
+
+// IP returns the address the machine has on its own user mode network,
+// as substituted for $public_ipv4. Like every other machine's, it is
+// only reachable from inside QEMU; SSH goes through sshAddr instead.
+func (m *machine) IP() string {
+	return guestIP
+}
+
+// PrivateIP returns the same address as IP, which all machines share
+// since each has a network of its own.
+func (m *machine) PrivateIP() string {
+	return guestIP
+}
+
+// sshAddr returns the address on the host forwarded to the machine's
+// SSH port.
+func (m *machine) sshAddr() string {
+	return fmt.Sprintf("127.0.0.1:%d", m.sshPort)
+}
+
+func (m *machine) SSHClient() (*ssh.Client, error) {
+	return m.qc.SSHClient(m.sshAddr())
+}
+
+func (m *machine) PasswordSSHClient(user string, password string) (*ssh.Client, error) {
+	return m.qc.PasswordSSHClient(m.sshAddr(), user, password)
+}
+
+func (m *machine) SSH(cmd string) ([]byte, error) {
+	return m.qc.SSH(m, cmd)
+}
+
+func (m *machine) Exec(ctx context.Context, cmd string, opts *platform.ExecOptions) (*platform.ExecResult, error) {
+	return m.qc.Exec(ctx, m, cmd, opts)
+}
+
+func (m *machine) Reboot() error {
+	if err := platform.StartReboot(m); err != nil {
+		return err
+	}
+	if err := m.journal.Start(context.TODO(), m); err != nil {
+		return err
+	}
+	if err := platform.CheckMachine(m); err != nil {
+		return err
+	}
+	if err := platform.EnableSelinux(m); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *machine) Destroy() error {
+	err := m.qemu.Kill()
+	if err2 := m.journal.Destroy(); err == nil && err2 != nil {
+		err = err2
+	}
+
+	buf, err2 := ioutil.ReadFile(m.consolePath)
+	if err2 == nil {
+		m.console = string(buf)
+	} else if err == nil {
+		err = err2
+	}
+
+	m.qc.DelMach(m)
+	// the forwarded port may be reused by another machine
+	if err2 := m.qc.HostKeys().Forget(m.sshAddr()); err == nil && err2 != nil {
+		err = err2
+	}
+
+	return err
+}
+
+func (m *machine) ConsoleOutput() string {
+	return m.console
+}
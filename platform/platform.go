@@ -16,18 +16,20 @@ package platform
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"io"
-	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/coreos/pkg/capnslog"
 	"golang.org/x/crypto/ssh"
 
 	"github.com/coreos/mantle/platform/conf"
 	"github.com/coreos/mantle/util"
 )
 
+var plog = capnslog.NewPackageLogger("github.com/coreos/mantle", "platform")
+
 const (
 	sshRetries = 30
 	sshTimeout = 10 * time.Second
@@ -50,9 +52,13 @@ type Machine interface {
 	// PasswordSSHClient establishes a new SSH connection using the provided credentials.
 	PasswordSSHClient(user string, password string) (*ssh.Client, error)
 
-	// SSH runs a single command over a new SSH connection.
+	// SSH runs a single command over the machine's shared SSH
+	// connection, see NewSSHSession.
 	SSH(cmd string) ([]byte, error)
 
+	// Exec runs a command over the shared SSH connection, killing it if ctx is done first.
+	Exec(ctx context.Context, cmd string, opts *ExecOptions) (*ExecResult, error)
+
 	// Reboot restarts the machine and waits for it to come back.
 	Reboot() error
 
@@ -87,6 +93,10 @@ type Cluster interface {
 // Options contains the base options for all clusters.
 type Options struct {
 	BaseName string
+
+	// Proxy is a proxy to reach machines' SSH servers through, in
+	// any form network.NewProxyDialer takes.
+	Proxy string
 }
 
 // RuntimeConfig contains cluster-specific configuration.
@@ -95,24 +105,8 @@ type RuntimeConfig struct {
 
 	NoSSHKeyInUserData bool // don't inject SSH key into Ignition/cloud-config
 	NoSSHKeyInMetadata bool // don't add SSH key to platform metadata
-}
-
-// Wrap a StdoutPipe as a io.ReadCloser
-type sshPipe struct {
-	s   *ssh.Session
-	c   *ssh.Client
-	err *bytes.Buffer
-	io.Reader
-}
-
-func (p *sshPipe) Close() error {
-	if err := p.s.Wait(); err != nil {
-		return fmt.Errorf("%s: %s", err, p.err)
-	}
-	if err := p.s.Close(); err != nil {
-		return err
-	}
-	return p.c.Close()
+	AllowSnapshotBoot  bool // machines may be restored from a booted snapshot
+	ConsoleHostKeys    bool // verify host keys against console output
 }
 
 // Copy a file between two machines in a cluster.
@@ -129,77 +123,6 @@ func TransferFile(src Machine, srcPath string, dst Machine, dstPath string) erro
 	return nil
 }
 
-// ReadFile returns a io.ReadCloser that streams the requested file. The
-// caller should close the reader when finished.
-func ReadFile(m Machine, path string) (io.ReadCloser, error) {
-	client, err := m.SSHClient()
-	if err != nil {
-		return nil, fmt.Errorf("failed creating SSH client: %v", err)
-	}
-
-	session, err := client.NewSession()
-	if err != nil {
-		client.Close()
-		return nil, fmt.Errorf("failed creating SSH session: %v", err)
-	}
-
-	// connect session stdout
-	stdoutPipe, err := session.StdoutPipe()
-	if err != nil {
-		session.Close()
-		client.Close()
-		return nil, err
-	}
-
-	// collect stderr
-	errBuf := bytes.NewBuffer(nil)
-	session.Stderr = errBuf
-
-	// stream file to stdout
-	err = session.Start(fmt.Sprintf("sudo cat %s", path))
-	if err != nil {
-		session.Close()
-		client.Close()
-		return nil, err
-	}
-
-	// pass stdoutPipe as a io.ReadCloser that cleans up the ssh session
-	// on when closed.
-	return &sshPipe{session, client, errBuf, stdoutPipe}, nil
-}
-
-// InstallFile copies data from in to the path to on m.
-func InstallFile(in io.Reader, m Machine, to string) error {
-	dir := filepath.Dir(to)
-	out, err := m.SSH(fmt.Sprintf("sudo mkdir -p %s", dir))
-	if err != nil {
-		return fmt.Errorf("failed creating directory %s: %s", dir, out)
-	}
-
-	client, err := m.SSHClient()
-	if err != nil {
-		return fmt.Errorf("failed creating SSH client: %v", err)
-	}
-
-	defer client.Close()
-
-	session, err := client.NewSession()
-	if err != nil {
-		return fmt.Errorf("failed creating SSH session: %v", err)
-	}
-
-	defer session.Close()
-
-	// write file to fs from stdin
-	session.Stdin = in
-	out, err = session.CombinedOutput(fmt.Sprintf("sudo install -m 0755 /dev/stdin %s", to))
-	if err != nil {
-		return fmt.Errorf("failed executing install: %q: %v", out, err)
-	}
-
-	return nil
-}
-
 // NewMachines spawns n instances in cluster c, with
 // each instance passed the same userdata.
 func NewMachines(c Cluster, userdata *conf.UserData, n int) ([]Machine, error) {
@@ -0,0 +1,146 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshPool keeps an SSH connection open to each machine which the
+// helpers in this package multiplex their sessions over, rather than
+// each command paying for a new connection and handshake.
+type sshPool struct {
+	mu      sync.Mutex
+	clients map[Machine]*pooledClient
+}
+
+type pooledClient struct {
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+var sshClients = &sshPool{
+	clients: make(map[Machine]*pooledClient),
+}
+
+// get returns the shared connection to m, checking that it is still
+// alive and reconnecting if not.
+func (p *sshPool) get(m Machine) (*ssh.Client, error) {
+	p.mu.Lock()
+	pc, ok := p.clients[m]
+	if !ok {
+		pc = &pooledClient{}
+		p.clients[m] = pc
+	}
+	p.mu.Unlock()
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.client != nil {
+		if err := keepalive(pc.client); err == nil {
+			return pc.client, nil
+		}
+		plog.Debugf("reconnecting to %s: shared SSH connection is dead", m.ID())
+		pc.client.Close()
+		pc.client = nil
+	}
+
+	client, err := m.SSHClient()
+	if err != nil {
+		return nil, err
+	}
+	pc.client = client
+	return client, nil
+}
+
+// drop closes the shared connection to m, if any.
+func (p *sshPool) drop(m Machine) {
+	p.mu.Lock()
+	pc, ok := p.clients[m]
+	delete(p.clients, m)
+	p.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.client != nil {
+		pc.client.Close()
+		pc.client = nil
+	}
+}
+
+// keepalive checks that the server on the other end of client still
+// responds within sshTimeout.
+func keepalive(client *ssh.Client) error {
+	errc := make(chan error, 1)
+	go func() {
+		// Servers reply, even if only to refuse the request.
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		errc <- err
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(sshTimeout):
+		return fmt.Errorf("timed out waiting for keepalive reply")
+	}
+}
+
+// NewSSHSession opens an SSH session on m over the connection shared
+// by the helpers in this package. The returned function releases the
+// session and must be called once it is finished.
+func NewSSHSession(m Machine) (*ssh.Session, func(), error) {
+	client, err := sshClients.get(m)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session, err := client.NewSession()
+	if err == nil {
+		return session, func() { session.Close() }, nil
+	}
+
+	// sshd limits the sessions per connection (MaxSessions) so use a
+	// dedicated connection while the shared one is busy.
+	plog.Debugf("using a dedicated SSH connection to %s: %v", m.ID(), err)
+	client, err = m.SSHClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	session, err = client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return session, func() {
+		session.Close()
+		client.Close()
+	}, nil
+}
+
+// CloseSSHClient closes the connection to m shared by the helpers in
+// this package. The next command reconnects.
+func CloseSSHClient(m Machine) {
+	sshClients.drop(m)
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/coreos/mantle/network/mockssh"
+)
+
+// mockMachine dials mockssh servers, counting the connections.
+type mockMachine struct {
+	Machine
+	dials int
+}
+
+func (m *mockMachine) ID() string {
+	return "mock"
+}
+
+func (m *mockMachine) SSHClient() (*ssh.Client, error) {
+	m.dials++
+	return mockssh.NewMockClient(func(s *mockssh.Session) {
+		s.Exit(0)
+	}), nil
+}
+
+func runPooled(t *testing.T, m Machine) {
+	session, release, err := NewSSHSession(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	if err := session.Run("true"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSSHPoolReuse(t *testing.T) {
+	m := &mockMachine{}
+	defer CloseSSHClient(m)
+
+	for i := 0; i < 3; i++ {
+		runPooled(t, m)
+	}
+	if m.dials != 1 {
+		t.Errorf("dialed %d times, expected 1", m.dials)
+	}
+}
+
+func TestSSHPoolReconnect(t *testing.T) {
+	m := &mockMachine{}
+	defer CloseSSHClient(m)
+
+	runPooled(t, m)
+
+	// a dead connection is replaced
+	client, err := sshClients.get(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	runPooled(t, m)
+	if m.dials != 2 {
+		t.Errorf("dialed %d times, expected 2", m.dials)
+	}
+
+	// as is one closed explicitly, e.g. on reboot
+	CloseSSHClient(m)
+	runPooled(t, m)
+	if m.dials != 3 {
+		t.Errorf("dialed %d times, expected 3", m.dials)
+	}
+}
@@ -0,0 +1,439 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/mantle/network/sftp"
+	"github.com/coreos/mantle/util"
+)
+
+// sftpServerCmd runs the machine's sftp-server as root, unlike the sftp
+// subsystem, so files can be written anywhere and given any owner.
+const sftpServerCmd = `sudo sh -c 'for s in /usr/lib64/misc/sftp-server /usr/lib/misc/sftp-server /usr/libexec/openssh/sftp-server /usr/lib/openssh/sftp-server; do [ -x "$s" ] && exec "$s"; done; echo sftp-server not found >&2; exit 127'`
+
+// TransferOptions contains optional settings for Upload and Download.
+type TransferOptions struct {
+	// Mode, if set, is given to transferred files instead of the
+	// mode of the source. Directories keep the source's mode.
+	Mode os.FileMode
+
+	// Owner, as user or user:group, is given to uploaded files and
+	// directories, which are otherwise owned by root.
+	Owner string
+
+	// Verify compares the SHA-256 checksums of each file on both
+	// ends after it is transferred.
+	Verify bool
+
+	// Progress, if set, is called as each file is transferred with
+	// the bytes done so far and the file's size.
+	Progress func(path string, done, total int64)
+}
+
+// NewSFTPClient starts an SFTP session with root privileges on m. The
+// returned function ends it.
+func NewSFTPClient(m Machine) (*sftp.Client, func(), error) {
+	session, release, err := NewSSHSession(m)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed creating SSH session: %v", err)
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+
+	if err := session.Start(sftpServerCmd); err != nil {
+		release()
+		return nil, nil, err
+	}
+
+	client, err := sftp.NewClient(stdout, stdin)
+	if err != nil {
+		session.Close()
+		release()
+		return nil, nil, fmt.Errorf("%v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return client, func() {
+		client.Close()
+		session.Wait()
+		release()
+	}, nil
+}
+
+// transfer is an Upload or Download in progress.
+type transfer struct {
+	m        Machine
+	client   *sftp.Client
+	opts     *TransferOptions
+	uid, gid int
+}
+
+func newTransfer(m Machine, opts *TransferOptions) (*transfer, func(), error) {
+	if opts == nil {
+		opts = &TransferOptions{}
+	}
+
+	t := &transfer{
+		m:    m,
+		opts: opts,
+		uid:  -1,
+		gid:  -1,
+	}
+	if opts.Owner != "" {
+		var err error
+		if t.uid, t.gid, err = lookupOwner(m, opts.Owner); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	client, closer, err := NewSFTPClient(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	t.client = client
+	return t, closer, nil
+}
+
+// lookupOwner resolves user[:group] to ids on m.
+func lookupOwner(m Machine, owner string) (int, int, error) {
+	user, group := owner, ""
+	if i := strings.Index(owner, ":"); i >= 0 {
+		user, group = owner[:i], owner[i+1:]
+	}
+
+	// lookup runs cmd for name unless it is numeric already, and
+	// parses its output with parse; the command must fail for
+	// unknown names
+	lookup := func(cmd, name string, parse func(out string) (int, error)) (int, error) {
+		if id, err := strconv.Atoi(name); err == nil {
+			return id, nil
+		}
+		out, err := m.SSH(fmt.Sprintf(cmd, util.ShellQuote(name)))
+		if err != nil {
+			return -1, fmt.Errorf("looking up owner %q: %s: %v", owner, out, err)
+		}
+		id, err := parse(string(out))
+		if err != nil {
+			return -1, fmt.Errorf("looking up owner %q: %v", owner, err)
+		}
+		return id, nil
+	}
+
+	uid, err := lookup("id -u %s", user, strconv.Atoi)
+	if err != nil {
+		return -1, -1, err
+	}
+	var gid int
+	if group == "" {
+		gid, err = lookup("id -g %s", user, strconv.Atoi)
+	} else {
+		gid, err = lookup("getent group %s", group, func(out string) (int, error) {
+			// name:password:gid:members
+			fields := strings.Split(out, ":")
+			if len(fields) < 3 {
+				return -1, fmt.Errorf("unexpected group entry %q", out)
+			}
+			return strconv.Atoi(fields[2])
+		})
+	}
+	if err != nil {
+		return -1, -1, err
+	}
+	return uid, gid, nil
+}
+
+// Upload copies the file or directory tree at local to remote on m.
+// Missing parent directories of remote are created.
+func Upload(m Machine, local, remote string, opts *TransferOptions) error {
+	t, closer, err := newTransfer(m, opts)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	fi, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+	if err := t.client.MkdirAll(path.Dir(remote), 0755); err != nil {
+		return err
+	}
+	return t.upload(local, remote, fi)
+}
+
+func (t *transfer) upload(local, remote string, fi os.FileInfo) error {
+	if !fi.IsDir() {
+		return t.uploadFile(local, remote, fi)
+	}
+
+	err := t.client.Mkdir(remote, fi.Mode().Perm())
+	if err != nil {
+		// fine if it exists already
+		if rfi, serr := t.client.Stat(remote); serr != nil || !rfi.IsDir() {
+			return err
+		}
+	}
+	if err := t.setAttrs(remote, fi.Mode()); err != nil {
+		return err
+	}
+
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	entries, err := f.Readdir(0)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err := t.upload(filepath.Join(local, entry.Name()), path.Join(remote, entry.Name()), entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *transfer) uploadFile(local, remote string, fi os.FileInfo) error {
+	if !fi.Mode().IsRegular() {
+		plog.Warningf("not uploading %s: not a regular file", local)
+		return nil
+	}
+
+	in, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return t.write(in, remote, fi.Mode(), fi.Size())
+}
+
+// write copies in to the file remote, giving it mode unless the Mode
+// option overrides it. size is only used to report progress.
+func (t *transfer) write(in io.Reader, remote string, mode os.FileMode, size int64) error {
+	out, err := t.client.Create(remote, 0600)
+	if err != nil {
+		return err
+	}
+	sum := sha256.New()
+	_, err = io.Copy(out, t.progress(io.TeeReader(in, sum), remote, size))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if t.opts.Mode != 0 {
+		mode = t.opts.Mode
+	}
+	if err := t.setAttrs(remote, mode); err != nil {
+		return err
+	}
+	return t.verify(remote, sum)
+}
+
+// setAttrs sets the mode, and the owner if requested, of an uploaded
+// file. Modes are set explicitly since those at creation are subject
+// to the server's umask.
+func (t *transfer) setAttrs(remote string, mode os.FileMode) error {
+	if t.uid >= 0 {
+		if err := t.client.Chown(remote, t.uid, t.gid); err != nil {
+			return err
+		}
+	}
+	// chown may clear setuid and setgid bits, so chmod comes last
+	return t.client.Chmod(remote, mode)
+}
+
+// InstallFile copies data from in to the path to on m, creating missing
+// parent directories. The file is owned by root with mode 0755. Relative
+// paths are relative to the SSH user's home directory.
+func InstallFile(in io.Reader, m Machine, to string) error {
+	t, closer, err := newTransfer(m, nil)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	if err := t.client.MkdirAll(path.Dir(to), 0755); err != nil {
+		return fmt.Errorf("failed creating directory %s: %v", path.Dir(to), err)
+	}
+	return t.write(in, to, 0755, -1)
+}
+
+// ReadFile returns a io.ReadCloser that streams the requested file. The
+// caller should close the reader when finished.
+func ReadFile(m Machine, path string) (io.ReadCloser, error) {
+	client, closer, err := NewSFTPClient(m)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := client.Open(path)
+	if err != nil {
+		closer()
+		return nil, err
+	}
+	return &sftpReader{f, closer}, nil
+}
+
+// sftpReader is a remote file that ends its SFTP session when closed.
+type sftpReader struct {
+	*sftp.File
+	closer func()
+}
+
+func (r *sftpReader) Close() error {
+	defer r.closer()
+	return r.File.Close()
+}
+
+// Download copies the file or directory tree at remote on m to local.
+func Download(m Machine, remote, local string, opts *TransferOptions) error {
+	t, closer, err := newTransfer(m, opts)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	fi, err := t.client.Stat(remote)
+	if err != nil {
+		return err
+	}
+	return t.download(remote, local, fi)
+}
+
+func (t *transfer) download(remote, local string, fi *sftp.FileInfo) error {
+	if !fi.IsDir() {
+		return t.downloadFile(remote, local, fi)
+	}
+
+	if err := os.MkdirAll(local, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	entries, err := t.client.ReadDir(remote)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err := t.download(path.Join(remote, entry.Name()), filepath.Join(local, entry.Name()), entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *transfer) downloadFile(remote, local string, fi *sftp.FileInfo) error {
+	if !fi.Mode().IsRegular() {
+		plog.Warningf("not downloading %s: not a regular file", remote)
+		return nil
+	}
+
+	in, err := t.client.Open(remote)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	mode := fi.Mode().Perm()
+	if t.opts.Mode != 0 {
+		mode = t.opts.Mode
+	}
+	out, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	sum := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, sum), t.progress(in, remote, fi.Size()))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return t.verify(remote, sum)
+}
+
+// verify checks remote's checksum against sum if requested.
+func (t *transfer) verify(remote string, sum hash.Hash) error {
+	if !t.opts.Verify {
+		return nil
+	}
+
+	out, err := t.m.SSH("sudo sha256sum " + util.ShellQuote(remote))
+	if err != nil {
+		return fmt.Errorf("checksumming %s: %s: %v", remote, out, err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return fmt.Errorf("checksumming %s: no output", remote)
+	}
+	if local := hex.EncodeToString(sum.Sum(nil)); fields[0] != local {
+		return fmt.Errorf("checksum mismatch for %s: remote %s, local %s", remote, fields[0], local)
+	}
+	return nil
+}
+
+// progress reports reads from r through the Progress option.
+func (t *transfer) progress(r io.Reader, name string, total int64) io.Reader {
+	if t.opts.Progress == nil {
+		return r
+	}
+	t.opts.Progress(name, 0, total)
+	return &progressReader{r: r, name: name, total: total, fn: t.opts.Progress}
+}
+
+type progressReader struct {
+	r     io.Reader
+	name  string
+	done  int64
+	total int64
+	fn    func(path string, done, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.done += int64(n)
+		p.fn(p.name, p.done, p.total)
+	}
+	return n, err
+}
@@ -100,5 +100,9 @@ func StartReboot(m Machine) error {
 	if err != nil {
 		return fmt.Errorf("issuing reboot command failed: %v", out)
 	}
+
+	// the shared connection would outlive sshd.socket until the
+	// machine actually goes down
+	CloseSSHClient(m)
 	return nil
 }